@@ -0,0 +1,111 @@
+// Package audit records who changed which key and when. Events are written to
+// one or more sinks, sinks implementing Reader can be queried.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/bartke/datastream/storage"
+)
+
+// ErrNotReadable is returned by Multi.Events if none of the sinks is a Reader
+var ErrNotReadable = errors.New("audit sinks cannot be queried")
+
+const (
+	// ActionUpdate is the action of events of pushed values
+	ActionUpdate = "update"
+	// ActionDelete is the action of events of deleted keys
+	ActionDelete = "delete"
+)
+
+// Event is a change of a key
+type Event struct {
+	Time time.Time `json:"time"`
+	// Principal is the name of the authenticated caller, "anonymous" otherwise
+	Principal string `json:"principal"`
+	// Peer is the remote address of the caller
+	Peer   string `json:"peer,omitempty"`
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	// PreviousHash and NewHash are the hashes of the values before and after
+	// the change, see Hash, empty if the key did not exist or was deleted
+	PreviousHash string `json:"previous_hash,omitempty"`
+	NewHash      string `json:"new_hash,omitempty"`
+}
+
+// Hash returns the hex encoded SHA-256 of a value
+func Hash(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sink stores events
+type Sink interface {
+	Record(ctx context.Context, events []Event) error
+}
+
+// Reader is a sink whose events can be queried
+type Reader interface {
+	// Events returns the matching events, the most recent first
+	Events(ctx context.Context, query Query) ([]Event, error)
+}
+
+type Query struct {
+	// optional key or selector, all keys by default
+	Key string
+	// optional time range, Since is inclusive and Until exclusive
+	Since time.Time
+	Until time.Time
+	// optional maximum number of events, all matching events by default
+	Limit int
+}
+
+func (q Query) matches(e Event) bool {
+	if q.Key != "" && !storage.Match([]string{q.Key}, e.Key) {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	return q.Until.IsZero() || e.Time.Before(q.Until)
+}
+
+// newestFirst orders events by time, the most recent first, and applies the
+// limit of the query
+func (q Query) newestFirst(events []Event) []Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events
+}
+
+// Multi records events to all sinks and queries the first Reader among them
+type Multi []Sink
+
+// Record records to every sink even if one fails, the first error is returned
+func (m Multi) Record(ctx context.Context, events []Event) error {
+	var first error
+	for _, sink := range m {
+		if err := sink.Record(ctx, events); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m Multi) Events(ctx context.Context, query Query) ([]Event, error) {
+	for _, sink := range m {
+		if reader, ok := sink.(Reader); ok {
+			return reader.Events(ctx, query)
+		}
+	}
+	return nil, ErrNotReadable
+}
@@ -0,0 +1,143 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/audit"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var _ audit.Reader = &audit.JSONLFile{}
+var _ audit.Reader = &audit.SQLTable{}
+var _ audit.Sink = &audit.Syslog{}
+
+var base = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+var events = []audit.Event{
+	{Time: base, Principal: "alice", Peer: "10.0.0.1:5000", Action: audit.ActionUpdate, Key: "rate_limit", NewHash: audit.Hash([]byte("10"))},
+	{Time: base.Add(time.Minute), Principal: "bob", Action: audit.ActionUpdate, Key: "services/payments/limit", NewHash: audit.Hash([]byte("5"))},
+	{Time: base.Add(2 * time.Minute), Principal: "alice", Action: audit.ActionUpdate, Key: "rate_limit", PreviousHash: audit.Hash([]byte("10")), NewHash: audit.Hash([]byte("20"))},
+	{Time: base.Add(3 * time.Minute), Principal: "bob", Action: audit.ActionDelete, Key: "services/orders/limit", PreviousHash: audit.Hash([]byte("1"))},
+}
+
+// testReader records the events in two batches and queries them
+func testReader(t *testing.T, sink interface {
+	audit.Sink
+	audit.Reader
+}) {
+	ctx := context.Background()
+	if err := sink.Record(ctx, events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Record(ctx, events[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query audit.Query
+		want  []audit.Event
+	}{
+		{audit.Query{}, []audit.Event{events[3], events[2], events[1], events[0]}},
+		{audit.Query{Key: "rate_limit"}, []audit.Event{events[2], events[0]}},
+		{audit.Query{Key: "services/"}, []audit.Event{events[3], events[1]}},
+		{audit.Query{Key: "services/*/limit", Limit: 1}, []audit.Event{events[3]}},
+		{audit.Query{Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute)}, []audit.Event{events[2], events[1]}},
+		{audit.Query{Key: "missing"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := sink.Events(ctx, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Events(%+v) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestJSONLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.OpenJSONLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	testReader(t, sink)
+}
+
+func TestSQLTable(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sink, err := audit.NewSQLTable(audit.SQLConfig{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReader(t, sink)
+
+	// the table is reused
+	if _, err := audit.NewSQLTable(audit.SQLConfig{DB: db}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.NewSyslog(&buf, audit.SyslogConfig{AppName: "datastreamd", Hostname: "host"})
+	event := events[0]
+	event.Principal = `ali"ce]`
+	if err := sink.Record(context.Background(), []audit.Event{event, events[3]}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf.String())
+	}
+	want := `<133>1 2023-05-01T12:00:00Z host datastreamd `
+	if !strings.HasPrefix(lines[0], want) {
+		t.Errorf("line %q does not start with %q", lines[0], want)
+	}
+	for _, part := range []string{
+		` update [audit@32473 principal="ali\"ce\]" peer="10.0.0.1:5000" key="rate_limit" new_hash="`,
+		`] ali"ce] updated rate_limit`,
+	} {
+		if !strings.Contains(lines[0], part) {
+			t.Errorf("line %q does not contain %q", lines[0], part)
+		}
+	}
+	if !strings.HasSuffix(lines[1], "bob deleted services/orders/limit") {
+		t.Errorf("line %q", lines[1])
+	}
+}
+
+func TestMulti(t *testing.T) {
+	var buf bytes.Buffer
+	syslog := audit.NewSyslog(&buf, audit.SyslogConfig{})
+	if _, err := (audit.Multi{syslog}).Events(context.Background(), audit.Query{}); !errors.Is(err, audit.ErrNotReadable) {
+		t.Errorf("Events without a reader: %v, want ErrNotReadable", err)
+	}
+
+	jsonl, err := audit.OpenJSONLFile(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonl.Close()
+	multi := audit.Multi{syslog, jsonl}
+	if err := multi.Record(context.Background(), events[:2]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := multi.Events(context.Background(), audit.Query{})
+	if err != nil || len(got) != 2 || strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("multi recorded %v, %v and\n%s", got, err, buf.String())
+	}
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// JSONLFile appends events to a file as JSON lines, queries scan the file
+type JSONLFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenJSONLFile opens or creates the file events are appended to
+func OpenJSONLFile(path string) (*JSONLFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLFile{path: path, file: f}, nil
+}
+
+func (j *JSONLFile) Record(ctx context.Context, events []Event) error {
+	var lines []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a single write keeps the events of a batch together
+	if _, err := j.file.Write(lines); err != nil {
+		return fmt.Errorf("failed to write audit events: %w", err)
+	}
+	return nil
+}
+
+func (j *JSONLFile) Events(ctx context.Context, query Query) ([]Event, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", j.path, line, err)
+		}
+		if query.matches(event) {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return query.newestFirst(events), nil
+}
+
+func (j *JSONLFile) Close() error {
+	return j.file.Close()
+}
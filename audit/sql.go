@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bartke/datastream/internal/sqlutil"
+	"github.com/bartke/datastream/storage"
+)
+
+// DefaultTable is the table used when SQLConfig.Table is empty
+const DefaultTable = "audit"
+
+type SQLConfig struct {
+	DB *sql.DB
+
+	// optional table name, default is "audit", it is created if it does not
+	// exist
+	Table string
+
+	// optional placeholder style, "postgres" for $1, $2, ..., default is ?
+	Dialect string
+}
+
+// SQLTable stores events in a SQL table
+type SQLTable struct {
+	db       *sql.DB
+	table    string
+	postgres bool
+}
+
+// sqlSchema creates the audit table, {table} is replaced by the table name.
+// Times are stored as Unix nanoseconds to compare them as numbers.
+const sqlSchema = `
+	CREATE TABLE IF NOT EXISTS {table} (
+		time BIGINT NOT NULL,
+		principal TEXT NOT NULL,
+		peer TEXT NOT NULL,
+		action TEXT NOT NULL,
+		key TEXT NOT NULL,
+		previous_hash TEXT NOT NULL,
+		new_hash TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS {table}_key_time ON {table} (key, time);
+	CREATE INDEX IF NOT EXISTS {table}_time ON {table} (time)`
+
+func NewSQLTable(config SQLConfig) (*SQLTable, error) {
+	if config.Table == "" {
+		config.Table = DefaultTable
+	}
+	t := &SQLTable{db: config.DB, table: config.Table, postgres: config.Dialect == "postgres"}
+	for _, stmt := range strings.Split(strings.ReplaceAll(sqlSchema, "{table}", t.table), ";") {
+		if _, err := t.db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to create audit table %s: %w", t.table, err)
+		}
+	}
+	return t, nil
+}
+
+// rebind replaces ? placeholders for postgres
+func (t *SQLTable) rebind(query string) string {
+	if !t.postgres {
+		return query
+	}
+	return sqlutil.Rebind(query)
+}
+
+func (t *SQLTable) Record(ctx context.Context, events []Event) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, t.rebind("INSERT INTO "+t.table+" (time, principal, peer, action, key, previous_hash, new_hash) VALUES (?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range events {
+		if _, err := stmt.ExecContext(ctx, e.Time.UnixNano(), e.Principal, e.Peer, e.Action, e.Key, e.PreviousHash, e.NewHash); err != nil {
+			return fmt.Errorf("failed to write audit event: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (t *SQLTable) Events(ctx context.Context, query Query) ([]Event, error) {
+	conditions := []string{"1 = 1"}
+	var params []interface{}
+	switch {
+	case query.Key == "":
+	case storage.IsSelector(query.Key):
+		// narrowed down by the literal prefix, matched exactly below
+		conditions = append(conditions, "key LIKE ? ESCAPE '!'")
+		params = append(params, sqlutil.LikeEscaper.Replace(storage.SelectorPrefix(query.Key))+"%")
+	default:
+		conditions = append(conditions, "key = ?")
+		params = append(params, query.Key)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		params = append(params, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "time < ?")
+		params = append(params, query.Until.UnixNano())
+	}
+
+	rows, err := t.db.QueryContext(ctx, t.rebind(
+		"SELECT time, principal, peer, action, key, previous_hash, new_hash FROM "+t.table+
+			" WHERE "+strings.Join(conditions, " AND ")+" ORDER BY time DESC"), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() && (query.Limit <= 0 || len(events) < query.Limit) {
+		var e Event
+		var nanos int64
+		if err := rows.Scan(&nanos, &e.Principal, &e.Peer, &e.Action, &e.Key, &e.PreviousHash, &e.NewHash); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, nanos).UTC()
+		if query.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events, rows.Err()
+}
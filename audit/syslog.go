@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFacility is the syslog facility of events, local0
+const DefaultFacility = 16
+
+// severityNotice is the syslog severity of events
+const severityNotice = 5
+
+type SyslogConfig struct {
+	// optional application name, default is "datastream"
+	AppName string
+
+	// optional hostname, default is os.Hostname
+	Hostname string
+
+	// optional facility, default is DefaultFacility
+	Facility int
+}
+
+// Syslog writes events as RFC 5424 messages, one per line, to a stream such
+// as a file or a connection to a syslog server
+type Syslog struct {
+	appName  string
+	hostname string
+	priority int
+	pid      int
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewSyslog(w io.Writer, config SyslogConfig) *Syslog {
+	if config.AppName == "" {
+		config.AppName = "datastream"
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+	if config.Hostname == "" {
+		config.Hostname = "-"
+	}
+	if config.Facility == 0 {
+		config.Facility = DefaultFacility
+	}
+	return &Syslog{
+		appName:  config.AppName,
+		hostname: config.Hostname,
+		priority: config.Facility*8 + severityNotice,
+		pid:      os.Getpid(),
+		w:        w,
+	}
+}
+
+// sdEscaper escapes structured data parameter values
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func (s *Syslog) Record(ctx context.Context, events []Event) error {
+	var b strings.Builder
+	for _, e := range events {
+		fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [audit@32473", s.priority, e.Time.UTC().Format(time.RFC3339Nano), s.hostname, s.appName, s.pid, e.Action)
+		for _, param := range [][2]string{
+			{"principal", e.Principal},
+			{"peer", e.Peer},
+			{"key", e.Key},
+			{"previous_hash", e.PreviousHash},
+			{"new_hash", e.NewHash},
+		} {
+			if param[1] != "" {
+				fmt.Fprintf(&b, ` %s="%s"`, param[0], sdEscaper.Replace(param[1]))
+			}
+		}
+		fmt.Fprintf(&b, "] %s %sd %s\n", e.Principal, e.Action, e.Key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.w, b.String()); err != nil {
+		return fmt.Errorf("failed to write audit events: %w", err)
+	}
+	return nil
+}
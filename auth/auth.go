@@ -0,0 +1,148 @@
+// Package auth authenticates DataService calls by bearer token or client
+// certificate and attaches the authenticated principal to the call context.
+//
+//	a := auth.NewInterceptor(auth.InterceptorConfig{
+//		Authenticators: []auth.Authenticator{tokens, jwt},
+//	})
+//	grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(shared.LogMiddleware, a.Unary),
+//		grpc.StreamInterceptor(a.Stream),
+//	)
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/bartke/datastream/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrInvalidToken is returned by authenticators for tokens they do not accept
+var ErrInvalidToken = errors.New("invalid token")
+
+// Principal is the authenticated caller
+type Principal struct {
+	// Name is the token name, JWT subject or certificate identity
+	Name string
+	// optional groups of the caller
+	Groups []string
+	// Method is "token", "jwt" or "tls"
+	Method string
+}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of an authenticated call
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator validates a bearer token
+type Authenticator interface {
+	// Authenticate returns the principal of the token, ErrInvalidToken if the
+	// token is not accepted
+	Authenticate(ctx context.Context, token string) (Principal, error)
+}
+
+type InterceptorConfig struct {
+	// Authenticators are tried in order until one accepts the token
+	Authenticators []Authenticator
+
+	// optional, calls without a token are authenticated by their verified
+	// client certificate, see tlsconfig.PeerIdentity
+	ClientCertificates bool
+}
+
+// Interceptor rejects unauthenticated calls with UNAUTHENTICATED
+type Interceptor struct {
+	authenticators     []Authenticator
+	clientCertificates bool
+}
+
+func NewInterceptor(config InterceptorConfig) *Interceptor {
+	return &Interceptor{
+		authenticators:     config.Authenticators,
+		clientCertificates: config.ClientCertificates,
+	}
+}
+
+// Unary is a grpc.UnaryServerInterceptor
+func (a *Interceptor) Unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Stream is a grpc.StreamServerInterceptor
+func (a *Interceptor) Stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+func (a *Interceptor) authenticate(ctx context.Context) (context.Context, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		if a.clientCertificates {
+			if identity, ok := tlsconfig.PeerIdentity(ctx); ok {
+				return NewContext(ctx, Principal{Name: identity.Name(), Groups: identity.Organizations, Method: "tls"}), nil
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	for _, authenticator := range a.authenticators {
+		p, err := authenticator.Authenticate(ctx, token)
+		if errors.Is(err, ErrInvalidToken) {
+			continue
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "authentication failed: %v", err)
+		}
+		return NewContext(ctx, p), nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// bearerToken returns the token of the authorization header, empty if there
+// is none
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", nil
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || strings.TrimSpace(token) == "" {
+		return "", status.Error(codes.Unauthenticated, "malformed authorization header")
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// serverStream replaces the context of a stream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,241 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var _ auth.Authenticator = &auth.StaticTokens{}
+var _ auth.Authenticator = &auth.JWTAuthenticator{}
+
+const tokenFile = `
+# token   name     groups
+secret-1  updater  writers,ops
+secret-2  reader
+`
+
+const jwks = `{"keys": [
+	{"kty": "oct", "kid": "k1", "alg": "HS256", "k": "c2VjcmV0LWtleS1vbmU"},
+	{"kty": "oct", "kid": "k2", "k": "c2VjcmV0LWtleS10d28"},
+	{"kty": "RSA", "kid": "ignored"}
+]}`
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign returns an HS256 JWT
+func sign(t *testing.T, kid, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestStaticTokens(t *testing.T) {
+	tokens, err := auth.LoadTokenFile(writeFile(t, "tokens", tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := tokens.Authenticate(context.Background(), "secret-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (auth.Principal{Name: "updater", Groups: []string{"writers", "ops"}, Method: "token"}); !reflect.DeepEqual(p, want) {
+		t.Errorf("principal = %+v, want %+v", p, want)
+	}
+	if _, err := tokens.Authenticate(context.Background(), "secret-3"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("unknown token: %v, want ErrInvalidToken", err)
+	}
+
+	if _, err := auth.LoadTokenFile(writeFile(t, "tokens", "secret-1\n")); err == nil {
+		t.Error("token without a name loaded")
+	}
+	if _, err := auth.LoadTokenFile(writeFile(t, "tokens", "a x\na y\n")); err == nil {
+		t.Error("duplicate token loaded")
+	}
+}
+
+func TestJWT(t *testing.T) {
+	a, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+		JWKSFile: writeFile(t, "jwks.json", jwks),
+		Audience: "datastream",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":    "deployer",
+			"aud":    []string{"other", "datastream"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"writers"},
+		}
+	}
+	p, err := a.Authenticate(context.Background(), sign(t, "k1", "secret-key-one", valid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (auth.Principal{Name: "deployer", Groups: []string{"writers"}, Method: "jwt"}); !reflect.DeepEqual(p, want) {
+		t.Errorf("principal = %+v, want %+v", p, want)
+	}
+	if _, err := a.Authenticate(context.Background(), sign(t, "k2", "secret-key-two", valid())); err != nil {
+		t.Errorf("token of the second key: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+	}{
+		{"wrong key", func() string { return sign(t, "k1", "secret-key-two", valid()) }},
+		{"unknown key", func() string { return sign(t, "k3", "secret-key-one", valid()) }},
+		{"ambiguous key", func() string { return sign(t, "", "secret-key-one", valid()) }},
+		{"expired", func() string {
+			claims := valid()
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return sign(t, "k1", "secret-key-one", claims)
+		}},
+		{"no expiry", func() string {
+			claims := valid()
+			delete(claims, "exp")
+			return sign(t, "k1", "secret-key-one", claims)
+		}},
+		{"not yet valid", func() string {
+			claims := valid()
+			claims["nbf"] = time.Now().Add(time.Hour).Unix()
+			return sign(t, "k1", "secret-key-one", claims)
+		}},
+		{"audience", func() string {
+			claims := valid()
+			claims["aud"] = "other"
+			return sign(t, "k1", "secret-key-one", claims)
+		}},
+		{"no subject", func() string {
+			claims := valid()
+			delete(claims, "sub")
+			return sign(t, "k1", "secret-key-one", claims)
+		}},
+		{"alg none", func() string {
+			token := sign(t, "k1", "secret-key-one", valid())
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+			return header + token[strings.Index(token, "."):]
+		}},
+		{"not a jwt", func() string { return "secret-1" }},
+	}
+	for _, tt := range tests {
+		if _, err := a.Authenticate(context.Background(), tt.token()); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("%s: %v, want ErrInvalidToken", tt.name, err)
+		}
+	}
+}
+
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stream) Context() context.Context { return s.ctx }
+
+func TestInterceptor(t *testing.T) {
+	tokens, err := auth.LoadTokenFile(writeFile(t, "tokens", tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := auth.NewJWTAuthenticator(auth.JWTConfig{JWKSFile: writeFile(t, "jwks.json", jwks)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := auth.NewInterceptor(auth.InterceptorConfig{Authenticators: []auth.Authenticator{tokens, jwt}})
+
+	call := func(authorization ...string) (auth.Principal, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs())
+		if len(authorization) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization[0]))
+		}
+		var p auth.Principal
+		_, err := a.Unary(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			p, _ = auth.FromContext(ctx)
+			return nil, nil
+		})
+		return p, err
+	}
+
+	if p, err := call("Bearer secret-2"); err != nil || p.Name != "reader" {
+		t.Errorf("static token: %+v, %v", p, err)
+	}
+	token := sign(t, "k1", "secret-key-one", map[string]interface{}{"sub": "deployer", "exp": time.Now().Add(time.Hour).Unix()})
+	if p, err := call("bearer " + token); err != nil || p.Name != "deployer" {
+		t.Errorf("jwt: %+v, %v", p, err)
+	}
+	for _, authorization := range [][]string{{}, {"Bearer nope"}, {"Basic dXNlcjpwYXNz"}, {"Bearer "}} {
+		if _, err := call(authorization...); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("authorization %q: %v, want UNAUTHENTICATED", authorization, err)
+		}
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret-1"))
+	err = a.Stream(nil, &stream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+		if p, ok := auth.FromContext(ss.Context()); !ok || p.Name != "updater" {
+			t.Errorf("stream principal = %+v", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterceptorClientCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ctl", Organization: []string{"ops"}}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		p, _ := auth.FromContext(ctx)
+		return p, nil
+	}
+
+	a := auth.NewInterceptor(auth.InterceptorConfig{ClientCertificates: true})
+	p, err := a.Unary(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	if want := (auth.Principal{Name: "ctl", Groups: []string{"ops"}, Method: "tls"}); err != nil || !reflect.DeepEqual(p, want) {
+		t.Errorf("principal = %+v, %v, want %+v", p, err, want)
+	}
+
+	a = auth.NewInterceptor(auth.InterceptorConfig{})
+	if _, err := a.Unary(ctx, nil, &grpc.UnaryServerInfo{}, handler); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("client certificate accepted without ClientCertificates: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultLeeway is the clock skew tolerated for the exp and nbf claims
+const DefaultLeeway = time.Minute
+
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+type JWTConfig struct {
+	// JWKSFile is a JSON Web Key Set of the "oct" keys tokens are signed with
+	JWKSFile string
+
+	// optional issuer tokens must have
+	Issuer string
+
+	// optional audience tokens must include
+	Audience string
+
+	// optional claim holding the groups of the principal, default is "groups"
+	GroupsClaim string
+
+	// optional clock skew tolerated for exp and nbf, default is DefaultLeeway
+	Leeway time.Duration
+}
+
+// JWTAuthenticator accepts HMAC signed JWTs with a subject and expiry
+type JWTAuthenticator struct {
+	keys        map[string]jwk
+	issuer      string
+	audience    string
+	groupsClaim string
+	leeway      time.Duration
+}
+
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Key       string `json:"k"`
+
+	secret []byte
+}
+
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	contents, err := os.ReadFile(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", config.JWKSFile, err)
+	}
+
+	a := &JWTAuthenticator{
+		keys:        make(map[string]jwk),
+		issuer:      config.Issuer,
+		audience:    config.Audience,
+		groupsClaim: config.GroupsClaim,
+		leeway:      config.Leeway,
+	}
+	for _, key := range set.Keys {
+		if key.KeyType != "oct" {
+			continue
+		}
+		if _, ok := jwtAlgorithms[key.Algorithm]; key.Algorithm != "" && !ok {
+			return nil, fmt.Errorf("key %q: unsupported algorithm %s", key.KeyID, key.Algorithm)
+		}
+		if key.secret, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(key.Key, "=")); err != nil || len(key.secret) == 0 {
+			return nil, fmt.Errorf("key %q: invalid key", key.KeyID)
+		}
+		if _, ok := a.keys[key.KeyID]; ok {
+			return nil, fmt.Errorf("duplicate key %q", key.KeyID)
+		}
+		a.keys[key.KeyID] = key
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("no oct keys in %s", config.JWKSFile)
+	}
+	if a.groupsClaim == "" {
+		a.groupsClaim = "groups"
+	}
+	if a.leeway == 0 {
+		a.leeway = DefaultLeeway
+	}
+	return a, nil
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is a single audience or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, err
+	}
+	key, err := a.key(header)
+	if err != nil {
+		return Principal{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	mac := hmac.New(jwtAlgorithms[header.Algorithm], key.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return Principal{}, fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, err
+	}
+	if err := a.verify(claims, time.Now()); err != nil {
+		return Principal{}, err
+	}
+	var all map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return Principal{}, err
+	}
+	p := Principal{Name: claims.Subject, Method: "jwt"}
+	if groups, ok := all[a.groupsClaim]; ok {
+		if err := json.Unmarshal(groups, &p.Groups); err != nil {
+			return Principal{}, fmt.Errorf("%w: claim %s is not a list of strings", ErrInvalidToken, a.groupsClaim)
+		}
+	}
+	return p, nil
+}
+
+// key returns the key a token names, tokens without a key ID are accepted if
+// the set has a single key
+func (a *JWTAuthenticator) key(header jwtHeader) (jwk, error) {
+	if _, ok := jwtAlgorithms[header.Algorithm]; !ok {
+		return jwk{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Algorithm)
+	}
+	key, ok := a.keys[header.KeyID]
+	if !ok && header.KeyID == "" && len(a.keys) == 1 {
+		for _, key = range a.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return jwk{}, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, header.KeyID)
+	}
+	if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+		return jwk{}, fmt.Errorf("%w: key %q is not for %s", ErrInvalidToken, header.KeyID, header.Algorithm)
+	}
+	return key, nil
+}
+
+func (a *JWTAuthenticator) verify(claims jwtClaims, now time.Time) error {
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	if claims.ExpiresAt == nil {
+		return fmt.Errorf("%w: missing expiry", ErrInvalidToken)
+	}
+	if now.Add(-a.leeway).After(unixTime(*claims.ExpiresAt)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if claims.NotBefore != nil && now.Add(a.leeway).Before(unixTime(*claims.NotBefore)) {
+		return fmt.Errorf("%w: not yet valid", ErrInvalidToken)
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if a.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == a.audience {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: audience %q", ErrInvalidToken, claims.Audience)
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// StaticTokens accepts a fixed set of tokens, see LoadTokenFile
+type StaticTokens struct {
+	// tokens are looked up by their hash so the lookup does not leak timing
+	// information about the stored tokens
+	tokens map[[sha256.Size]byte]Principal
+}
+
+// LoadTokenFile reads a token file, one token per line followed by the
+// principal name and optional comma separated groups:
+//
+//	# token                           name     groups
+//	3f1b9c0d5e2a4f7b8c6d1e0f9a2b3c4d  updater  writers,ops
+//
+// Empty lines and lines starting with # are ignored.
+func LoadTokenFile(path string) (*StaticTokens, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &StaticTokens{tokens: make(map[[sha256.Size]byte]Principal)}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want token, name and optional groups", path, line)
+		}
+		p := Principal{Name: fields[1], Method: "token"}
+		if len(fields) == 3 {
+			p.Groups = strings.Split(fields[2], ",")
+		}
+		hash := sha256.Sum256([]byte(fields[0]))
+		if _, ok := tokens.tokens[hash]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, line)
+		}
+		tokens.tokens[hash] = p
+	}
+	return tokens, scanner.Err()
+}
+
+func (s *StaticTokens) Authenticate(ctx context.Context, token string) (Principal, error) {
+	p, ok := s.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Principal{}, ErrInvalidToken
+	}
+	return p, nil
+}
@@ -0,0 +1,390 @@
+// Package client provides a DataService client which keeps a local cache of
+// the subscribed keys up to date, reconnecting and resyncing when the
+// subscription fails.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bartke/datastream/codec"
+	"github.com/bartke/datastream/generated/datastream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultMinBackoff is the default delay before the first reconnect
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the default upper bound of the reconnect delay
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrNotFound is returned by the typed getters for keys not in the cache
+	ErrNotFound = errors.New("key not found")
+
+	// errStreamClosed is reported when the server ends a subscription
+	errStreamClosed = errors.New("subscription closed by server")
+)
+
+// tracer creates the spans of subscriptions
+var tracer = otel.Tracer("github.com/bartke/datastream/client")
+
+type Config struct {
+	// Keys are the keys or selectors to subscribe to
+	Keys []string
+
+	// optional delay before the first reconnect, doubled on every failed
+	// attempt up to MaxBackoff, defaults are 100ms and 30s
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// optional codecs for the typed getters, default is codec.Default
+	Codecs *codec.Registry
+
+	// optional error channel receiving subscription failures
+	ErrorChan chan<- error
+}
+
+// Client caches the values of subscribed keys. The cache is filled by Run,
+// values received from the server are shared and must not be modified.
+type Client struct {
+	service      datastream.DataServiceClient
+	keys         []string
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	codecs       *codec.Registry
+	errorChannel chan<- error
+
+	mu       sync.RWMutex
+	cache    map[string]*datastream.Data
+	revision int64
+	watchers map[string]map[*watcher]struct{}
+	changes  chan *datastream.Data
+
+	synced     chan struct{}
+	syncedOnce sync.Once
+}
+
+type watcher struct {
+	callback func(*datastream.Data)
+}
+
+// New creates a client for the given keys, Run has to be called to connect
+func New(service datastream.DataServiceClient, config Config) *Client {
+	if config.MinBackoff == 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	if config.Codecs == nil {
+		config.Codecs = codec.Default
+	}
+	return &Client{
+		service:      service,
+		keys:         config.Keys,
+		minBackoff:   config.MinBackoff,
+		maxBackoff:   config.MaxBackoff,
+		codecs:       config.Codecs,
+		errorChannel: config.ErrorChan,
+		cache:        make(map[string]*datastream.Data),
+		watchers:     make(map[string]map[*watcher]struct{}),
+		synced:       make(chan struct{}),
+	}
+}
+
+func (c *Client) forwardError(err error) {
+	if c.errorChannel != nil {
+		c.errorChannel <- err
+	}
+}
+
+// Run subscribes to the keys and keeps the cache up to date until ctx is done.
+// Failed subscriptions are retried with exponential backoff, every new
+// subscription starts with a snapshot the cache is resynced against.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.minBackoff
+	for {
+		received, err := c.subscribe(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.forwardError(err)
+
+		if received {
+			backoff = c.minBackoff
+		}
+		// wait between half and the full backoff to spread reconnects
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// subscribe applies the responses of a single subscription until it fails and
+// reports whether any response was received. The subscription is traced by a
+// span the server continues if the connection propagates it, see
+// tracing.DialOptions.
+func (c *Client) subscribe(ctx context.Context) (received bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "client subscribe", trace.WithAttributes(attribute.StringSlice("datastream.keys", c.keys)))
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	stream, err := c.service.Subscribe(ctx, &datastream.DataRequest{Keys: c.keys})
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return received, errStreamClosed
+		}
+		if err != nil {
+			return received, err
+		}
+		received = true
+		span.AddEvent("response", trace.WithAttributes(
+			attribute.Int64("datastream.revision", resp.Revision),
+			attribute.Int("datastream.changes", len(resp.Data)),
+		))
+		if err := c.apply(ctx, resp); err != nil {
+			return received, err
+		}
+	}
+}
+
+// apply updates the cache with a response and notifies about the changes
+func (c *Client) apply(ctx context.Context, resp *datastream.DataResponse) error {
+	var changes []*datastream.Data
+
+	c.mu.Lock()
+	if resp.Snapshot {
+		// keys missing from a snapshot were deleted while disconnected
+		for key, data := range c.cache {
+			if _, ok := resp.Data[key]; !ok {
+				changes = append(changes, &datastream.Data{Key: key, Deleted: true, Revision: data.Revision})
+				delete(c.cache, key)
+			}
+		}
+	}
+	for key, data := range resp.Data {
+		if data.Deleted {
+			if _, ok := c.cache[key]; ok {
+				delete(c.cache, key)
+				changes = append(changes, data)
+			}
+			continue
+		}
+		if cached, ok := c.cache[key]; ok && resp.Snapshot && proto.Equal(cached, data) {
+			continue
+		}
+		c.cache[key] = data
+		changes = append(changes, data)
+	}
+	if resp.Revision > c.revision {
+		c.revision = resp.Revision
+	}
+	c.mu.Unlock()
+
+	if resp.Snapshot {
+		c.syncedOnce.Do(func() { close(c.synced) })
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Revision != changes[j].Revision {
+			return changes[i].Revision < changes[j].Revision
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	for _, change := range changes {
+		if err := c.notify(ctx, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify calls the watchers of the changed key and sends the change to the
+// change channel
+func (c *Client) notify(ctx context.Context, change *datastream.Data) error {
+	c.mu.RLock()
+	watchers := make([]*watcher, 0, len(c.watchers[change.Key]))
+	for w := range c.watchers[change.Key] {
+		watchers = append(watchers, w)
+	}
+	changes := c.changes
+	c.mu.RUnlock()
+
+	for _, w := range watchers {
+		w.callback(change)
+	}
+
+	if changes != nil {
+		select {
+		case changes <- change:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// WaitSynced blocks until the first snapshot has been received
+func (c *Client) WaitSynced(ctx context.Context) error {
+	select {
+	case <-c.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns the cached value of key
+func (c *Client) Get(key string) (*datastream.Data, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.cache[key]
+	return data, ok
+}
+
+func (c *Client) lookup(key string) (*datastream.Data, error) {
+	data, ok := c.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return data, nil
+}
+
+// GetInt returns the cached value of key decoded as integer
+func (c *Client) GetInt(key string) (int64, error) {
+	data, err := c.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.codecs.Int(data.ValueType, data.Value)
+}
+
+// GetFloat returns the cached value of key decoded as float
+func (c *Client) GetFloat(key string) (float64, error) {
+	data, err := c.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.codecs.Float(data.ValueType, data.Value)
+}
+
+// GetBool returns the cached value of key decoded as bool
+func (c *Client) GetBool(key string) (bool, error) {
+	data, err := c.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	return c.codecs.Bool(data.ValueType, data.Value)
+}
+
+// GetDuration returns the cached value of key decoded as duration
+func (c *Client) GetDuration(key string) (time.Duration, error) {
+	data, err := c.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.codecs.Duration(data.ValueType, data.Value)
+}
+
+// GetString returns the cached value of key decoded as text
+func (c *Client) GetString(key string) (string, error) {
+	data, err := c.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	return c.codecs.String(data.ValueType, data.Value)
+}
+
+// Unmarshal decodes the cached value of a structured key, e.g. JSON, YAML or
+// protobuf, into v
+func (c *Client) Unmarshal(key string, v interface{}) error {
+	data, err := c.lookup(key)
+	if err != nil {
+		return err
+	}
+	return c.codecs.Unmarshal(data.ValueType, data.Value, v)
+}
+
+// Keys returns the cached keys in sorted order
+func (c *Client) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.cache))
+	for key := range c.cache {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Revision returns the latest store revision received
+func (c *Client) Revision() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.revision
+}
+
+// Watch calls callback with every change to key, deletions are passed as
+// tombstones. Callbacks are called sequentially from Run and should return
+// quickly. The returned function removes the watch.
+func (c *Client) Watch(key string, callback func(data *datastream.Data)) func() {
+	w := &watcher{callback: callback}
+
+	c.mu.Lock()
+	if c.watchers[key] == nil {
+		c.watchers[key] = make(map[*watcher]struct{})
+	}
+	c.watchers[key][w] = struct{}{}
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.watchers[key], w)
+		if len(c.watchers[key]) == 0 {
+			delete(c.watchers, key)
+		}
+	}
+}
+
+// Changes returns a channel receiving every change to the cache. Once
+// requested the channel has to be drained, Run blocks until a change is
+// received.
+func (c *Client) Changes() <-chan *datastream.Data {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == nil {
+		c.changes = make(chan *datastream.Data)
+	}
+	return c.changes
+}
@@ -0,0 +1,183 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/client"
+	"github.com/bartke/datastream/codec"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// flakyService allows breaking the current subscription
+type flakyService struct {
+	datastream.DataServiceClient
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+func (f *flakyService) Subscribe(ctx context.Context, in *datastream.DataRequest, opts ...grpc.CallOption) (datastream.DataService_SubscribeClient, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	f.mu.Lock()
+	f.cancel = cancel
+	f.mu.Unlock()
+	return f.DataServiceClient.Subscribe(ctx, in, opts...)
+}
+
+func (f *flakyService) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancel()
+}
+
+func setup(t *testing.T) (*storage.MemoryStorage, *flakyService) {
+	t.Helper()
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "max_connections", Value: []byte("10"), ValueType: "int"},
+			{Key: "rate_limit", Value: []byte("100"), ValueType: "int"},
+		},
+	})
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	datastream.RegisterDataServiceServer(server, service.NewDataServiceServer(store))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return store, &flakyService{DataServiceClient: datastream.NewDataServiceClient(conn)}
+}
+
+func run(t *testing.T, c *client.Client) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	wait, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	if err := c.WaitSynced(wait); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func push(t *testing.T, store storage.Storage, key, value string) {
+	t.Helper()
+	err := store.PushUpdate(context.Background(), &storage.Data{Key: key, Value: []byte(value), ValueType: "int"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func next(t *testing.T, changes <-chan *datastream.Data) *datastream.Data {
+	t.Helper()
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	return nil
+}
+
+func TestGetAndWatch(t *testing.T) {
+	store, svc := setup(t)
+	c := client.New(svc, client.Config{Keys: []string{"max_connections", "rate_limit"}})
+
+	watched := make(chan *datastream.Data, 10)
+	c.Watch("max_connections", func(data *datastream.Data) {
+		watched <- data
+	})
+	run(t, c)
+
+	data, ok := c.Get("rate_limit")
+	if !ok || string(data.Value) != "100" {
+		t.Fatalf("Get(rate_limit) = %v, %v, want 100", data, ok)
+	}
+	if initial := next(t, watched); string(initial.Value) != "10" {
+		t.Fatalf("initial watch value = %s, want 10", initial.Value)
+	}
+
+	push(t, store, "max_connections", "20")
+	if change := next(t, watched); string(change.Value) != "20" {
+		t.Fatalf("watch value = %s, want 20", change.Value)
+	}
+	if data, _ := c.Get("max_connections"); string(data.Value) != "20" {
+		t.Fatalf("cached value = %s, want 20", data.Value)
+	}
+}
+
+func TestResyncAfterReconnect(t *testing.T) {
+	store, svc := setup(t)
+	c := client.New(svc, client.Config{
+		Keys:       []string{"max_connections", "rate_limit"},
+		MinBackoff: time.Millisecond,
+	})
+	changes := c.Changes()
+	run(t, c)
+	next(t, changes)
+	next(t, changes)
+
+	// changes missed while disconnected are picked up by the resync, the
+	// unchanged key is not reported again
+	svc.disconnect()
+	if err := store.Delete(context.Background(), "rate_limit"); err != nil {
+		t.Fatal(err)
+	}
+	push(t, store, "max_connections", "30")
+
+	seen := make(map[string]*datastream.Data)
+	for len(seen) < 2 {
+		change := next(t, changes)
+		seen[change.Key] = change
+	}
+	if !seen["rate_limit"].Deleted || string(seen["max_connections"].Value) != "30" {
+		t.Fatalf("changes after reconnect = %v, want rate_limit deleted and max_connections=30", seen)
+	}
+	if _, ok := c.Get("rate_limit"); ok {
+		t.Errorf("deleted key still cached")
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	_, svc := setup(t)
+	c := client.New(svc, client.Config{Keys: []string{"max_connections"}})
+	run(t, c)
+
+	if v, err := c.GetInt("max_connections"); err != nil || v != 10 {
+		t.Errorf("GetInt = %v, %v, want 10", v, err)
+	}
+	if _, err := c.GetBool("max_connections"); !errors.Is(err, codec.ErrTypeMismatch) {
+		t.Errorf("GetBool of int = %v, want ErrTypeMismatch", err)
+	}
+	if _, err := c.GetInt("missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetInt of missing key = %v, want ErrNotFound", err)
+	}
+}
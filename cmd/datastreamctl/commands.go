@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// capsPageSize is the page size used to list all capabilities
+const capsPageSize = 500
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parse parses the flags of a command and checks the number of arguments
+func (c *cli) parse(flags *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	flags.SetOutput(c.stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if n := flags.NArg(); n < minArgs || (maxArgs >= 0 && n > maxArgs) {
+		for _, u := range usages {
+			if u.name == flags.Name() {
+				fmt.Fprintf(c.stderr, "usage: datastreamctl %s\n", u.usage)
+			}
+		}
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) unary(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// readValue returns value or stdin for "-"
+func (c *cli) readValue(value string) ([]byte, error) {
+	if value != "-" {
+		return []byte(value), nil
+	}
+	return io.ReadAll(c.stdin)
+}
+
+// listCapabilities pages through all capabilities matching the filters
+func (c *cli) listCapabilities(ctx context.Context, prefix string, tags []string) ([]*datastream.Capability, error) {
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+
+	var capabilities []*datastream.Capability
+	req := &datastream.ListCapabilitiesRequest{Prefix: prefix, Tags: tags, PageSize: capsPageSize}
+	for {
+		resp, err := c.service.ListCapabilities(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		capabilities = append(capabilities, resp.Capabilities...)
+		if resp.NextPageToken == "" {
+			return capabilities, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+func runCaps(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("caps", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "list keys with this prefix only")
+	var tags stringList
+	flags.Var(&tags, "tag", "list keys with this tag only, repeatable")
+	if err := c.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	capabilities, err := c.listCapabilities(ctx, *prefix, tags)
+	if err != nil {
+		return err
+	}
+	switch c.output {
+	case "json":
+		return writeJSON(c.stdout, &datastream.ListCapabilitiesResponse{Capabilities: capabilities})
+	case "raw":
+		for _, capability := range capabilities {
+			fmt.Fprintln(c.stdout, capability.Key)
+		}
+		return nil
+	}
+
+	t := newTable(c.stdout, "KEY", "TYPE", "ACCESS", "OWNER", "TAGS", "DESCRIPTION")
+	for _, capability := range capabilities {
+		access := "rw"
+		if capability.ReadOnly {
+			access = "ro"
+		}
+		t.row(capability.Key, capability.ValueType, access, capability.Owner, strings.Join(capability.Tags, ","), capability.Description)
+	}
+	return t.flush()
+}
+
+func runGet(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	asOf := flags.String("as-of", "", "read the values as of this RFC 3339 time or duration ago")
+	if err := c.parse(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	req := &datastream.DataRequest{Keys: flags.Args()}
+	var err error
+	if req.AsOf, err = parseTime(*asOf); err != nil {
+		return err
+	}
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.Sync(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	switch c.output {
+	case "json":
+		err = writeJSON(c.stdout, resp)
+	case "raw":
+		for i, data := range sortedData(resp.Data) {
+			if i > 0 {
+				fmt.Fprintln(c.stdout)
+			}
+			c.stdout.Write(data.Value)
+		}
+	default:
+		t := newTable(c.stdout, "KEY", "TYPE", "REVISION", "UPDATED", "VALUE")
+		for _, data := range sortedData(resp.Data) {
+			t.row(data.Key, data.ValueType, fmt.Sprint(data.Revision), data.UpdatedAt.AsTime().Local().Format("2006-01-02 15:04:05"), displayValue(data.Value))
+		}
+		err = t.flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, key := range flags.Args() {
+		if _, ok := resp.Data[key]; !ok && !storage.IsSelector(key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("key not found: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func runWatch(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	from := flags.Int64("from-revision", 0, "replay all changes since this revision instead of starting with the current state")
+	if err := c.parse(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	stream, err := c.service.Subscribe(ctx, &datastream.DataRequest{Keys: flags.Args(), FromRevision: *from})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("subscription closed by server")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch c.output {
+		case "json":
+			err = writeJSON(c.stdout, resp)
+		case "raw":
+			for _, data := range sortedData(resp.Data) {
+				c.stdout.Write(data.Value)
+				fmt.Fprintln(c.stdout)
+			}
+		default:
+			t := newTable(c.stdout)
+			for _, data := range sortedData(resp.Data) {
+				value := displayValue(data.Value)
+				if data.Deleted {
+					value = "<deleted>"
+				}
+				t.row(fmt.Sprint(data.Revision), data.Key, data.ValueType, value)
+			}
+			err = t.flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func runSet(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("set", flag.ContinueOnError)
+	valueType := flags.String("type", "", "value type, defaults to the declared type of the key")
+	expect := flags.Int64("expect-revision", -1, "only update if the key is at this revision, 0 if it must not exist")
+	if err := c.parse(flags, args, 2, 2); err != nil {
+		return err
+	}
+
+	value, err := c.readValue(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	data := &datastream.Data{Key: flags.Arg(0), Value: value, ValueType: *valueType}
+	if *expect >= 0 {
+		data.ExpectedRevision = expect
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	_, err = c.service.PushUpdate(ctx, data)
+	return err
+}
+
+func runDelete(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	if err := c.parse(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	for _, key := range flags.Args() {
+		if _, err := c.service.Delete(ctx, &datastream.DeleteRequest{Key: key}); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// exportFile is the format written by export and read by import
+type exportFile struct {
+	Revision int64         `json:"revision"`
+	Data     []exportEntry `json:"data"`
+}
+
+// exportEntry holds UTF-8 values as text and other values base64 encoded
+type exportEntry struct {
+	Key       string `json:"key"`
+	ValueType string `json:"value_type,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Base64    string `json:"base64,omitempty"`
+}
+
+func runExport(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	if err := c.parse(flags, args, 0, -1); err != nil {
+		return err
+	}
+
+	keys := flags.Args()
+	if len(keys) == 0 {
+		capabilities, err := c.listCapabilities(ctx, "", nil)
+		if err != nil {
+			return err
+		}
+		for _, capability := range capabilities {
+			keys = append(keys, capability.Key)
+		}
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.Sync(ctx, &datastream.DataRequest{Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	export := exportFile{Revision: resp.Revision, Data: []exportEntry{}}
+	for _, data := range sortedData(resp.Data) {
+		entry := exportEntry{Key: data.Key, ValueType: data.ValueType}
+		if utf8.Valid(data.Value) {
+			entry.Value = string(data.Value)
+		} else {
+			entry.Base64 = base64.StdEncoding.EncodeToString(data.Value)
+		}
+		export.Data = append(export.Data, entry)
+	}
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+func runImport(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	if err := c.parse(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	var input io.Reader = c.stdin
+	if path := flags.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	var export exportFile
+	if err := json.NewDecoder(input).Decode(&export); err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+
+	batch := &datastream.PushBatchRequest{}
+	for _, entry := range export.Data {
+		value := []byte(entry.Value)
+		if entry.Base64 != "" {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(entry.Base64); err != nil {
+				return fmt.Errorf("invalid value of %s: %w", entry.Key, err)
+			}
+		}
+		batch.Data = append(batch.Data, &datastream.Data{Key: entry.Key, Value: value, ValueType: entry.ValueType})
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	if _, err := c.service.PushBatch(ctx, batch); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "imported %d keys\n", len(batch.Data))
+	return nil
+}
+
+func runAudit(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	since := flags.String("since", "", "list events at or after this RFC 3339 time or duration ago, e.g. 24h")
+	until := flags.String("until", "", "list events before this RFC 3339 time or duration ago")
+	limit := flags.Int("limit", 100, "maximum number of events, 0 for all")
+	if err := c.parse(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	req := &datastream.ListAuditEventsRequest{Key: flags.Arg(0), Limit: int32(*limit)}
+	var err error
+	if req.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if req.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.ListAuditEvents(ctx, req)
+	if err != nil {
+		return err
+	}
+	switch c.output {
+	case "json":
+		return writeJSON(c.stdout, resp)
+	case "raw":
+		for _, e := range resp.Events {
+			fmt.Fprintf(c.stdout, "%s %s %s %s\n", e.Time.AsTime().Format(time.RFC3339Nano), e.Principal, e.Action, e.Key)
+		}
+		return nil
+	}
+
+	t := newTable(c.stdout, "TIME", "PRINCIPAL", "PEER", "ACTION", "KEY", "PREVIOUS", "NEW")
+	for _, e := range resp.Events {
+		t.row(e.Time.AsTime().Local().Format("2006-01-02 15:04:05"), e.Principal, e.Peer, e.Action, e.Key, shortHash(e.PreviousHash), shortHash(e.NewHash))
+	}
+	return t.flush()
+}
+
+func runHistory(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	limit := flags.Int("limit", 20, "maximum number of versions, 0 for all")
+	if err := c.parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.History(ctx, &datastream.HistoryRequest{Key: flags.Arg(0), Limit: int32(*limit)})
+	if err != nil {
+		return err
+	}
+	switch c.output {
+	case "json":
+		return writeJSON(c.stdout, resp)
+	case "raw":
+		for _, data := range resp.Versions {
+			c.stdout.Write(data.Value)
+			fmt.Fprintln(c.stdout)
+		}
+		return nil
+	}
+
+	t := newTable(c.stdout, "REVISION", "VERSION", "UPDATED", "TYPE", "VALUE")
+	for _, data := range resp.Versions {
+		value := displayValue(data.Value)
+		if data.Deleted {
+			value = "<deleted>"
+		}
+		t.row(fmt.Sprint(data.Revision), fmt.Sprint(data.Version), data.UpdatedAt.AsTime().Local().Format("2006-01-02 15:04:05"), data.ValueType, value)
+	}
+	return t.flush()
+}
+
+func runRollback(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	if err := c.parse(flags, args, 2, 2); err != nil {
+		return err
+	}
+	revision, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid revision %q", flags.Arg(1))
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.Rollback(ctx, &datastream.RollbackRequest{Key: flags.Arg(0), Revision: revision})
+	if err != nil {
+		return err
+	}
+	return c.writeRollback(resp)
+}
+
+func runRollbackTo(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("rollback-to", flag.ContinueOnError)
+	if err := c.parse(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	// the target is a revision, or an RFC 3339 time or duration ago
+	req := &datastream.RollbackToRequest{Keys: flags.Args()[1:]}
+	if revision, err := strconv.ParseInt(flags.Arg(0), 10, 64); err == nil {
+		req.Revision = revision
+	} else if req.AsOf, err = parseTime(flags.Arg(0)); err != nil {
+		return fmt.Errorf("invalid revision or time %q", flags.Arg(0))
+	}
+
+	ctx, cancel := c.unary(ctx)
+	defer cancel()
+	resp, err := c.service.RollbackTo(ctx, req)
+	if err != nil {
+		return err
+	}
+	return c.writeRollback(resp)
+}
+
+// writeRollback prints the changes of a rollback
+func (c *cli) writeRollback(resp *datastream.RollbackResponse) error {
+	switch c.output {
+	case "json":
+		return writeJSON(c.stdout, resp)
+	case "raw":
+		for _, data := range resp.Changes {
+			fmt.Fprintln(c.stdout, data.Key)
+		}
+		return nil
+	}
+
+	t := newTable(c.stdout, "KEY", "TYPE", "VALUE")
+	for _, data := range resp.Changes {
+		value := displayValue(data.Value)
+		if data.Deleted {
+			value = "<deleted>"
+		}
+		t.row(data.Key, data.ValueType, value)
+	}
+	if err := t.flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "restored %d keys to revision %d\n", len(resp.Changes), resp.Revision)
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or a duration before now, empty is unset
+func parseTime(value string) (*timestamppb.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamppb.New(t), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q, want RFC 3339 or a duration", value)
+	}
+	return timestamppb.New(time.Now().Add(-d)), nil
+}
+
+// shortHash abbreviates a value hash for tables
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// sortedData returns the entries of a response ordered by key
+func sortedData(data map[string]*datastream.Data) []*datastream.Data {
+	result := make([]*datastream.Data, 0, len(data))
+	for _, d := range data {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
@@ -0,0 +1,218 @@
+// Command datastreamctl inspects and modifies the keys of a DataService:
+//
+//	datastreamctl [flags] caps [-prefix p] [-tag t]
+//	datastreamctl [flags] get [-as-of t] key...
+//	datastreamctl [flags] watch [-from-revision n] key...
+//	datastreamctl [flags] set [-type t] [-expect-revision n] key value
+//	datastreamctl [flags] delete key...
+//	datastreamctl [flags] export [key...] > backup.json
+//	datastreamctl [flags] import [file]
+//	datastreamctl [flags] audit [-since t] [-until t] [-limit n] [key]
+//	datastreamctl [flags] history [-limit n] key
+//	datastreamctl [flags] rollback key revision
+//	datastreamctl [flags] rollback-to revision|t [key...]
+//
+// Keys of get, watch and export may be selectors such as "services/". A value
+// of "-" is read from stdin. Times are RFC 3339 times or durations ago, e.g.
+// "24h".
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// errUsage is returned for invalid command lines, the usage has been printed
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "datastreamctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// options are the global flags
+type options struct {
+	addr       string
+	timeout    time.Duration
+	output     string
+	tls        bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	skipVerify bool
+	token      string
+	tokenFile  string
+}
+
+// commands run a subcommand with its arguments
+var commands = map[string]func(ctx context.Context, c *cli, args []string) error{
+	"caps":        runCaps,
+	"get":         runGet,
+	"watch":       runWatch,
+	"set":         runSet,
+	"delete":      runDelete,
+	"export":      runExport,
+	"import":      runImport,
+	"audit":       runAudit,
+	"history":     runHistory,
+	"rollback":    runRollback,
+	"rollback-to": runRollbackTo,
+}
+
+// usages are the command lines of the commands in the order they are listed
+var usages = []struct{ name, usage string }{
+	{"caps", "caps [-prefix p] [-tag t]"},
+	{"get", "get [-as-of t] key..."},
+	{"watch", "watch [-from-revision n] key..."},
+	{"set", "set [-type t] [-expect-revision n] key value"},
+	{"delete", "delete key..."},
+	{"export", "export [key...]"},
+	{"import", "import [file]"},
+	{"audit", "audit [-since t] [-until t] [-limit n] [key]"},
+	{"history", "history [-limit n] key"},
+	{"rollback", "rollback key revision"},
+	{"rollback-to", "rollback-to revision|time [key...]"},
+}
+
+// cli is the state shared by the commands
+type cli struct {
+	options
+	service datastream.DataServiceClient
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("datastreamctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&o.addr, "addr", envOr("DATASTREAM_ADDR", "localhost:8080"), "server address, or $DATASTREAM_ADDR")
+	flags.DurationVar(&o.timeout, "timeout", 10*time.Second, "timeout of unary calls")
+	flags.StringVar(&o.output, "o", "table", "output format: table, json or raw")
+	flags.BoolVar(&o.tls, "tls", false, "connect with TLS, implied by -ca, -cert and -server-name")
+	flags.StringVar(&o.caFile, "ca", "", "CA bundle to verify the server with")
+	flags.StringVar(&o.certFile, "cert", "", "client certificate for mutual TLS")
+	flags.StringVar(&o.keyFile, "key", "", "client key for mutual TLS")
+	flags.StringVar(&o.serverName, "server-name", "", "server name to verify instead of the address host")
+	flags.BoolVar(&o.skipVerify, "insecure-skip-verify", false, "do not verify the server certificate")
+	flags.StringVar(&o.token, "token", os.Getenv("DATASTREAM_TOKEN"), "bearer token, or $DATASTREAM_TOKEN")
+	flags.StringVar(&o.tokenFile, "token-file", "", "file holding the bearer token")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: datastreamctl [flags] command [args]\n\ncommands:")
+		for _, u := range usages {
+			fmt.Fprintf(stderr, "  %s\n", u.usage)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return errUsage
+	}
+	switch o.output {
+	case "table", "json", "raw":
+	default:
+		return fmt.Errorf("unknown output format %q", o.output)
+	}
+
+	conn, err := dial(o)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	c := &cli{
+		options: o,
+		service: datastream.NewDataServiceClient(conn),
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+	}
+	return cmd(ctx, c, flags.Args()[1:])
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// dial connects to the server with the transport and token options
+func dial(o options) (*grpc.ClientConn, error) {
+	secure := o.tls || o.caFile != "" || o.certFile != "" || o.serverName != "" || o.skipVerify
+	creds := insecure.NewCredentials()
+	if secure {
+		var err error
+		creds, err = tlsconfig.NewClientCredentials(tlsconfig.Config{
+			CertFile:           o.certFile,
+			KeyFile:            o.keyFile,
+			CAFile:             o.caFile,
+			ServerName:         o.serverName,
+			InsecureSkipVerify: o.skipVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+
+	token := o.token
+	if o.tokenFile != "" {
+		contents, err := os.ReadFile(o.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+	if token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken{token: token, secure: secure}))
+	}
+	return grpc.Dial(o.addr, dialOptions...)
+}
+
+// bearerToken sends the token in the authorization header of every call
+type bearerToken struct {
+	token  string
+	secure bool
+}
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return t.secure
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/audit"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// startServer serves server and returns its address and the authorization
+// header of the last call
+func startServer(t *testing.T, server *service.DataServiceServer) (string, func() string) {
+	t.Helper()
+	var mu sync.Mutex
+	var authorization string
+	record := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		authorization = strings.Join(md.Get("authorization"), ",")
+		mu.Unlock()
+		return handler(ctx, req)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(record))
+	datastream.RegisterDataServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String(), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return authorization
+	}
+}
+
+// ctl runs datastreamctl against addr and returns its output
+func ctl(t *testing.T, addr, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), append([]string{"-addr", addr}, args...), strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestGetSetDelete(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Capabilities: []storage.Capability{{Key: "max_connections", ValueType: "int", Owner: "platform"}},
+	})
+	addr, authorization := startServer(t, service.NewDataServiceServer(store))
+
+	if _, err := ctl(t, addr, "", "-token", "secret", "set", "max_connections", "20"); err != nil {
+		t.Fatal(err)
+	}
+	if got := authorization(); got != "Bearer secret" {
+		t.Errorf("authorization = %q, want bearer token", got)
+	}
+	if _, err := ctl(t, addr, "binary\x00value", "set", "-type", "binary", "blob", "-"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl(t, addr, "", "set", "-type", "int", "max_connections", "many"); err == nil {
+		t.Error("set of an invalid int succeeded")
+	}
+
+	out, err := ctl(t, addr, "", "-o", "raw", "get", "blob")
+	if err != nil || out != "binary\x00value" {
+		t.Errorf("get -o raw = %q, %v, want the raw value", out, err)
+	}
+	out, err = ctl(t, addr, "", "get", "max_connections", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "max_connections  int") || !strings.Contains(out, `"binary\x00value"`) {
+		t.Errorf("get table =\n%s", out)
+	}
+	out, err = ctl(t, addr, "", "-o", "json", "get", "max_connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Data map[string]struct{ Value []byte }
+	}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || string(resp.Data["max_connections"].Value) != "20" {
+		t.Errorf("get -o json = %s, %v", out, err)
+	}
+
+	out, err = ctl(t, addr, "", "caps")
+	if err != nil || !strings.Contains(strings.Join(strings.Fields(out), " "), "max_connections int rw platform") {
+		t.Errorf("caps =\n%s%v", out, err)
+	}
+
+	if _, err := ctl(t, addr, "", "delete", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl(t, addr, "", "get", "blob"); err == nil || !strings.Contains(err.Error(), "key not found: blob") {
+		t.Errorf("get of deleted key = %v, want key not found", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	source, _ := startServer(t, service.NewDataServiceServer(storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "services/payments", Value: []byte(`{"limit": 5}`), ValueType: "json"},
+			{Key: "blob", Value: []byte{0xff, 0x00}, ValueType: "binary"},
+		},
+	})))
+	export, err := ctl(t, source, "", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := storage.NewMemoryStorage(storage.MemoryConfig{})
+	addr, _ := startServer(t, service.NewDataServiceServer(target))
+	if _, err := ctl(t, addr, export, "import"); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := target.Sync(context.Background(), []string{"services/", "blob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || !bytes.Equal(data["blob"].Value, []byte{0xff, 0x00}) || data["services/payments"].ValueType != "json" {
+		t.Errorf("imported %v", data)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "alpha", Value: []byte("1"), ValueType: "text/plain"}},
+	})
+	addr, _ := startServer(t, service.NewDataServiceServer(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stdout := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{"-addr", addr, "-o", "raw", "watch", "alpha"}, nil, stdout, &bytes.Buffer{})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(stdout.String(), "1\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := store.PushUpdate(context.Background(), &storage.Data{Key: "alpha", Value: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	for stdout.String() != "1\n2\n" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "1\n2\n" {
+		t.Errorf("watch output = %q, want both values", got)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	sink, err := audit.OpenJSONLFile(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	addr, _ := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Audit: sink}))
+
+	for _, value := range []string{"10", "20"} {
+		if _, err := ctl(t, addr, "", "set", "rate_limit", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ctl(t, addr, "", "set", "other", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ctl(t, addr, "", "-o", "raw", "audit", "-since", "1h", "rate_limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " anonymous update rate_limit") {
+		t.Errorf("audit =\n%s", out)
+	}
+	out, err = ctl(t, addr, "", "audit", "-limit", "1")
+	if err != nil || !strings.Contains(out, "other") || strings.Contains(out, "rate_limit") {
+		t.Errorf("audit -limit 1 =\n%s%v", out, err)
+	}
+	if _, err := ctl(t, addr, "", "audit", "-until", "yesterday"); err == nil {
+		t.Error("invalid -until accepted")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	addr, _ := startServer(t, service.NewDataServiceServer(store))
+
+	for _, value := range []string{"10", "20"} {
+		if _, err := ctl(t, addr, "", "set", "rate_limit", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := ctl(t, addr, "", "delete", "rate_limit"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ctl(t, addr, "", "history", "rate_limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[1], "<deleted>") || !strings.HasSuffix(lines[3], " 10") {
+		t.Errorf("history =\n%s", out)
+	}
+	out, err = ctl(t, addr, "", "-o", "raw", "history", "-limit", "1", "rate_limit")
+	if err != nil || out != "\n" {
+		t.Errorf("history -limit 1 = %q, %v, want the tombstone", out, err)
+	}
+
+	out, err = ctl(t, addr, "", "-o", "raw", "get", "-as-of", between.Format(time.RFC3339Nano), "rate_limit")
+	if err != nil || out != "20" {
+		t.Errorf("get -as-of = %q, %v, want the value before the deletion", out, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	addr, _ := startServer(t, service.NewDataServiceServer(store))
+
+	for _, args := range [][]string{{"rate_limit", "10"}, {"rate_limit", "20"}, {"timeout", "5"}} {
+		if _, err := ctl(t, addr, "", append([]string{"set"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := ctl(t, addr, "", "rollback", "rate_limit", "1")
+	if err != nil || !strings.Contains(strings.Join(strings.Fields(out), " "), "rate_limit 10") {
+		t.Errorf("rollback =\n%s%v", out, err)
+	}
+	out, err = ctl(t, addr, "", "-o", "raw", "rollback-to", "1")
+	if err != nil || out != "timeout\n" {
+		t.Errorf("rollback-to = %q, %v, want the deletion of timeout", out, err)
+	}
+	if out, err := ctl(t, addr, "", "-o", "raw", "get", "rate_limit"); err != nil || out != "10" {
+		t.Errorf("rate_limit after rollback = %q, %v", out, err)
+	}
+	if _, err := ctl(t, addr, "", "rollback", "rate_limit", "latest"); err == nil {
+		t.Error("invalid revision accepted")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"unknown"}, {"set", "key"}} {
+		var stderr bytes.Buffer
+		err := run(context.Background(), args, nil, &bytes.Buffer{}, &stderr)
+		if err != errUsage || !strings.Contains(stderr.String(), "usage: datastreamctl") {
+			t.Errorf("run(%q) = %v, %q, want usage", args, err, stderr.String())
+		}
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
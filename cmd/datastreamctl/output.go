@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// table writes aligned columns
+type table struct {
+	w *tabwriter.Writer
+}
+
+// newTable starts a table with an optional header
+func newTable(w io.Writer, header ...string) *table {
+	t := &table{w: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+	if len(header) > 0 {
+		t.row(header...)
+	}
+	return t
+}
+
+func (t *table) row(columns ...string) {
+	fmt.Fprintln(t.w, strings.Join(columns, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.w.Flush()
+}
+
+// writeJSON writes a message as a single line of JSON
+func writeJSON(w io.Writer, m proto.Message) error {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// displayValue formats a value for a table cell, text with control characters
+// is quoted and binary values are summarized
+func displayValue(value []byte) string {
+	if !utf8.Valid(value) {
+		return fmt.Sprintf("<%d bytes>", len(value))
+	}
+	s := string(value)
+	if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bartke/datastream/audit"
+)
+
+// closers closes all of its closers
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// newAudit opens the configured audit sinks, the sink is nil if none is
+// configured. ListAuditEvents queries the file before the SQL table.
+func newAudit(config AuditConfig) (audit.Sink, io.Closer, error) {
+	var sinks audit.Multi
+	var opened closers
+	fail := func(err error) (audit.Sink, io.Closer, error) {
+		opened.Close()
+		return nil, nil, err
+	}
+
+	if config.File != "" {
+		file, err := audit.OpenJSONLFile(config.File)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open audit file: %w", err))
+		}
+		sinks, opened = append(sinks, file), append(opened, file)
+	}
+	if config.SQL.Driver != "" {
+		db, err := sql.Open(config.SQL.Driver, config.SQL.DSN)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open audit database: %w", err))
+		}
+		opened = append(opened, db)
+		dialect := ""
+		if config.SQL.Driver == "postgres" {
+			dialect = "postgres"
+		}
+		table, err := audit.NewSQLTable(audit.SQLConfig{DB: db, Table: config.SQL.Table, Dialect: dialect})
+		if err != nil {
+			return fail(err)
+		}
+		sinks = append(sinks, table)
+	}
+	if config.Syslog.Network != "" {
+		conn, err := net.Dial(config.Syslog.Network, config.Syslog.Address)
+		if err != nil {
+			return fail(fmt.Errorf("failed to connect to syslog: %w", err))
+		}
+		opened = append(opened, conn)
+		appName := config.Syslog.AppName
+		if appName == "" {
+			appName = "datastreamd"
+		}
+		sinks = append(sinks, audit.NewSyslog(conn, audit.SyslogConfig{AppName: appName}))
+	}
+
+	if len(sinks) == 0 {
+		return nil, opened, nil
+	}
+	return sinks, opened, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bartke/datastream/metrics"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	_ "github.com/lib/pq"
+)
+
+// sqliteSchema creates the data table of a new sqlite database
+const sqliteSchema = `
+	CREATE TABLE IF NOT EXISTS %s (
+		key TEXT PRIMARY KEY,
+		value BLOB,
+		value_type TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+
+// postgresSchema creates the data table of a new postgres database
+const postgresSchema = `
+	CREATE TABLE IF NOT EXISTS %s (
+		key TEXT PRIMARY KEY,
+		value BYTEA,
+		value_type TEXT,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`
+
+// newStore creates the configured backend, the returned closer releases its
+// resources
+func newStore(config *Config, m *metrics.Metrics, errs chan<- error) (storage.Storage, io.Closer, error) {
+	backend := config.Backend
+	switch backend.Type {
+	case "sqlite":
+		db, err := sql.Open("sqlite3", backend.SQLite.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		table := backend.SQLite.Table
+		if table == "" {
+			table = storage.DefaultTable
+		}
+		if _, err := db.Exec(fmt.Sprintf(sqliteSchema, table)); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		store, err := storage.NewSQLiteStorage(storage.SQLConfig{
+			DB:           db,
+			Table:        table,
+			SyncInterval: config.SyncInterval,
+			ErrorChan:    errs,
+			Metrics:      m,
+		})
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return store, db, nil
+
+	case "postgres":
+		db, err := sql.Open("postgres", backend.Postgres.DSN)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		table := backend.Postgres.Table
+		if table == "" {
+			table = storage.DefaultTable
+		}
+		if _, err := db.Exec(fmt.Sprintf(postgresSchema, table)); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		store, err := storage.NewPostgresStorage(storage.SQLConfig{
+			DB:           db,
+			Table:        table,
+			SyncInterval: config.SyncInterval,
+			ErrorChan:    errs,
+			Metrics:      m,
+		})
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return store, db, nil
+
+	case "git":
+		store, err := storage.NewGitRepository(storage.GitRepositoryConfig{
+			RepoPath:     backend.Git.Repo,
+			CloneDir:     backend.Git.CloneDir,
+			Username:     backend.Git.Username,
+			Password:     backend.Git.Password,
+			CommitName:   backend.Git.CommitName,
+			CommitEmail:  backend.Git.CommitEmail,
+			SyncInterval: config.SyncInterval,
+			ErrorChannel: errs,
+			Metrics:      m,
+		})
+		return store, nopCloser{}, err
+
+	case "s3":
+		store, err := storage.NewS3Storage(storage.S3StorageConfig{
+			Endpoint:     backend.S3.Endpoint,
+			Region:       backend.S3.Region,
+			Bucket:       backend.S3.Bucket,
+			AccessKey:    backend.S3.AccessKey,
+			SecretKey:    backend.S3.SecretKey,
+			AccessToken:  backend.S3.AccessToken,
+			SyncInterval: config.SyncInterval,
+			ErrorChan:    errs,
+			Metrics:      m,
+		})
+		return store, nopCloser{}, err
+
+	case "memory":
+		seed := make([]storage.Data, len(backend.Memory.Seed))
+		for i, entry := range backend.Memory.Seed {
+			seed[i] = storage.Data{Key: entry.Key, Value: []byte(entry.Value), ValueType: entry.ValueType}
+		}
+		return storage.NewMemoryStorage(storage.MemoryConfig{Seed: seed}), nopCloser{}, nil
+	}
+	return nil, nil, fmt.Errorf("unknown backend type %q", backend.Type)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// newValidator loads the configured schema files
+func newValidator(config *Config) (*service.Validator, error) {
+	schemas := make(map[string][]byte, len(config.Schemas))
+	for selector, path := range config.Schemas {
+		schema, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema for %s: %w", selector, err)
+		}
+		schemas[selector] = schema
+	}
+	return service.NewValidator(service.ValidatorConfig{Schemas: schemas})
+}
+
+// newPolicy loads the policy file, without one the policy is nil and allows
+// everything
+func newPolicy(config *Config) (*service.Policy, error) {
+	if config.PolicyFile == "" {
+		return nil, nil
+	}
+	rules, err := service.LoadPolicyFile(config.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewPolicy(service.PolicyConfig{Rules: rules})
+}
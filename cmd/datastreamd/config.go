@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bartke/datastream/tracing"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultListen          = ":8080"
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// Config is the server configuration, loaded from a YAML or TOML file
+type Config struct {
+	// optional listen address, default is :8080
+	Listen string `yaml:"listen" toml:"listen"`
+
+	// optional TLS certificate and key, the server is plaintext without them
+	TLS TLSConfig `yaml:"tls" toml:"tls"`
+
+	// optional backend poll interval, default is storage.DefaultSyncInterval
+	SyncInterval time.Duration `yaml:"sync_interval" toml:"sync_interval"`
+
+	// optional time to wait for open calls on shutdown before they are
+	// canceled, default is 10 seconds
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// optional interceptors in the order they are applied, e.g. recovery, log,
+	// auth
+	Interceptors []string `yaml:"interceptors" toml:"interceptors"`
+
+	// optional authentication of the auth interceptor
+	Auth AuthConfig `yaml:"auth" toml:"auth"`
+
+	// optional JSON schema files by key or selector
+	Schemas map[string]string `yaml:"schemas" toml:"schemas"`
+
+	// optional authorization policy file, see service.LoadPolicyFile, every
+	// caller may act on every key without it. It requires the auth interceptor
+	// to identify the callers.
+	PolicyFile string `yaml:"policy_file" toml:"policy_file"`
+
+	// optional audit log of updates and deletions
+	Audit AuditConfig `yaml:"audit" toml:"audit"`
+
+	// optional Prometheus metrics
+	Metrics MetricsConfig `yaml:"metrics" toml:"metrics"`
+
+	// optional OpenTelemetry tracing, calls are traced by the tracing
+	// interceptor
+	Tracing TracingConfig `yaml:"tracing" toml:"tracing"`
+
+	Backend BackendConfig `yaml:"backend" toml:"backend"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+
+	// optional CA bundle, clients have to present a certificate signed by it
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+
+	// optional interval to check the files for rotated certificates, default
+	// is tlsconfig.DefaultReloadInterval
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+type AuthConfig struct {
+	// optional static token file, see auth.LoadTokenFile
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+
+	// optional HMAC signed JWTs
+	JWT JWTConfig `yaml:"jwt" toml:"jwt"`
+
+	// optional, calls without a token are authenticated by their client
+	// certificate, requires tls.client_ca_file
+	ClientCertificates bool `yaml:"client_certificates" toml:"client_certificates"`
+}
+
+type JWTConfig struct {
+	JWKSFile string `yaml:"jwks_file" toml:"jwks_file"`
+	// optional issuer and audience tokens must have
+	Issuer   string `yaml:"issuer" toml:"issuer"`
+	Audience string `yaml:"audience" toml:"audience"`
+	// optional claim holding the groups, default is "groups"
+	GroupsClaim string `yaml:"groups_claim" toml:"groups_claim"`
+}
+
+type AuditConfig struct {
+	// optional JSON lines file
+	File string `yaml:"file" toml:"file"`
+
+	// optional SQL table
+	SQL AuditSQLConfig `yaml:"sql" toml:"sql"`
+
+	// optional syslog server
+	Syslog AuditSyslogConfig `yaml:"syslog" toml:"syslog"`
+}
+
+type AuditSQLConfig struct {
+	// Driver is sqlite3 or postgres
+	Driver string `yaml:"driver" toml:"driver"`
+	DSN    string `yaml:"dsn" toml:"dsn"`
+	// optional table name, default is "audit"
+	Table string `yaml:"table" toml:"table"`
+}
+
+type AuditSyslogConfig struct {
+	// Network is udp, tcp or unix
+	Network string `yaml:"network" toml:"network"`
+	Address string `yaml:"address" toml:"address"`
+	// optional application name, default is "datastreamd"
+	AppName string `yaml:"app_name" toml:"app_name"`
+}
+
+type MetricsConfig struct {
+	// optional HTTP listen address of the /metrics endpoint, e.g. :9090,
+	// metrics are disabled without it
+	Listen string `yaml:"listen" toml:"listen"`
+}
+
+type TracingConfig struct {
+	// Exporter is otlp or stdout, tracing is disabled without it
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// optional OTLP collector address, default is localhost:4317
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// optional, connect to the OTLP collector without TLS
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// optional service name, default is "datastreamd"
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+	// optional fraction of traces sampled, default is 1
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+type BackendConfig struct {
+	// Type is one of sqlite, postgres, git, s3 or memory
+	Type string `yaml:"type" toml:"type"`
+
+	SQLite   SQLiteConfig   `yaml:"sqlite" toml:"sqlite"`
+	Postgres PostgresConfig `yaml:"postgres" toml:"postgres"`
+	Git      GitConfig      `yaml:"git" toml:"git"`
+	S3       S3Config       `yaml:"s3" toml:"s3"`
+	Memory   MemoryConfig   `yaml:"memory" toml:"memory"`
+}
+
+type SQLiteConfig struct {
+	// database file, the data table is created if it does not exist
+	Path string `yaml:"path" toml:"path"`
+	// optional table name, default is "data"
+	Table string `yaml:"table" toml:"table"`
+}
+
+type PostgresConfig struct {
+	// connection string, the data table is created if it does not exist
+	DSN string `yaml:"dsn" toml:"dsn"`
+	// optional table name, default is "data"
+	Table string `yaml:"table" toml:"table"`
+}
+
+type GitConfig struct {
+	// local repository path or remote URL
+	Repo string `yaml:"repo" toml:"repo"`
+	// optional directory remote repositories are cloned into
+	CloneDir    string `yaml:"clone_dir" toml:"clone_dir"`
+	Username    string `yaml:"username" toml:"username"`
+	Password    string `yaml:"password" toml:"password"`
+	CommitName  string `yaml:"commit_name" toml:"commit_name"`
+	CommitEmail string `yaml:"commit_email" toml:"commit_email"`
+}
+
+type S3Config struct {
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	Region      string `yaml:"region" toml:"region"`
+	Bucket      string `yaml:"bucket" toml:"bucket"`
+	AccessKey   string `yaml:"access_key" toml:"access_key"`
+	SecretKey   string `yaml:"secret_key" toml:"secret_key"`
+	AccessToken string `yaml:"access_token" toml:"access_token"`
+}
+
+type MemoryConfig struct {
+	// optional initial values
+	Seed []SeedEntry `yaml:"seed" toml:"seed"`
+}
+
+type SeedEntry struct {
+	Key       string `yaml:"key" toml:"key"`
+	Value     string `yaml:"value" toml:"value"`
+	ValueType string `yaml:"value_type" toml:"value_type"`
+}
+
+// LoadConfig reads a configuration file, the format is chosen by the file
+// extension. Environment variables referenced as ${NAME} are expanded, e.g.
+// to keep secrets out of the file.
+func LoadConfig(path string) (*Config, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	contents = []byte(os.ExpandEnv(string(contents)))
+
+	var config Config
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &config)
+	case ".toml":
+		err = toml.Unmarshal(contents, &config)
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, use .yaml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	if config.Listen == "" {
+		config.Listen = defaultListen
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	return &config, config.validate()
+}
+
+func (c *Config) validate() error {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls requires both cert_file and key_file")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls client_ca_file requires cert_file and key_file")
+	}
+	authenticated := false
+	for _, name := range c.Interceptors {
+		if _, ok := interceptors[name]; !ok {
+			return fmt.Errorf("unknown interceptor %q", name)
+		}
+		authenticated = authenticated || name == "auth"
+	}
+	switch c.Audit.SQL.Driver {
+	case "", "sqlite3", "postgres":
+	default:
+		return fmt.Errorf("unknown audit sql driver %q", c.Audit.SQL.Driver)
+	}
+	if (c.Audit.SQL.Driver == "") != (c.Audit.SQL.DSN == "") {
+		return fmt.Errorf("audit sql requires both driver and dsn")
+	}
+	if (c.Audit.Syslog.Network == "") != (c.Audit.Syslog.Address == "") {
+		return fmt.Errorf("audit syslog requires both network and address")
+	}
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample_ratio %v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+	if c.Auth.ClientCertificates && c.TLS.ClientCAFile == "" {
+		return fmt.Errorf("auth client_certificates requires tls client_ca_file")
+	}
+	if c.PolicyFile != "" && !authenticated {
+		return fmt.Errorf("policy_file requires the auth interceptor")
+	}
+	switch c.Backend.Type {
+	case "sqlite":
+		if c.Backend.SQLite.Path == "" {
+			return fmt.Errorf("sqlite backend requires a path")
+		}
+	case "postgres":
+		if c.Backend.Postgres.DSN == "" {
+			return fmt.Errorf("postgres backend requires a dsn")
+		}
+	case "git":
+		if c.Backend.Git.Repo == "" {
+			return fmt.Errorf("git backend requires a repo")
+		}
+	case "s3":
+		if c.Backend.S3.Bucket == "" {
+			return fmt.Errorf("s3 backend requires a bucket")
+		}
+	case "memory":
+	case "":
+		return fmt.Errorf("missing backend type")
+	default:
+		return fmt.Errorf("unknown backend type %q", c.Backend.Type)
+	}
+	return nil
+}
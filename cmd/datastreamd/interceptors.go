@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/bartke/datastream/auth"
+	"github.com/bartke/datastream/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// interceptor is a pair of unary and stream server interceptors
+type interceptor struct {
+	unary  grpc.UnaryServerInterceptor
+	stream grpc.StreamServerInterceptor
+}
+
+// interceptors creates the interceptors by the name used in the config
+var interceptors = map[string]func(config *Config) (interceptor, error){
+	"log": func(*Config) (interceptor, error) {
+		return interceptor{unary: logUnary, stream: logStream}, nil
+	},
+	"recovery": func(*Config) (interceptor, error) {
+		return interceptor{unary: recoverUnary, stream: recoverStream}, nil
+	},
+	"auth":    authInterceptor,
+	"tracing": tracingInterceptor,
+}
+
+// serverOptions chains the configured interceptors, the first one is the
+// outermost
+func serverOptions(config *Config) ([]grpc.ServerOption, error) {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	for _, name := range config.Interceptors {
+		i, err := interceptors[name](config)
+		if err != nil {
+			return nil, err
+		}
+		if i.unary != nil {
+			unary = append(unary, i.unary)
+		}
+		if i.stream != nil {
+			stream = append(stream, i.stream)
+		}
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}, nil
+}
+
+// authInterceptor authenticates calls by the configured token file, JWT keys
+// and client certificates
+func authInterceptor(config *Config) (interceptor, error) {
+	var authenticators []auth.Authenticator
+	if config.Auth.TokenFile != "" {
+		tokens, err := auth.LoadTokenFile(config.Auth.TokenFile)
+		if err != nil {
+			return interceptor{}, fmt.Errorf("failed to load token file: %w", err)
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if config.Auth.JWT.JWKSFile != "" {
+		jwt, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+			JWKSFile:    config.Auth.JWT.JWKSFile,
+			Issuer:      config.Auth.JWT.Issuer,
+			Audience:    config.Auth.JWT.Audience,
+			GroupsClaim: config.Auth.JWT.GroupsClaim,
+		})
+		if err != nil {
+			return interceptor{}, fmt.Errorf("failed to load JWT keys: %w", err)
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	if len(authenticators) == 0 && !config.Auth.ClientCertificates {
+		return interceptor{}, fmt.Errorf("auth interceptor requires a token_file, jwt jwks_file or client_certificates")
+	}
+
+	a := auth.NewInterceptor(auth.InterceptorConfig{
+		Authenticators:     authenticators,
+		ClientCertificates: config.Auth.ClientCertificates,
+	})
+	return interceptor{unary: a.Unary, stream: a.Stream}, nil
+}
+
+// tracingInterceptor starts a span for every call, the spans are exported as
+// configured in the tracing section
+func tracingInterceptor(config *Config) (interceptor, error) {
+	if config.Tracing.Exporter == "" {
+		return interceptor{}, fmt.Errorf("tracing interceptor requires a tracing exporter")
+	}
+	return interceptor{unary: tracing.UnaryServerInterceptor(), stream: tracing.StreamServerInterceptor()}, nil
+}
+
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	log.Printf("method: %s, duration: %s, error: %v", info.FullMethod, time.Since(start), err)
+	return resp, err
+}
+
+func logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	log.Printf("method: %s, duration: %s, error: %v", info.FullMethod, time.Since(start), err)
+	return err
+}
+
+// recovered converts a panic in a handler into an INTERNAL error
+func recovered(method string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("method: %s, panic: %v\n%s", method, r, debug.Stack())
+		*err = status.Errorf(codes.Internal, "internal error")
+	}
+}
+
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recovered(info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recovered(info.FullMethod, &err)
+	return handler(srv, ss)
+}
@@ -0,0 +1,148 @@
+// Command datastreamd serves the DataService from one of the storage
+// backends, configured by a YAML or TOML file:
+//
+//	datastreamd -config /etc/datastream/datastreamd.yaml
+//
+// The server shuts down gracefully on SIGTERM or SIGINT.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage/service"
+	"github.com/bartke/datastream/tlsconfig"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	configPath := flag.String("config", "datastreamd.yaml", "path of the YAML or TOML config file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatalf("error creating listener: %v", err)
+	}
+	if err := run(ctx, config, listener); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves on listener until ctx is done and shuts down gracefully, calls
+// still open after the shutdown timeout, e.g. subscriptions, are canceled
+func run(ctx context.Context, config *Config, listener net.Listener) error {
+	// backends and certificate reloads block on reporting errors, they are
+	// drained for the lifetime of the process
+	errs := make(chan error)
+	go func() {
+		for err := range errs {
+			log.Printf("error: %v", err)
+		}
+	}()
+
+	tracingCloser, err := startTracing(ctx, config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracingCloser.Close()
+
+	m, metricsCloser, err := serveMetrics(config.Metrics)
+	if err != nil {
+		return err
+	}
+	defer metricsCloser.Close()
+
+	store, closer, err := newStore(config, m, errs)
+	if err != nil {
+		return fmt.Errorf("error creating %s backend: %w", config.Backend.Type, err)
+	}
+	defer closer.Close()
+
+	validator, err := newValidator(config)
+	if err != nil {
+		return err
+	}
+	policy, err := newPolicy(config)
+	if err != nil {
+		return err
+	}
+	auditSink, auditCloser, err := newAudit(config.Audit)
+	if err != nil {
+		return err
+	}
+	defer auditCloser.Close()
+
+	options, err := serverOptions(config)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		// outermost to observe the calls rejected by the other interceptors
+		options = append([]grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(m.Unary),
+			grpc.ChainStreamInterceptor(m.Stream),
+		}, options...)
+	}
+	if config.TLS.CertFile != "" {
+		creds, err := tlsconfig.NewServerCredentials(tlsconfig.Config{
+			CertFile:       config.TLS.CertFile,
+			KeyFile:        config.TLS.KeyFile,
+			CAFile:         config.TLS.ClientCAFile,
+			ReloadInterval: config.TLS.ReloadInterval,
+			ErrorChannel:   errs,
+		})
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(options...)
+	datastream.RegisterDataServiceServer(server, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{
+		Validator: validator,
+		Policy:    policy,
+		Audit:     auditSink,
+		Metrics:   m,
+	}))
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	log.Printf("serving %s backend on %s", config.Backend.Type, listener.Addr())
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down")
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(config.ShutdownTimeout):
+		log.Printf("shutdown timeout, canceling open calls")
+		server.Stop()
+		<-stopped
+	}
+	return nil
+}
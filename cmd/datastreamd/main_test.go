@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("DATASTREAMD_TEST_OWNER", "platform")
+
+	yamlConfig, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tomlConfig, err := LoadConfig("testdata/memory.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(yamlConfig, tomlConfig) {
+		t.Errorf("yaml config %+v differs from toml config %+v", yamlConfig, tomlConfig)
+	}
+	if yamlConfig.SyncInterval != time.Second || yamlConfig.Backend.Memory.Seed[1].Value != "platform" {
+		t.Errorf("config = %+v, want 1s sync interval and expanded owner", yamlConfig)
+	}
+
+	if _, err := LoadConfig("datastreamd.example.yaml"); err != nil {
+		t.Errorf("example config: %v", err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"listen: :8080", "missing backend type"},
+		{"backend: {type: mysql}", "unknown backend type"},
+		{"backend: {type: sqlite}", "requires a path"},
+		{"backend: {type: memory}\ninterceptors: [auth0]", "unknown interceptor"},
+		{"backend: {type: memory}\ntls: {cert_file: server.crt}", "both cert_file and key_file"},
+		{"backend: {type: memory}\nsync_interval: often", "invalid config"},
+		{"backend: {type: memory}\nauth: {client_certificates: true}", "requires tls client_ca_file"},
+		{"backend: {type: memory}\npolicy_file: policy.yaml", "requires the auth interceptor"},
+		{"backend: {type: memory}\naudit: {sql: {driver: mysql, dsn: x}}", "unknown audit sql driver"},
+		{"backend: {type: memory}\naudit: {syslog: {network: udp}}", "requires both network and address"},
+		{"backend: {type: memory}\ntracing: {exporter: jaeger}", "unknown tracing exporter"},
+		{"backend: {type: memory}\ntracing: {exporter: otlp, sample_ratio: 2}", "not between 0 and 1"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadConfig(%q) = %v, want error containing %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	config, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, config, listener) }()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := datastream.NewDataServiceClient(conn)
+
+	resp, err := client.Sync(context.Background(), &datastream.DataRequest{Keys: []string{"max_connections"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data["max_connections"].Value) != "10" {
+		t.Errorf("max_connections = %q, want 10", resp.Data["max_connections"].Value)
+	}
+
+	// an open subscription is canceled once the shutdown timeout expires
+	stream, err := client.Subscribe(context.Background(), &datastream.DataRequest{Keys: []string{"max_connections"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(config.ShutdownTimeout + 5*time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("subscription still open after shutdown")
+	}
+}
+
+func TestTracingInterceptor(t *testing.T) {
+	config, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Interceptors = []string{"tracing"}
+	if _, err := serverOptions(config); err == nil || !strings.Contains(err.Error(), "requires a tracing exporter") {
+		t.Errorf("tracing without exporter: %v", err)
+	}
+	config.Tracing.Exporter = "otlp"
+	if _, err := serverOptions(config); err != nil {
+		t.Errorf("tracing with exporter: %v", err)
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	config, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Interceptors = []string{"auth"}
+	if _, err := serverOptions(config); err == nil || !strings.Contains(err.Error(), "requires a token_file") {
+		t.Errorf("auth without authenticators: %v", err)
+	}
+
+	dir := t.TempDir()
+	config.Auth.TokenFile = filepath.Join(dir, "tokens")
+	if err := os.WriteFile(config.Auth.TokenFile, []byte("secret updater writers\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config.PolicyFile = filepath.Join(dir, "policy.yaml")
+	policy := "rules:\n  - {principals: [group:writers], actions: [read], keys: [max_connections]}\n"
+	if err := os.WriteFile(config.PolicyFile, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go run(ctx, config, listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := datastream.NewDataServiceClient(conn)
+
+	req := &datastream.DataRequest{Keys: []string{"max_connections"}}
+	if _, err := client.Sync(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("sync without token: %v, want UNAUTHENTICATED", err)
+	}
+	authorized := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	if _, err := client.Sync(authorized, req); err != nil {
+		t.Errorf("sync with token: %v", err)
+	}
+	if _, err := client.PushUpdate(authorized, &datastream.Data{Key: "max_connections", Value: []byte("20")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("push without policy rule: %v, want PERMISSION_DENIED", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	config, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	config.Audit.File = filepath.Join(dir, "audit.jsonl")
+	config.Audit.SQL = AuditSQLConfig{Driver: "sqlite3", DSN: filepath.Join(dir, "audit.db")}
+	syslog, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syslog.Close()
+	config.Audit.Syslog = AuditSyslogConfig{Network: "udp", Address: syslog.LocalAddr().String()}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go run(ctx, config, listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := datastream.NewDataServiceClient(conn)
+
+	if _, err := client.PushUpdate(context.Background(), &datastream.Data{Key: "max_connections", Value: []byte("20")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.ListAuditEvents(context.Background(), &datastream.ListAuditEventsRequest{Key: "max_connections"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Action != "update" {
+		t.Errorf("events = %v, want the update of max_connections", resp.Events)
+	}
+
+	buf := make([]byte, 1024)
+	syslog.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := syslog.ReadFrom(buf)
+	if err != nil || !strings.Contains(string(buf[:n]), "anonymous updated max_connections") {
+		t.Errorf("syslog message %q, %v", buf[:n], err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	config, err := LoadConfig("testdata/memory.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reserve a port for the metrics endpoint
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Metrics.Listen = reserved.Addr().String()
+	reserved.Close()
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go run(ctx, config, listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := datastream.NewDataServiceClient(conn)
+
+	if _, err := client.Sync(context.Background(), &datastream.DataRequest{Keys: []string{"max_connections"}}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Subscribe(context.Background(), &datastream.DataRequest{Keys: []string{"max_connections"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + config.Metrics.Listen + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`datastream_rpcs_total{code="OK",method="/datastream.DataService/Sync"} 1`,
+		`datastream_active_subscriptions 1`,
+		`datastream_updates_fanned_out_total{key="max_connections"} 1`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv("DATASTREAM_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("DATASTREAM_POSTGRES_DSN required for the Postgres tests")
+	}
+	// the data table is created by the server
+	table := fmt.Sprintf("datastreamd_test_%d", os.Getpid())
+	config := &Config{Backend: BackendConfig{Type: "postgres", Postgres: PostgresConfig{DSN: dsn, Table: table}}}
+	store, closer, err := newStore(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	defer func() {
+		db := closer.(*sql.DB)
+		db.Exec("DROP TABLE " + table + ", " + table + "_log, " + table + "_meta")
+		db.Exec("DROP FUNCTION " + table + "_log_append(), " + table + "_log_lock()")
+	}()
+
+	ctx := context.Background()
+	if err := store.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	data, revision, err := store.Sync(ctx, []string{"alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["alpha"].Value) != "1" || revision != 1 {
+		t.Errorf("Sync = %v at revision %d, want alpha=1 at revision 1", data, revision)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/bartke/datastream/metrics"
+)
+
+// serveMetrics serves the metrics on /metrics of the configured address, the
+// metrics are nil if no address is configured
+func serveMetrics(config MetricsConfig) (*metrics.Metrics, io.Closer, error) {
+	if config.Listen == "" {
+		return nil, nopCloser{}, nil
+	}
+	m, err := metrics.New(metrics.Config{})
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating metrics listener: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving metrics: %v", err)
+		}
+	}()
+	log.Printf("serving metrics on %s", listener.Addr())
+	return m, server, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/bartke/datastream/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracingFlushTimeout bounds the export of the remaining spans on shutdown
+const tracingFlushTimeout = 5 * time.Second
+
+// startTracing installs the configured tracer provider, closing it exports
+// the remaining spans
+func startTracing(ctx context.Context, config TracingConfig) (io.Closer, error) {
+	if config.Exporter == "" {
+		return nopCloser{}, nil
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "datastreamd"
+	}
+	provider, err := tracing.New(ctx, tracing.Config{
+		Exporter:    config.Exporter,
+		Endpoint:    config.Endpoint,
+		Insecure:    config.Insecure,
+		ServiceName: config.ServiceName,
+		SampleRatio: config.SampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tracerCloser{provider}, nil
+}
+
+type tracerCloser struct {
+	provider *sdktrace.TracerProvider
+}
+
+func (c tracerCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	defer cancel()
+	return c.provider.Shutdown(ctx)
+}
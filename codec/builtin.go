@@ -0,0 +1,211 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"gopkg.in/yaml.v3"
+)
+
+// Int decodes decimal integers to int64
+type Int struct{}
+
+func (Int) Decode(value []byte) (interface{}, error) {
+	return strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+}
+
+func (Int) Encode(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []byte(strconv.FormatInt(rv.Int(), 10)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows int64", rv.Uint())
+		}
+		return []byte(strconv.FormatUint(rv.Uint(), 10)), nil
+	case reflect.String:
+		return validated(Int{}, []byte(rv.String()))
+	}
+	return nil, fmt.Errorf("cannot encode %T as int", v)
+}
+
+// Float decodes decimal numbers to float64
+type Float struct{}
+
+func (Float) Decode(value []byte) (interface{}, error) {
+	return strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+}
+
+func (Float) Encode(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return []byte(strconv.FormatFloat(rv.Float(), 'g', -1, 64)), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []byte(strconv.FormatInt(rv.Int(), 10)), nil
+	case reflect.String:
+		return validated(Float{}, []byte(rv.String()))
+	}
+	return nil, fmt.Errorf("cannot encode %T as float", v)
+}
+
+// Bool decodes the values accepted by strconv.ParseBool to bool
+type Bool struct{}
+
+func (Bool) Decode(value []byte) (interface{}, error) {
+	return strconv.ParseBool(strings.TrimSpace(string(value)))
+}
+
+func (Bool) Encode(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case bool:
+		return []byte(strconv.FormatBool(b)), nil
+	case string:
+		return validated(Bool{}, []byte(b))
+	}
+	return nil, fmt.Errorf("cannot encode %T as bool", v)
+}
+
+// Duration decodes the values accepted by time.ParseDuration to time.Duration
+type Duration struct{}
+
+func (Duration) Decode(value []byte) (interface{}, error) {
+	return time.ParseDuration(strings.TrimSpace(string(value)))
+}
+
+func (Duration) Encode(v interface{}) ([]byte, error) {
+	switch d := v.(type) {
+	case time.Duration:
+		return []byte(d.String()), nil
+	case string:
+		return validated(Duration{}, []byte(d))
+	}
+	return nil, fmt.Errorf("cannot encode %T as duration", v)
+}
+
+// Text decodes values to string
+type Text struct{}
+
+func (Text) Decode(value []byte) (interface{}, error) {
+	return string(value), nil
+}
+
+func (Text) Encode(v interface{}) ([]byte, error) {
+	switch s := v.(type) {
+	case string:
+		return []byte(s), nil
+	case []byte:
+		return s, nil
+	case fmt.Stringer:
+		return []byte(s.String()), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as text", v)
+}
+
+// Binary passes values through as []byte
+type Binary struct{}
+
+func (Binary) Decode(value []byte) (interface{}, error) {
+	return value, nil
+}
+
+func (Binary) Encode(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as binary", v)
+}
+
+// JSON decodes JSON documents to the types of encoding/json
+type JSON struct{}
+
+func (JSON) Decode(value []byte) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal(value, &v)
+	return v, err
+}
+
+func (JSON) Encode(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return validated(JSON{}, b)
+	}
+	return json.Marshal(v)
+}
+
+func (JSON) Unmarshal(value []byte, v interface{}) error {
+	return json.Unmarshal(value, v)
+}
+
+// YAML decodes YAML documents to the types of gopkg.in/yaml.v3
+type YAML struct{}
+
+func (YAML) Decode(value []byte) (interface{}, error) {
+	var v interface{}
+	err := yaml.Unmarshal(value, &v)
+	return v, err
+}
+
+func (YAML) Encode(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return validated(YAML{}, b)
+	}
+	return yaml.Marshal(v)
+}
+
+func (YAML) Unmarshal(value []byte, v interface{}) error {
+	return yaml.Unmarshal(value, v)
+}
+
+// Protobuf decodes serialized google.protobuf.Any messages to *anypb.Any,
+// Unmarshal unpacks the message into a proto.Message of the contained type
+type Protobuf struct{}
+
+func (Protobuf) Decode(value []byte) (interface{}, error) {
+	msg := &anypb.Any{}
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (Protobuf) Encode(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case *anypb.Any:
+		return proto.Marshal(m)
+	case proto.Message:
+		msg, err := anypb.New(m)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(msg)
+	}
+	return nil, fmt.Errorf("cannot encode %T as protobuf", v)
+}
+
+func (Protobuf) Unmarshal(value []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal protobuf into %T", v)
+	}
+	msg := &anypb.Any{}
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return err
+	}
+	return msg.UnmarshalTo(m)
+}
+
+// validated returns value if it decodes with codec
+func validated(codec Codec, value []byte) ([]byte, error) {
+	if _, err := codec.Decode(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
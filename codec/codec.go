@@ -0,0 +1,207 @@
+// Package codec converts values between their wire representation and Go
+// types based on the value_type of a key. The same registry is used by the
+// server to validate updates and by the client for typed accessors.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownType is returned for value types without a registered codec
+	ErrUnknownType = errors.New("unknown value type")
+	// ErrInvalidValue is returned when a value cannot be decoded or encoded
+	// with the codec of its value type
+	ErrInvalidValue = errors.New("invalid value")
+	// ErrTypeMismatch is returned when a value is requested as a Go type its
+	// value type does not decode to
+	ErrTypeMismatch = errors.New("type mismatch")
+)
+
+// Codec converts the bytes of a value to a Go value and back
+type Codec interface {
+	// Decode parses value into its Go representation
+	Decode(value []byte) (interface{}, error)
+	// Encode formats a Go value, accepting at least the types Decode returns
+	Encode(v interface{}) ([]byte, error)
+}
+
+// Unmarshaler is implemented by codecs for structured values which can decode
+// into a value provided by the caller
+type Unmarshaler interface {
+	Unmarshal(value []byte, v interface{}) error
+}
+
+// Registry maps value types to codecs, it is safe for concurrent use
+type Registry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{codecs: make(map[string]Codec)}
+}
+
+// NewDefaultRegistry creates a registry with the builtin codecs for int,
+// float, bool, duration, text, binary, JSON, YAML and protobuf values
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(Int{}, "int", "integer")
+	r.Register(Float{}, "float", "double")
+	r.Register(Bool{}, "bool", "boolean")
+	r.Register(Duration{}, "duration")
+	r.Register(Text{}, "text", "string", "text/plain", ".txt")
+	r.Register(Binary{}, "binary", "application/octet-stream")
+	r.Register(JSON{}, "json", ".json", "application/json")
+	r.Register(YAML{}, "yaml", ".yaml", ".yml", "application/yaml")
+	r.Register(Protobuf{}, "protobuf", "application/protobuf")
+	return r
+}
+
+// Default is the registry used when none is configured
+var Default = NewDefaultRegistry()
+
+// Register registers codec for the given value types, replacing previous
+// registrations
+func (r *Registry) Register(codec Codec, valueTypes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, valueType := range valueTypes {
+		r.codecs[valueType] = codec
+	}
+}
+
+// Lookup returns the codec registered for valueType
+func (r *Registry) Lookup(valueType string) (Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	codec, ok := r.codecs[valueType]
+	return codec, ok
+}
+
+// ValueTypes returns the registered value types in sorted order
+func (r *Registry) ValueTypes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	valueTypes := make([]string, 0, len(r.codecs))
+	for valueType := range r.codecs {
+		valueTypes = append(valueTypes, valueType)
+	}
+	sort.Strings(valueTypes)
+	return valueTypes
+}
+
+func (r *Registry) lookup(valueType string) (Codec, error) {
+	codec, ok := r.Lookup(valueType)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, valueType)
+	}
+	return codec, nil
+}
+
+// Decode decodes value with the codec of valueType
+func (r *Registry) Decode(valueType string, value []byte) (interface{}, error) {
+	codec, err := r.lookup(valueType)
+	if err != nil {
+		return nil, err
+	}
+	v, err := codec.Decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w for value type %s: %v", ErrInvalidValue, valueType, err)
+	}
+	return v, nil
+}
+
+// Encode encodes v with the codec of valueType
+func (r *Registry) Encode(valueType string, v interface{}) ([]byte, error) {
+	codec, err := r.lookup(valueType)
+	if err != nil {
+		return nil, err
+	}
+	value, err := codec.Encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w for value type %s: %v", ErrInvalidValue, valueType, err)
+	}
+	return value, nil
+}
+
+// Unmarshal decodes value into v, valueType has to be registered with a codec
+// implementing Unmarshaler
+func (r *Registry) Unmarshal(valueType string, value []byte, v interface{}) error {
+	codec, err := r.lookup(valueType)
+	if err != nil {
+		return err
+	}
+	unmarshaler, ok := codec.(Unmarshaler)
+	if !ok {
+		return fmt.Errorf("%w: value type %s is not a structured type", ErrTypeMismatch, valueType)
+	}
+	if err := unmarshaler.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("%w for value type %s: %v", ErrInvalidValue, valueType, err)
+	}
+	return nil
+}
+
+// Validate checks that value decodes with the codec of valueType, values of
+// unknown types are accepted
+func (r *Registry) Validate(valueType string, value []byte) error {
+	if _, ok := r.Lookup(valueType); !ok {
+		return nil
+	}
+	_, err := r.Decode(valueType, value)
+	return err
+}
+
+// decodeAs decodes value and asserts the Go type of the result
+func decodeAs[T any](r *Registry, valueType string, value []byte) (T, error) {
+	var zero T
+	v, err := r.Decode(valueType, value)
+	if err != nil {
+		return zero, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: value type %s decodes to %T, not %T", ErrTypeMismatch, valueType, v, zero)
+	}
+	return t, nil
+}
+
+// Int decodes a value of a type decoding to int64
+func (r *Registry) Int(valueType string, value []byte) (int64, error) {
+	return decodeAs[int64](r, valueType, value)
+}
+
+// Float decodes a value of a type decoding to float64, integers are converted
+func (r *Registry) Float(valueType string, value []byte) (float64, error) {
+	v, err := r.Decode(valueType, value)
+	if err != nil {
+		return 0, err
+	}
+	switch f := v.(type) {
+	case float64:
+		return f, nil
+	case int64:
+		return float64(f), nil
+	}
+	return 0, fmt.Errorf("%w: value type %s decodes to %T, not float64", ErrTypeMismatch, valueType, v)
+}
+
+// Bool decodes a value of a type decoding to bool
+func (r *Registry) Bool(valueType string, value []byte) (bool, error) {
+	return decodeAs[bool](r, valueType, value)
+}
+
+// Duration decodes a value of a type decoding to time.Duration
+func (r *Registry) Duration(valueType string, value []byte) (time.Duration, error) {
+	return decodeAs[time.Duration](r, valueType, value)
+}
+
+// String decodes a value of a type decoding to string
+func (r *Registry) String(valueType string, value []byte) (string, error) {
+	return decodeAs[string](r, valueType, value)
+}
@@ -0,0 +1,120 @@
+package codec_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/codec"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		valueType string
+		value     string
+		want      interface{}
+	}{
+		{"int", " 42\n", int64(42)},
+		{"float", "1.5", 1.5},
+		{"bool", "true", true},
+		{"duration", "1m30s", 90 * time.Second},
+		{"text/plain", "hello", "hello"},
+		{"json", `{"a":1}`, map[string]interface{}{"a": float64(1)}},
+		{".yaml", "a: 1", map[string]interface{}{"a": 1}},
+	}
+	for _, tt := range tests {
+		got, err := codec.Default.Decode(tt.valueType, []byte(tt.value))
+		if err != nil {
+			t.Errorf("Decode(%s, %q): %v", tt.valueType, tt.value, err)
+			continue
+		}
+		encoded, err := codec.Default.Encode(tt.valueType, got)
+		if err != nil {
+			t.Errorf("Encode(%s, %v): %v", tt.valueType, got, err)
+		}
+		again, err := codec.Default.Decode(tt.valueType, encoded)
+		if err != nil || !equal(again, tt.want) || !equal(got, tt.want) {
+			t.Errorf("Decode(%s, %q) = %v, round trip %v, want %v", tt.valueType, tt.value, got, again, tt.want)
+		}
+	}
+}
+
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if a[k] != b[k] {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func TestInvalidValue(t *testing.T) {
+	for _, tt := range []struct{ valueType, value string }{
+		{"int", "abc"},
+		{"int", "1.5"},
+		{"bool", "yes please"},
+		{"duration", "10"},
+		{"json", "{"},
+	} {
+		err := codec.Default.Validate(tt.valueType, []byte(tt.value))
+		if !errors.Is(err, codec.ErrInvalidValue) {
+			t.Errorf("Validate(%s, %q) = %v, want ErrInvalidValue", tt.valueType, tt.value, err)
+		}
+	}
+
+	if err := codec.Default.Validate("custom/type", []byte("anything")); err != nil {
+		t.Errorf("Validate of unknown type = %v, want nil", err)
+	}
+	if _, err := codec.Default.Decode("custom/type", nil); !errors.Is(err, codec.ErrUnknownType) {
+		t.Errorf("Decode of unknown type = %v, want ErrUnknownType", err)
+	}
+}
+
+func TestTypedAccessors(t *testing.T) {
+	if v, err := codec.Default.Int("int", []byte("7")); err != nil || v != 7 {
+		t.Errorf("Int = %v, %v, want 7", v, err)
+	}
+	if v, err := codec.Default.Float("int", []byte("7")); err != nil || v != 7 {
+		t.Errorf("Float of int = %v, %v, want 7", v, err)
+	}
+	if _, err := codec.Default.Bool("int", []byte("7")); !errors.Is(err, codec.ErrTypeMismatch) {
+		t.Errorf("Bool of int = %v, want ErrTypeMismatch", err)
+	}
+	if err := codec.Default.Unmarshal("int", []byte("7"), new(int)); !errors.Is(err, codec.ErrTypeMismatch) {
+		t.Errorf("Unmarshal of int = %v, want ErrTypeMismatch", err)
+	}
+
+	var config struct {
+		Limit int `json:"limit" yaml:"limit"`
+	}
+	if err := codec.Default.Unmarshal(".yml", []byte("limit: 5"), &config); err != nil || config.Limit != 5 {
+		t.Errorf("Unmarshal yaml = %v, %v, want limit 5", config, err)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	value, err := codec.Default.Encode("protobuf", durationpb.New(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d durationpb.Duration
+	if err := codec.Default.Unmarshal("protobuf", value, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.AsDuration() != time.Second {
+		t.Errorf("decoded %v, want 1s", d.AsDuration())
+	}
+	if err := codec.Default.Validate("protobuf", []byte{0xff}); !errors.Is(err, codec.ErrInvalidValue) {
+		t.Errorf("Validate of garbage = %v, want ErrInvalidValue", err)
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"io"
 	"log"
 
+	"github.com/bartke/datastream/client"
 	"github.com/bartke/datastream/generated/datastream"
 	"google.golang.org/grpc"
 )
@@ -17,11 +17,8 @@ func main() {
 	}
 	defer conn.Close()
 
-	// Create a client
-	client := datastream.NewDataServiceClient(conn)
-
 	// Send a ListCapabilities request to the server
-	resp, err := client.ListCapabilities(context.Background(), &datastream.ListCapabilitiesRequest{})
+	resp, err := datastream.NewDataServiceClient(conn).ListCapabilities(context.Background(), &datastream.ListCapabilitiesRequest{})
 	if err != nil {
 		log.Fatalf("error sending ListCapabilities request: %v", err)
 	}
@@ -35,37 +32,17 @@ func main() {
 		subsriptions = append(subsriptions, resp.Capabilities[i].Key)
 	}
 
-	// sync for subkey
-	content, err := client.Sync(context.Background(), &datastream.DataRequest{Keys: subsriptions})
-	if err != nil {
-		log.Fatalf("error sending Sync request: %v", err)
-	}
-
-	for key, data := range content.Data {
-		log.Printf("Received sync update for key %s value %v, stringified data %s", key, data.Value, string(data.Value))
-	}
-
 	log.Printf("Subscribing to key: %s", subsriptions)
 
-	// Create a stream to receive updates
-	stream, err := client.Subscribe(context.Background(), &datastream.DataRequest{Keys: subsriptions})
-	if err != nil {
-		log.Fatalf("Failed to subscribe: %v", err)
+	// the client keeps a local copy of the keys, reconnecting on failures
+	c := client.New(datastream.NewDataServiceClient(conn), client.Config{Keys: subsriptions})
+	for _, key := range subsriptions {
+		c.Watch(key, func(data *datastream.Data) {
+			log.Printf("Received subscription update for key %s value %v, stringified data %s", data.Key, data.Value, string(data.Value))
+		})
 	}
 
-	for {
-		// Receive updates from the stream
-		update, err := stream.Recv()
-		if err != nil {
-			if err == io.EOF {
-				log.Println("stream closed")
-				break
-			}
-			log.Fatalf("Failed to receive update: %v", err)
-		}
-
-		for key, data := range update.Data {
-			log.Printf("Received subscription update for key %s value %v, stringified data %s", key, data.Value, string(data.Value))
-		}
+	if err := c.Run(context.Background()); err != nil {
+		log.Fatalf("Subscription ended: %v", err)
 	}
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"net"
+	"os"
 
+	"github.com/bartke/datastream/auth"
 	"github.com/bartke/datastream/examples/server/settings"
 	"github.com/bartke/datastream/examples/shared"
 	"github.com/bartke/datastream/generated/datastream"
@@ -25,7 +27,22 @@ func main() {
 		log.Fatalf("error creating listener: %v", err)
 	}
 
-	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(shared.LogMiddleware))
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(shared.LogMiddleware)}
+
+	// Require bearer tokens if a token file is given
+	if path := os.Getenv("DATASTREAM_TOKEN_FILE"); path != "" {
+		tokens, err := auth.LoadTokenFile(path)
+		if err != nil {
+			log.Fatalf("error loading tokens: %v", err)
+		}
+		a := auth.NewInterceptor(auth.InterceptorConfig{Authenticators: []auth.Authenticator{tokens}})
+		options = []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(shared.LogMiddleware, a.Unary),
+			grpc.StreamInterceptor(a.Stream),
+		}
+	}
+
+	grpcServer := grpc.NewServer(options...)
 	datastream.RegisterDataServiceServer(grpcServer, s)
 
 	log.Println("Starting gRPC server on :8080")
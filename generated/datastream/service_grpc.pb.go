@@ -27,10 +27,27 @@ type DataServiceClient interface {
 	ListCapabilities(ctx context.Context, in *ListCapabilitiesRequest, opts ...grpc.CallOption) (*ListCapabilitiesResponse, error)
 	// initial sync request from client to server
 	Sync(ctx context.Context, in *DataRequest, opts ...grpc.CallOption) (*DataResponse, error)
-	// streaming updates request from client to server
+	// streaming updates request from client to server, the first response is a
+	// snapshot of the requested keys unless the subscription resumes from a
+	// revision
 	Subscribe(ctx context.Context, in *DataRequest, opts ...grpc.CallOption) (DataService_SubscribeClient, error)
 	// optional push updates from client back to server
 	PushUpdate(ctx context.Context, in *Data, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// optional removal of a key, subscribers receive a tombstone
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// optional atomic update of several keys, subscribers receive the batch in
+	// a single response
+	PushBatch(ctx context.Context, in *PushBatchRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// optional audit log of updates and deletions, the most recent first
+	ListAuditEvents(ctx context.Context, in *ListAuditEventsRequest, opts ...grpc.CallOption) (*ListAuditEventsResponse, error)
+	// prior values of a key, the most recent first
+	History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error)
+	// optional restore of a key to its value at a past revision, the old value
+	// is written as a new update and the history is kept
+	Rollback(ctx context.Context, in *RollbackRequest, opts ...grpc.CallOption) (*RollbackResponse, error)
+	// optional restore of all keys, or the selected ones, to their state at a
+	// past revision or time as one atomic change
+	RollbackTo(ctx context.Context, in *RollbackToRequest, opts ...grpc.CallOption) (*RollbackResponse, error)
 }
 
 type dataServiceClient struct {
@@ -100,6 +117,60 @@ func (c *dataServiceClient) PushUpdate(ctx context.Context, in *Data, opts ...gr
 	return out, nil
 }
 
+func (c *dataServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataServiceClient) PushBatch(ctx context.Context, in *PushBatchRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/PushBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataServiceClient) ListAuditEvents(ctx context.Context, in *ListAuditEventsRequest, opts ...grpc.CallOption) (*ListAuditEventsResponse, error) {
+	out := new(ListAuditEventsResponse)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/ListAuditEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataServiceClient) History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error) {
+	out := new(HistoryResponse)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/History", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataServiceClient) Rollback(ctx context.Context, in *RollbackRequest, opts ...grpc.CallOption) (*RollbackResponse, error) {
+	out := new(RollbackResponse)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/Rollback", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataServiceClient) RollbackTo(ctx context.Context, in *RollbackToRequest, opts ...grpc.CallOption) (*RollbackResponse, error) {
+	out := new(RollbackResponse)
+	err := c.cc.Invoke(ctx, "/datastream.DataService/RollbackTo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DataServiceServer is the server API for DataService service.
 // All implementations must embed UnimplementedDataServiceServer
 // for forward compatibility
@@ -108,10 +179,27 @@ type DataServiceServer interface {
 	ListCapabilities(context.Context, *ListCapabilitiesRequest) (*ListCapabilitiesResponse, error)
 	// initial sync request from client to server
 	Sync(context.Context, *DataRequest) (*DataResponse, error)
-	// streaming updates request from client to server
+	// streaming updates request from client to server, the first response is a
+	// snapshot of the requested keys unless the subscription resumes from a
+	// revision
 	Subscribe(*DataRequest, DataService_SubscribeServer) error
 	// optional push updates from client back to server
 	PushUpdate(context.Context, *Data) (*emptypb.Empty, error)
+	// optional removal of a key, subscribers receive a tombstone
+	Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error)
+	// optional atomic update of several keys, subscribers receive the batch in
+	// a single response
+	PushBatch(context.Context, *PushBatchRequest) (*emptypb.Empty, error)
+	// optional audit log of updates and deletions, the most recent first
+	ListAuditEvents(context.Context, *ListAuditEventsRequest) (*ListAuditEventsResponse, error)
+	// prior values of a key, the most recent first
+	History(context.Context, *HistoryRequest) (*HistoryResponse, error)
+	// optional restore of a key to its value at a past revision, the old value
+	// is written as a new update and the history is kept
+	Rollback(context.Context, *RollbackRequest) (*RollbackResponse, error)
+	// optional restore of all keys, or the selected ones, to their state at a
+	// past revision or time as one atomic change
+	RollbackTo(context.Context, *RollbackToRequest) (*RollbackResponse, error)
 	mustEmbedUnimplementedDataServiceServer()
 }
 
@@ -131,6 +219,24 @@ func (UnimplementedDataServiceServer) Subscribe(*DataRequest, DataService_Subscr
 func (UnimplementedDataServiceServer) PushUpdate(context.Context, *Data) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PushUpdate not implemented")
 }
+func (UnimplementedDataServiceServer) Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedDataServiceServer) PushBatch(context.Context, *PushBatchRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushBatch not implemented")
+}
+func (UnimplementedDataServiceServer) ListAuditEvents(context.Context, *ListAuditEventsRequest) (*ListAuditEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAuditEvents not implemented")
+}
+func (UnimplementedDataServiceServer) History(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method History not implemented")
+}
+func (UnimplementedDataServiceServer) Rollback(context.Context, *RollbackRequest) (*RollbackResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rollback not implemented")
+}
+func (UnimplementedDataServiceServer) RollbackTo(context.Context, *RollbackToRequest) (*RollbackResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RollbackTo not implemented")
+}
 func (UnimplementedDataServiceServer) mustEmbedUnimplementedDataServiceServer() {}
 
 // UnsafeDataServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -219,6 +325,114 @@ func _DataService_PushUpdate_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _DataService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataService_PushBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).PushBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/PushBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).PushBatch(ctx, req.(*PushBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataService_ListAuditEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAuditEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).ListAuditEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/ListAuditEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).ListAuditEvents(ctx, req.(*ListAuditEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataService_History_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).History(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/History",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).History(ctx, req.(*HistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataService_Rollback_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RollbackRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).Rollback(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/Rollback",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).Rollback(ctx, req.(*RollbackRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataService_RollbackTo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RollbackToRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServiceServer).RollbackTo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/datastream.DataService/RollbackTo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServiceServer).RollbackTo(ctx, req.(*RollbackToRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // DataService_ServiceDesc is the grpc.ServiceDesc for DataService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -238,6 +452,30 @@ var DataService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "PushUpdate",
 			Handler:    _DataService_PushUpdate_Handler,
 		},
+		{
+			MethodName: "Delete",
+			Handler:    _DataService_Delete_Handler,
+		},
+		{
+			MethodName: "PushBatch",
+			Handler:    _DataService_PushBatch_Handler,
+		},
+		{
+			MethodName: "ListAuditEvents",
+			Handler:    _DataService_ListAuditEvents_Handler,
+		},
+		{
+			MethodName: "History",
+			Handler:    _DataService_History_Handler,
+		},
+		{
+			MethodName: "Rollback",
+			Handler:    _DataService_Rollback_Handler,
+		},
+		{
+			MethodName: "RollbackTo",
+			Handler:    _DataService_RollbackTo_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
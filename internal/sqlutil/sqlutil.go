@@ -0,0 +1,27 @@
+// Package sqlutil holds the query helpers shared by the SQL storage and the
+// SQL audit log.
+package sqlutil
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Rebind replaces the ? placeholders of query with the $1, $2, ... placeholders
+// of Postgres
+func Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// LikeEscaper escapes LIKE wildcards with the escape character "!"
+var LikeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
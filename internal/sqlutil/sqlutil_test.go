@@ -0,0 +1,20 @@
+package sqlutil_test
+
+import (
+	"testing"
+
+	"github.com/bartke/datastream/internal/sqlutil"
+)
+
+func TestRebind(t *testing.T) {
+	got := sqlutil.Rebind("SELECT key FROM data WHERE key > ? AND key LIKE ? ESCAPE '!' LIMIT ?")
+	if want := "SELECT key FROM data WHERE key > $1 AND key LIKE $2 ESCAPE '!' LIMIT $3"; got != want {
+		t.Errorf("Rebind = %q, want %q", got, want)
+	}
+}
+
+func TestLikeEscaper(t *testing.T) {
+	if got := sqlutil.LikeEscaper.Replace("a_b%c!"); got != "a!_b!%c!!" {
+		t.Errorf("escaped %q", got)
+	}
+}
@@ -0,0 +1,162 @@
+// Package metrics exports Prometheus metrics of the DataService, its
+// subscriptions and the polls of the storage backends.
+//
+//	m, err := metrics.New(metrics.Config{})
+//	grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(m.Unary, shared.LogMiddleware),
+//		grpc.StreamInterceptor(m.Stream),
+//	)
+//	http.Handle("/metrics", m.Handler())
+//
+// A nil *Metrics is valid and records nothing.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type Config struct {
+	// optional registry the metrics are registered with, default is a new
+	// registry including the Go runtime and process metrics
+	Registry *prometheus.Registry
+}
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	rpcs          *prometheus.CounterVec
+	rpcDuration   *prometheus.HistogramVec
+	subscriptions prometheus.Gauge
+	updates       *prometheus.CounterVec
+	streamed      prometheus.Counter
+	pollDuration  *prometheus.HistogramVec
+	pollErrors    *prometheus.CounterVec
+}
+
+func New(config Config) (*Metrics, error) {
+	registry := config.Registry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	m := &Metrics{
+		registry: registry,
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastream_rpcs_total",
+			Help: "Completed RPCs by method and status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastream_rpc_duration_seconds",
+			Help:    "Duration of RPCs by method and status code, streams last until they are closed.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		subscriptions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "datastream_active_subscriptions",
+			Help: "Open Subscribe streams.",
+		}),
+		updates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastream_updates_fanned_out_total",
+			Help: "Updates sent to subscribers by key, an update is counted once per subscriber.",
+		}, []string{"key"}),
+		streamed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "datastream_streamed_bytes_total",
+			Help: "Bytes of the responses sent to subscribers.",
+		}),
+		pollDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastream_backend_poll_duration_seconds",
+			Help:    "Duration of the polls of storage backends for changes.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		pollErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastream_backend_poll_errors_total",
+			Help: "Failed polls of storage backends.",
+		}, []string{"backend"}),
+	}
+	for _, c := range []prometheus.Collector{m.rpcs, m.rpcDuration, m.subscriptions, m.updates, m.streamed, m.pollDuration, m.pollErrors} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Unary is a grpc.UnaryServerInterceptor counting calls and their duration
+func (m *Metrics) Unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// Stream is a grpc.StreamServerInterceptor counting calls and their duration
+func (m *Metrics) Stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+func (m *Metrics) observeRPC(method string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	code := status.Code(err).String()
+	m.rpcs.WithLabelValues(method, code).Inc()
+	m.rpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+// SubscriptionOpened and SubscriptionClosed track the open subscriptions
+func (m *Metrics) SubscriptionOpened() {
+	if m != nil {
+		m.subscriptions.Inc()
+	}
+}
+
+func (m *Metrics) SubscriptionClosed() {
+	if m != nil {
+		m.subscriptions.Dec()
+	}
+}
+
+// Sent records a response sent to a subscriber
+func (m *Metrics) Sent(response *datastream.DataResponse) {
+	if m == nil {
+		return
+	}
+	for key := range response.Data {
+		m.updates.WithLabelValues(key).Inc()
+	}
+	m.streamed.Add(float64(proto.Size(response)))
+}
+
+// ObservePoll records a poll of a backend for changes which started at start,
+// err is the error the poll failed with
+func (m *Metrics) ObservePoll(backend string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.pollDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.pollErrors.WithLabelValues(backend).Inc()
+	}
+}
@@ -0,0 +1,109 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Config{Registry: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/datastream.DataService/Sync"}
+	for _, err := range []error{nil, nil, status.Error(codes.NotFound, "key not found")} {
+		m.Unary(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+	m.SubscriptionOpened()
+	m.SubscriptionOpened()
+	m.SubscriptionClosed()
+	m.Sent(&datastream.DataResponse{Data: map[string]*datastream.Data{
+		"a": {Key: "a", Value: []byte("1")},
+		"b": {Key: "b", Value: []byte("2")},
+	}})
+	m.Sent(&datastream.DataResponse{Data: map[string]*datastream.Data{"a": {Key: "a", Value: []byte("3")}}})
+	m.ObservePoll("sql", time.Now(), nil)
+	m.ObservePoll("sql", time.Now(), errors.New("database is locked"))
+
+	want := `
+# HELP datastream_active_subscriptions Open Subscribe streams.
+# TYPE datastream_active_subscriptions gauge
+datastream_active_subscriptions 1
+# HELP datastream_backend_poll_errors_total Failed polls of storage backends.
+# TYPE datastream_backend_poll_errors_total counter
+datastream_backend_poll_errors_total{backend="sql"} 1
+# HELP datastream_rpcs_total Completed RPCs by method and status code.
+# TYPE datastream_rpcs_total counter
+datastream_rpcs_total{code="NotFound",method="/datastream.DataService/Sync"} 1
+datastream_rpcs_total{code="OK",method="/datastream.DataService/Sync"} 2
+# HELP datastream_updates_fanned_out_total Updates sent to subscribers by key, an update is counted once per subscriber.
+# TYPE datastream_updates_fanned_out_total counter
+datastream_updates_fanned_out_total{key="a"} 2
+datastream_updates_fanned_out_total{key="b"} 1
+`
+	names := []string{"datastream_active_subscriptions", "datastream_backend_poll_errors_total", "datastream_rpcs_total", "datastream_updates_fanned_out_total"}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), names...); err != nil {
+		t.Error(err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "datastream_rpc_duration_seconds", "datastream_backend_poll_duration_seconds"); err != nil || n != 3 {
+		t.Errorf("got %d histograms, %v, want 3", n, err)
+	}
+
+	// the registry is in use
+	if _, err := metrics.New(metrics.Config{Registry: registry}); err == nil {
+		t.Error("metrics registered twice")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m, err := metrics.New(metrics.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Sent(&datastream.DataResponse{Data: map[string]*datastream.Data{"a": {Key: "a", Value: []byte("1")}}})
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"datastream_streamed_bytes_total ", "go_goroutines "} {
+		if !strings.Contains(string(body), "\n"+line) {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	var m *metrics.Metrics
+	m.SubscriptionOpened()
+	m.Sent(&datastream.DataResponse{})
+	m.ObservePoll("git", time.Now(), nil)
+	info := &grpc.StreamServerInfo{FullMethod: "/datastream.DataService/Subscribe"}
+	if err := m.Stream(nil, nil, info, func(interface{}, grpc.ServerStream) error { return nil }); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Page tokens are keyset cursors holding the last key of the previous page,
+// backends resume listing after it.
+
+// pageToken returns the token continuing after key
+func pageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// after returns the key the page starts after, empty for the first page
+func (q CapabilityQuery) after() (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(q.PageToken)
+	if err != nil || (q.PageToken != "" && len(key) == 0) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPageToken, q.PageToken)
+	}
+	return string(key), nil
+}
+
+// matches reports whether c passes the prefix and tag filters of q
+func (q CapabilityQuery) matches(c Capability) bool {
+	if !strings.HasPrefix(c.Key, q.Prefix) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		found := false
+		for _, t := range c.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// full reports whether a page of n capabilities is complete
+func (q CapabilityQuery) full(n int) bool {
+	return q.PageSize > 0 && n >= q.PageSize
+}
+
+// page filters sorted capabilities by q and returns the requested page
+func (q CapabilityQuery) page(capabilities []Capability) ([]Capability, string, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, "", err
+	}
+	var result []Capability
+	for _, c := range capabilities {
+		if (after != "" && c.Key <= after) || !q.matches(c) {
+			continue
+		}
+		if q.full(len(result)) {
+			return result, pageToken(result[len(result)-1].Key), nil
+		}
+		result = append(result, c)
+	}
+	return result, "", nil
+}
+
+// mergeCapabilities combines capabilities declared for keys or selectors with
+// the value types of the keys present in the store. Declarations are listed
+// even if no key is set, selector declarations also apply to every matching
+// key and more specific declarations take precedence.
+func mergeCapabilities(declared []Capability, present map[string]string) []Capability {
+	declared = byPrecedence(declared)
+
+	result := make(map[string]Capability, len(present))
+	for key, valueType := range present {
+		result[key] = declare(declared, Capability{Key: key, ValueType: valueType})
+	}
+	for _, d := range declared {
+		if _, ok := result[d.Key]; !ok {
+			result[d.Key] = declare(declared, Capability{Key: d.Key})
+		}
+	}
+
+	capabilities := make([]Capability, 0, len(result))
+	for _, capability := range result {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Slice(capabilities, func(i, j int) bool {
+		return capabilities[i].Key < capabilities[j].Key
+	})
+	return capabilities
+}
+
+// byPrecedence returns a copy of declared with selectors before exact keys and
+// longer selectors last, the order in which declarations are applied
+func byPrecedence(declared []Capability) []Capability {
+	declared = append([]Capability(nil), declared...)
+	sort.SliceStable(declared, func(i, j int) bool {
+		a, b := IsSelector(declared[i].Key), IsSelector(declared[j].Key)
+		if a != b {
+			return a
+		}
+		return len(declared[i].Key) < len(declared[j].Key)
+	})
+	return declared
+}
+
+// declare applies the declarations matching the key of c, declared has to be
+// ordered by precedence
+func declare(declared []Capability, c Capability) Capability {
+	for _, d := range declared {
+		if Match([]string{d.Key}, c.Key) {
+			c = withMetadata(c, d)
+		}
+	}
+	return c
+}
+
+// withMetadata returns c with the fields set in declared
+func withMetadata(c, declared Capability) Capability {
+	if declared.ValueType != "" {
+		c.ValueType = declared.ValueType
+	}
+	if declared.Description != "" {
+		c.Description = declared.Description
+	}
+	if declared.ReadOnly {
+		c.ReadOnly = true
+	}
+	if declared.Default != nil {
+		c.Default = declared.Default
+	}
+	if declared.Schema != "" {
+		c.Schema = declared.Schema
+	}
+	if declared.Owner != "" {
+		c.Owner = declared.Owner
+	}
+	if len(declared.Tags) > 0 {
+		c.Tags = declared.Tags
+	}
+	return c
+}
+
+// parseTags splits a comma separated list of tags
+func parseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
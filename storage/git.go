@@ -1,24 +1,67 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bartke/datastream/metrics"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
 )
 
-// GitRepository implements the Storage interface for a Git repository
+// GitManifest is the file in the repository root declaring capability
+// metadata, it maps keys or selectors to their metadata:
+//
+//	keys:
+//	  services/payments/limits.json:
+//	    description: payment limits per merchant
+//	    value_type: json
+//	    default: '{"limit": 100}'
+//	    schema: schemas/limits.json
+//	    owner: payments
+//	    tags: [limits]
+//	  generated/:
+//	    read_only: true
+//
+// The manifest itself is not listed as a key.
+const GitManifest = ".datastream.yaml"
+
+const (
+	// gitMemoEntries bounds the memoized commit depths and key revisions each
+	gitMemoEntries = 100000
+	// gitMemoManifests bounds the memoized manifests
+	gitMemoManifests = 16
+)
+
+// GitRepository implements the Storage interface for a Git repository. The
+// store revision of a commit is its depth in the first-parent history.
 type GitRepository struct {
+	// mu serializes access to the worktree which is not safe for concurrent use
+	mu   sync.Mutex
 	repo *git.Repository
 	auth transport.AuthMethod
 
+	// depths and revisions memoize commit depths and per-key revisions,
+	// manifests the parsed manifests by blob hash, the least recently used
+	// entries are evicted
+	depths    *lru[plumbing.Hash, int64]
+	revisions *lru[keyAtCommit, keyRevision]
+	manifests *lru[plumbing.Hash, []Capability]
+	listing   gitListing
+
 	isRemote bool
 
 	name  string
@@ -26,11 +69,18 @@ type GitRepository struct {
 
 	syncInterval time.Duration
 	errorChannel chan<- error
+	metrics      *metrics.Metrics
 }
 
 type GitRepositoryConfig struct {
+	// local repository path or remote URL, remote and bare repositories are
+	// cloned into CloneDir
 	RepoPath string
 
+	// optional directory remote repositories are cloned into, an existing
+	// clone is reused, default is a new temporary directory
+	CloneDir string
+
 	// optional name for commits
 	CommitName string
 	// optional email for commits
@@ -45,23 +95,22 @@ type GitRepositoryConfig struct {
 
 	// optional error channel
 	ErrorChannel chan<- error
+
+	// optional metrics of the pulls and history walks of subscriptions
+	Metrics *metrics.Metrics
 }
 
 // NewGitRepository creates a new GitRepository type that implements the Storage interface
 func NewGitRepository(config GitRepositoryConfig) (Storage, error) {
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	tempDir := filepath.Join(os.TempDir(), timestamp)
-
-	err := os.MkdirAll(tempDir, 0755)
-	if err != nil {
-		return nil, err
-	}
-
 	store := &GitRepository{
+		depths:       newLRU[plumbing.Hash, int64](gitMemoEntries),
+		revisions:    newLRU[keyAtCommit, keyRevision](gitMemoEntries),
+		manifests:    newLRU[plumbing.Hash, []Capability](gitMemoManifests),
 		name:         config.CommitName,
 		email:        config.CommitEmail,
 		syncInterval: config.SyncInterval,
 		errorChannel: config.ErrorChannel,
+		metrics:      config.Metrics,
 	}
 
 	if config.Password != "" {
@@ -71,16 +120,36 @@ func NewGitRepository(config GitRepositoryConfig) (Storage, error) {
 		}
 	}
 
+	if store.name == "" {
+		store.name = "datastream"
+	}
+
 	// either local or switch to remote and clone
 	repo, err := git.PlainOpen(config.RepoPath)
+	if err == nil {
+		// a bare repository has no worktree, treat it like a remote
+		if _, err = repo.Worktree(); err == git.ErrIsBareRepository {
+			err = git.ErrRepositoryNotExists
+		}
+	}
 	if err == git.ErrRepositoryNotExists {
+		cloneDir := config.CloneDir
+		if cloneDir == "" {
+			if cloneDir, err = os.MkdirTemp("", "datastream-"); err != nil {
+				return nil, err
+			}
+		}
 		cfg := &git.CloneOptions{
 			URL:          config.RepoPath,
 			SingleBranch: true,
 			Progress:     ioutil.Discard,
 			Auth:         store.auth,
 		}
-		repo, err = git.PlainClone(tempDir, false, cfg)
+		repo, err = git.PlainClone(cloneDir, false, cfg)
+		if err == git.ErrRepositoryAlreadyExists {
+			// reuse the clone of a previous run, it is pulled on sync
+			repo, err = git.PlainOpen(cloneDir)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -104,40 +173,171 @@ func (s *GitRepository) forwardError(err error) {
 	}
 }
 
-func (r *GitRepository) ListCapabilities() ([]Capability, error) {
+// ListCapabilities lists the files below the directory of the query prefix,
+// the file list of the last listed directory is kept for paging through it
+func (r *GitRepository) ListCapabilities(ctx context.Context, query CapabilityQuery) ([]Capability, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	ref, err := r.repo.Head()
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve HEAD reference: %w", err)
+		return nil, "", fmt.Errorf("failed to retrieve HEAD reference: %w", err)
 	}
 
 	commit, err := r.repo.CommitObject(ref.Hash())
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve commit: %w", err)
+		return nil, "", fmt.Errorf("failed to retrieve commit: %w", err)
 	}
 
 	tree, err := commit.Tree()
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve tree: %w", err)
+		return nil, "", fmt.Errorf("failed to retrieve tree: %w", err)
 	}
 
-	var capabilities []Capability
-	err = tree.Files().ForEach(func(file *object.File) error {
-		// get file extension for value type
-		extension := filepath.Ext(file.Name)
-		if extension == "" {
-			extension = "text"
+	// only the tree of the deepest directory containing the prefix is walked
+	dir := ""
+	if i := strings.LastIndex(query.Prefix, "/"); i > 0 {
+		dir = query.Prefix[:i]
+	}
+	files, err := r.listFiles(tree, dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	after, err := query.after()
+	if err != nil {
+		return nil, "", err
+	}
+	present := make(map[string]string)
+	for i := sort.SearchStrings(files, after); i < len(files); i++ {
+		name := files[i]
+		if name <= after || name == GitManifest || !strings.HasPrefix(name, query.Prefix) {
+			continue
+		}
+		present[name] = gitValueType(name)
+		if query.PageSize > 0 && len(present) > query.PageSize && len(query.Tags) == 0 {
+			break
+		}
+	}
+
+	declared, err := r.manifest(tree)
+	if err != nil {
+		return nil, "", err
+	}
+	return query.page(mergeCapabilities(declared, present))
+}
+
+// gitValueType returns the value type of a file by its extension, files are
+// plain text unless they are JSON or YAML documents
+func gitValueType(name string) string {
+	switch filepath.Ext(name) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "text/plain"
+}
+
+// gitListing is the sorted list of files below a directory of a tree
+type gitListing struct {
+	tree  plumbing.Hash
+	dir   string
+	files []string
+}
+
+// listFiles returns the sorted paths of all files below dir, the caller must
+// hold the lock
+func (r *GitRepository) listFiles(tree *object.Tree, dir string) ([]string, error) {
+	if dir != "" {
+		subtree, err := tree.Tree(dir)
+		if err == object.ErrDirectoryNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve tree %s: %w", dir, err)
+		}
+		tree = subtree
+	}
+	if r.listing.tree == tree.Hash && r.listing.dir == dir {
+		return r.listing.files, nil
+	}
+
+	var files []string
+	err := tree.Files().ForEach(func(file *object.File) error {
+		if dir != "" {
+			files = append(files, dir+"/"+file.Name)
+		} else {
+			files = append(files, file.Name)
 		}
-		capabilities = append(capabilities, Capability{Key: file.Name, ValueType: extension})
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to enumerate files: %w", err)
 	}
+	sort.Strings(files)
+	r.listing = gitListing{tree: tree.Hash, dir: dir, files: files}
+	return files, nil
+}
 
-	return capabilities, nil
+type gitManifest struct {
+	Keys map[string]struct {
+		ValueType   string   `yaml:"value_type"`
+		Description string   `yaml:"description"`
+		ReadOnly    bool     `yaml:"read_only"`
+		Default     *string  `yaml:"default"`
+		Schema      string   `yaml:"schema"`
+		Owner       string   `yaml:"owner"`
+		Tags        []string `yaml:"tags"`
+	} `yaml:"keys"`
 }
 
-func (r *GitRepository) sync() error {
+// manifest returns the capabilities declared in the manifest of tree ordered
+// by precedence, the caller must hold the lock
+func (r *GitRepository) manifest(tree *object.Tree) ([]Capability, error) {
+	file, err := tree.File(GitManifest)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve %s: %w", GitManifest, err)
+	}
+	if declared, ok := r.manifests.get(file.Hash); ok {
+		return declared, nil
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve %s: %w", GitManifest, err)
+	}
+	var manifest gitManifest
+	if err := yaml.Unmarshal([]byte(contents), &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", GitManifest, err)
+	}
+
+	var declared []Capability
+	for key, entry := range manifest.Keys {
+		capability := Capability{
+			Key:         key,
+			ValueType:   entry.ValueType,
+			Description: entry.Description,
+			ReadOnly:    entry.ReadOnly,
+			Schema:      entry.Schema,
+			Owner:       entry.Owner,
+			Tags:        entry.Tags,
+		}
+		if entry.Default != nil {
+			capability.Default = []byte(*entry.Default)
+		}
+		declared = append(declared, capability)
+	}
+	sort.Slice(declared, func(i, j int) bool { return declared[i].Key < declared[j].Key })
+	declared = byPrecedence(declared)
+	r.manifests.add(file.Hash, declared)
+	return declared, nil
+}
+
+func (r *GitRepository) sync(ctx context.Context) error {
 	if !r.isRemote {
 		return nil
 	}
@@ -156,163 +356,785 @@ func (r *GitRepository) sync() error {
 		return err
 	}
 
-	err = tree.Pull(opts)
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return err
+	ctx, span := tracer.Start(ctx, "git pull", trace.WithSpanKind(trace.SpanKindClient))
+	err = tree.PullContext(ctx, opts)
+	if err == git.NoErrAlreadyUpToDate {
+		err = nil
 	}
+	endSpan(span, err)
+	return err
+}
 
-	return nil
+func (r *GitRepository) Sync(ctx context.Context, keys []string) (map[string]Data, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sync(ctx); err != nil {
+		return nil, 0, fmt.Errorf("failed to sync: %w", err)
+	}
+
+	head, err := r.head()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := r.filesAt(head, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	revision, err := r.depth(head)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, revision, nil
 }
 
-func (r *GitRepository) Sync(keys []string) (map[string]Data, error) {
-	data := make(map[string]Data)
+// SyncAt reads the keys from the last commit in the first-parent history of
+// HEAD authored at or before asOf, commit times have a resolution of one
+// second
+func (r *GitRepository) SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sync(ctx); err != nil {
+		return nil, 0, fmt.Errorf("failed to sync: %w", err)
+	}
+
+	c, err := r.head()
+	if err != nil {
+		return nil, 0, err
+	}
+	for c != nil && c.Author.When.After(asOf) {
+		if c, err = firstParent(c); err != nil {
+			return nil, 0, err
+		}
+	}
+	if c == nil {
+		return make(map[string]Data), 0, nil
+	}
+
+	data, err := r.filesAt(c, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, err := r.depth(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, revision, nil
+}
+
+// SyncRevision reads the keys from the commit at revision in the first-parent
+// history of HEAD
+func (r *GitRepository) SyncRevision(ctx context.Context, keys []string, revision int64) (map[string]Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if err := r.sync(); err != nil {
+	if err := r.sync(ctx); err != nil {
 		return nil, fmt.Errorf("failed to sync: %w", err)
 	}
 
-	tree, err := r.repo.Worktree()
+	c, err := r.commitAt(revision)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve tree: %w", err)
+		return nil, err
+	}
+	if c == nil {
+		return make(map[string]Data), nil
 	}
+	return r.filesAt(c, keys)
+}
 
-	for _, key := range keys {
-		// Check if the file exists in the repository
-		s, err := tree.Filesystem.Stat(key)
+// filesAt returns the files of keys in commit c, the caller must hold the lock
+func (r *GitRepository) filesAt(c *object.Commit, keys []string) (map[string]Data, error) {
+	selected, err := selectFiles(c, keys)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]Data)
+	for _, key := range selected {
+		d, ok, err := r.fileAt(c, key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to access file '%s': %v", key, err)
+			return nil, err
 		}
+		if ok {
+			data[key] = d
+		}
+	}
+	return data, nil
+}
+
+// History walks the first-parent history of HEAD like git log --first-parent
+// on the path of key, every commit changing the file is a version
+func (r *GitRepository) History(ctx context.Context, key string, limit int) ([]Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sync: %w", err)
+	}
+
+	c, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := entryHash(c, key)
+	if err != nil {
+		return nil, err
+	}
 
-		f, err := tree.Filesystem.Open(key)
+	var versions []Data
+	for c != nil && (limit <= 0 || len(versions) < limit) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		parent, err := firstParent(c)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open file '%s': %v", key, err)
+			return nil, err
 		}
-
-		// read file contents
-		value := make([]byte, s.Size())
-		_, err = f.Read(value)
+		before, err := entryHash(parent, key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file '%s': %v", key, err)
+			return nil, err
 		}
 
-		// Add the key-value pair to the data map
-		data[key] = Data{
-			Key:       key,
-			Value:     value,
-			ValueType: "text/plain",
-			UpdatedAt: s.ModTime(),
+		if before != hash {
+			if hash.IsZero() {
+				revision, err := r.depth(c)
+				if err != nil {
+					return nil, err
+				}
+				versions = append(versions, Data{Key: key, UpdatedAt: c.Author.When, Deleted: true, Revision: revision})
+			} else {
+				d, _, err := r.fileAt(c, key)
+				if err != nil {
+					return nil, err
+				}
+				versions = append(versions, d)
+			}
 		}
+		c, hash = parent, before
 	}
-
-	return data, nil
+	return versions, nil
 }
 
-func (r *GitRepository) Subscribe(keys []string) (<-chan Data, error) {
-	out := make(chan Data)
-
-	var repohash string
-	filehashes := make(map[string]string)
+func (r *GitRepository) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []Data, error) {
+	out := make(chan []Data)
 
 	go func() {
 		defer close(out)
+
+		base, groups, err := r.initialState(ctx, keys, fromRevision)
+		if err != nil {
+			r.forwardError(err)
+			return
+		}
+
 		for {
-			if err := r.sync(); err != nil {
-				r.forwardError(err)
-				// no reason to abort yet - just try again
+			for _, group := range groups {
+				select {
+				case out <- group:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-time.After(r.syncInterval):
+			case <-ctx.Done():
+				return
 			}
 
-			ref, err := r.repo.Head()
+			base, groups, err = r.changesSince(ctx, keys, base)
 			if err != nil {
-				r.forwardError(fmt.Errorf("failed to retrieve HEAD reference: %w", err))
-				break
+				r.forwardError(err)
+				return
 			}
+		}
+	}()
 
-			c, err := r.repo.CommitObject(ref.Hash())
+	return out, nil
+}
+
+// initialState returns the current state of keys when fromRevision is zero,
+// or the changes at and after fromRevision otherwise, along with the commit
+// to follow changes from
+func (r *GitRepository) initialState(ctx context.Context, keys []string, fromRevision int64) (*object.Commit, [][]Data, error) {
+	if fromRevision > 0 {
+		r.mu.Lock()
+		base, err := r.commitAt(fromRevision - 1)
+		r.mu.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		return r.changesSince(ctx, keys, base)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.sync(ctx); err != nil && ctx.Err() == nil {
+		r.forwardError(err)
+	}
+
+	head, err := r.head()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected, err := selectFiles(head, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initial := []Data{}
+	for _, key := range selected {
+		d, ok, err := r.fileAt(head, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			initial = append(initial, d)
+		}
+	}
+	return head, [][]Data{initial}, nil
+}
+
+// changesSince syncs the repository and returns the changes to keys grouped by
+// commit for every commit after base in revision order, along with the current
+// HEAD. A nil base denotes the empty repository before the first commit.
+func (r *GitRepository) changesSince(ctx context.Context, keys []string, base *object.Commit) (_ *object.Commit, _ [][]Data, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// a failed pull fails the poll although the local history is still read
+	var pullErr error
+	defer func(start time.Time) {
+		if err == nil {
+			r.metrics.ObservePoll("git", start, pullErr)
+		} else if ctx.Err() == nil {
+			r.metrics.ObservePoll("git", start, err)
+		}
+	}(time.Now())
+
+	if err := r.sync(ctx); err != nil && ctx.Err() == nil {
+		r.forwardError(err)
+		pullErr = err
+		// no reason to abort yet - just try again
+	}
+
+	head, err := r.head()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// if no update has been made since the last sync, skip
+	if base != nil && head.Hash == base.Hash {
+		return base, nil, nil
+	}
+
+	// collect the commits between base and HEAD, if base is no longer part of
+	// the history (e.g. after a force push) only compare base and HEAD
+	var commits []*object.Commit
+	for c := head; c != nil; {
+		if base != nil && c.Hash == base.Hash {
+			break
+		}
+		commits = append(commits, c)
+		if c, err = firstParent(c); err != nil {
+			return nil, nil, err
+		}
+		if c == nil && base != nil {
+			commits = []*object.Commit{head}
+		}
+	}
+
+	var groups [][]Data
+	prev := base
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		candidates, err := changedFiles(ctx, prev, c, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var updates []Data
+		for _, key := range candidates {
+			before, err := entryHash(prev, key)
+			if err != nil {
+				return nil, nil, err
+			}
+			after, err := entryHash(c, key)
 			if err != nil {
-				r.forwardError(fmt.Errorf("failed to retrieve commit: %w", err))
-				break
+				return nil, nil, err
+			}
+			if before == after {
+				continue
 			}
 
-			// if no update has been made since the last sync, skip
-			if ref.Hash().String() != repohash {
-				tree, err := c.Tree()
+			if after.IsZero() {
+				revision, err := r.depth(c)
 				if err != nil {
-					r.forwardError(fmt.Errorf("failed to retrieve tree: %w", err))
-					return
+					return nil, nil, err
 				}
+				updates = append(updates, Data{Key: key, UpdatedAt: c.Author.When, Deleted: true, Revision: revision})
+				continue
+			}
 
-				for _, key := range keys {
-					file, err := tree.File(key)
-					if err != nil {
-						r.forwardError(fmt.Errorf("failed to retrieve file '%s': %w", key, err))
-						continue
-					}
-
-					// if no update has been made since the last sync, skip
-					if file.Hash.String() == filehashes[key] {
-						continue
-					}
-
-					value, err := file.Contents()
-					if err != nil {
-						r.forwardError(fmt.Errorf("failed to retrieve file contents '%s': %w", key, err))
-						continue
-					}
-
-					out <- Data{
-						Key:       key,
-						Value:     []byte(value),
-						ValueType: "text/plain",
-						UpdatedAt: c.Author.When,
-					}
-					filehashes[key] = file.Hash.String()
-				}
+			d, _, err := r.fileAt(c, key)
+			if err != nil {
+				return nil, nil, err
 			}
+			updates = append(updates, d)
+		}
+		if len(updates) > 0 {
+			groups = append(groups, updates)
+		}
+		prev = c
+	}
 
-			repohash = ref.Hash().String()
-			<-time.After(r.syncInterval)
+	return head, groups, nil
+}
+
+// selectFiles returns the exact keys and the files in commit c matching the
+// selectors in keys
+func selectFiles(c *object.Commit, keys []string) ([]string, error) {
+	exact, selectors := splitSelectors(keys)
+	if len(selectors) == 0 || c == nil {
+		return exact, nil
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tree: %w", err)
+	}
+	selected := exact
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if file.Name == GitManifest {
+			return nil
 		}
-		close(out)
-	}()
+		if Match(selectors, file.Name) && !Match(exact, file.Name) {
+			selected = append(selected, file.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate files: %w", err)
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
 
-	return out, nil
+// changedFiles returns the exact keys and the files changed between prev and
+// c matching the selectors in keys, including created and removed files
+func changedFiles(ctx context.Context, prev, c *object.Commit, keys []string) ([]string, error) {
+	exact, selectors := splitSelectors(keys)
+	if len(selectors) == 0 {
+		return exact, nil
+	}
+
+	var from, to *object.Tree
+	var err error
+	if prev != nil {
+		if from, err = prev.Tree(); err != nil {
+			return nil, fmt.Errorf("failed to retrieve tree: %w", err)
+		}
+	}
+	if to, err = c.Tree(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve tree: %w", err)
+	}
+	changes, err := object.DiffTreeContext(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare trees: %w", err)
+	}
+
+	selected := exact
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		if name != GitManifest && Match(selectors, name) && !Match(exact, name) {
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
 }
 
-func (r *GitRepository) PushUpdate(data *Data) error {
+func (r *GitRepository) head() (*object.Commit, error) {
+	ref, err := r.repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve HEAD reference: %w", err)
+	}
+
+	c, err := r.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve commit: %w", err)
+	}
+	return c, nil
+}
+
+func firstParent(c *object.Commit) (*object.Commit, error) {
+	if c.NumParents() == 0 {
+		return nil, nil
+	}
+	return c.Parent(0)
+}
+
+// entryHash returns the blob hash of the file key in commit c, or the zero
+// hash if the file does not exist
+func entryHash(c *object.Commit, key string) (plumbing.Hash, error) {
+	if c == nil {
+		return plumbing.ZeroHash, nil
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to retrieve tree: %w", err)
+	}
+	entry, err := tree.FindEntry(key)
+	if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to retrieve file '%s': %w", key, err)
+	}
+	return entry.Hash, nil
+}
+
+// depth returns the number of commits in the first-parent history of c
+func (r *GitRepository) depth(c *object.Commit) (int64, error) {
+	var pending []plumbing.Hash
+	var depth int64
+	for c != nil {
+		if d, ok := r.depths.get(c.Hash); ok {
+			depth = d
+			break
+		}
+		pending = append(pending, c.Hash)
+
+		var err error
+		if c, err = firstParent(c); err != nil {
+			return 0, err
+		}
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		depth++
+		r.depths.add(pending[i], depth)
+	}
+	return depth, nil
+}
+
+// commitAt returns the commit at the given revision in the first-parent
+// history of HEAD, nil for revision zero and HEAD for future revisions
+func (r *GitRepository) commitAt(revision int64) (*object.Commit, error) {
+	if revision <= 0 {
+		return nil, nil
+	}
+
+	c, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	for c != nil {
+		depth, err := r.depth(c)
+		if err != nil {
+			return nil, err
+		}
+		if depth <= revision {
+			return c, nil
+		}
+		if c, err = firstParent(c); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+type keyAtCommit struct {
+	commit plumbing.Hash
+	key    string
+}
+
+type keyRevision struct {
+	revision int64
+	version  int64
+	when     time.Time
+}
+
+// keyRevision returns the revision, version and modification time of key in
+// commit c by walking the first-parent history until the key was created
+func (r *GitRepository) keyRevision(c *object.Commit, key string) (keyRevision, error) {
+	type step struct {
+		commit *object.Commit
+		hash   plumbing.Hash
+	}
+
+	// walk back until a memoized entry, the creation of the key or the root
+	var pending []step
+	var known keyRevision
+	var knownHash plumbing.Hash
+	for c != nil {
+		if info, ok := r.revisions.get(keyAtCommit{c.Hash, key}); ok {
+			known = info
+			knownHash, _ = entryHash(c, key)
+			break
+		}
+		hash, err := entryHash(c, key)
+		if err != nil {
+			return keyRevision{}, err
+		}
+		if hash.IsZero() {
+			break
+		}
+		pending = append(pending, step{c, hash})
+
+		if c, err = firstParent(c); err != nil {
+			return keyRevision{}, err
+		}
+	}
+
+	// replay the history forward, every content change is a new version
+	for i := len(pending) - 1; i >= 0; i-- {
+		s := pending[i]
+		if s.hash != knownHash {
+			depth, err := r.depth(s.commit)
+			if err != nil {
+				return keyRevision{}, err
+			}
+			known = keyRevision{revision: depth, version: known.version + 1, when: s.commit.Author.When}
+			knownHash = s.hash
+		}
+		r.revisions.add(keyAtCommit{s.commit.Hash, key}, known)
+	}
+	return known, nil
+}
+
+// fileAt returns the content of key in commit c and whether it exists
+func (r *GitRepository) fileAt(c *object.Commit, key string) (Data, bool, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return Data{}, false, fmt.Errorf("failed to retrieve tree: %w", err)
+	}
+
+	file, err := tree.File(key)
+	if err == object.ErrFileNotFound {
+		return Data{}, false, nil
+	}
+	if err != nil {
+		return Data{}, false, fmt.Errorf("failed to retrieve file '%s': %w", key, err)
+	}
+
+	value, err := file.Contents()
+	if err != nil {
+		return Data{}, false, fmt.Errorf("failed to retrieve file contents '%s': %w", key, err)
+	}
+
+	info, err := r.keyRevision(c, key)
+	if err != nil {
+		return Data{}, false, err
+	}
+
+	// the manifest may declare another value type than the extension
+	declared, err := r.manifest(tree)
+	if err != nil {
+		return Data{}, false, err
+	}
+
+	return Data{
+		Key:       key,
+		Value:     []byte(value),
+		ValueType: declare(declared, Capability{Key: key, ValueType: gitValueType(key)}).ValueType,
+		UpdatedAt: info.when,
+		Revision:  info.revision,
+		Version:   info.version,
+	}, true, nil
+}
+
+func (r *GitRepository) PushUpdate(ctx context.Context, data *Data) error {
+	return r.write(ctx, []Data{*data}, "Update key")
+}
+
+// PushBatch writes all updates in a single commit
+func (r *GitRepository) PushBatch(ctx context.Context, batch []Data) error {
+	return r.write(ctx, batch, "Update keys")
+}
+
+// Revert commits a batch restoring the state of a past revision as a new
+// commit on top of the history
+func (r *GitRepository) Revert(ctx context.Context, batch []Data, revision int64) error {
+	return r.write(ctx, batch, fmt.Sprintf("Revert to revision %d", revision))
+}
+
+func (r *GitRepository) Delete(ctx context.Context, key string) error {
+	return r.write(ctx, []Data{{Key: key, Deleted: true}}, "Delete key")
+}
+
+// write applies the batch to the worktree and commits it, the worktree is
+// reset if any of the changes fails
+func (r *GitRepository) write(ctx context.Context, batch []Data, message string) error {
+	for i := range batch {
+		if err := checkGitKey(batch[i].Key); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// check the preconditions against the latest remote state, a remote update
+	// racing the commit below is caught by the fast-forward check on push
+	conditional := false
+	for i := range batch {
+		if batch[i].ExpectedRevision != nil {
+			conditional = true
+		}
+	}
+	if conditional {
+		if err := r.sync(ctx); err != nil {
+			return fmt.Errorf("failed to sync: %w", err)
+		}
+		head, err := r.head()
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			current, exists, err := r.fileAt(head, batch[i].Key)
+			if err != nil {
+				return err
+			}
+			if err := checkRevision(&batch[i], current, exists); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Get the current branch
 	w, err := r.repo.Worktree()
 	if err != nil {
 		return err
 	}
+	head, err := r.repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve HEAD reference: %w", err)
+	}
 
-	// Write the data to the file
-	err = ioutil.WriteFile(filepath.Join(data.Key), data.Value, 0644)
+	changed, err := stage(w, batch)
 	if err != nil {
+		if rerr := w.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset}); rerr != nil {
+			return fmt.Errorf("failed to reset worktree: %v: %w", rerr, err)
+		}
 		return err
 	}
+	if !changed {
+		return nil
+	}
+
+	err = r.commit(ctx, w, message)
+	if conditional && isRejected(err) {
+		return fmt.Errorf("%w: %v", ErrRevisionMismatch, err)
+	}
+	return err
+}
 
-	// Commit the changes to the branch
-	_, err = w.Add(data.Key)
+// checkGitKey rejects keys which are not files of the worktree the store may
+// write, i.e. the manifest, the repository metadata and paths outside of it
+func checkGitKey(key string) error {
+	name := path.Clean(key)
+	if name == GitManifest || name == ".git" || strings.HasPrefix(name, ".git/") ||
+		name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return fmt.Errorf("%w: %s", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// stage writes or removes the files of the batch in the worktree and adds them
+// to the index, it reports whether anything changed
+func stage(w *git.Worktree, batch []Data) (bool, error) {
+	changed := false
+	for _, data := range batch {
+		if data.Deleted {
+			if _, err := w.Filesystem.Stat(data.Key); os.IsNotExist(err) {
+				continue
+			}
+			if _, err := w.Remove(data.Key); err != nil {
+				return false, err
+			}
+			changed = true
+			continue
+		}
+
+		// Write the data to the file inside the worktree
+		if dir := filepath.Dir(data.Key); dir != "." {
+			if err := w.Filesystem.MkdirAll(dir, 0755); err != nil {
+				return false, err
+			}
+		}
+		f, err := w.Filesystem.Create(data.Key)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Write(data.Value)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := w.Add(data.Key); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// commit commits the staged changes and pushes them to the remote repository.
+// If the remote rejects the commit because its parent is no longer the remote
+// HEAD, the local branch is reset to the parent commit.
+func (r *GitRepository) commit(ctx context.Context, w *git.Worktree, message string) error {
+	parent, err := r.repo.Head()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to retrieve HEAD reference: %w", err)
 	}
 
-	_, err = w.Commit("Update key", &git.CommitOptions{
+	_, span := tracer.Start(ctx, "git commit")
+	_, err = w.Commit(message, &git.CommitOptions{
 		Author: &object.Signature{
 			Name:  r.name,
 			Email: r.email,
 			When:  time.Now(),
 		},
 	})
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
 
 	// Push the changes to the remote repository
-	err = r.repo.Push(&git.PushOptions{})
+	if !r.isRemote {
+		return nil
+	}
+	ctx, span = tracer.Start(ctx, "git push", trace.WithSpanKind(trace.SpanKindClient))
+	err = r.repo.PushContext(ctx, &git.PushOptions{Auth: r.auth})
+	if err == git.NoErrAlreadyUpToDate {
+		err = nil
+	}
+	endSpan(span, err)
 	if err != nil {
+		if isRejected(err) {
+			if rerr := w.Reset(&git.ResetOptions{Commit: parent.Hash(), Mode: git.HardReset}); rerr != nil {
+				return fmt.Errorf("failed to reset rejected commit: %v: %w", rerr, err)
+			}
+		}
 		return err
 	}
 
 	return nil
 }
+
+// isRejected reports whether a push failed because the remote has diverged
+func isRejected(err error) bool {
+	return err != nil && (err == git.ErrForceNeeded || strings.Contains(err.Error(), "non-fast-forward"))
+}
@@ -1,5 +1,272 @@
 package storage_test
 
-import "github.com/bartke/datastream/storage"
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/storagetest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
 
 var _ storage.Storage = &storage.GitRepository{}
+
+// initBareRepository creates a bare repository with a single initial commit
+func initBareRepository(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "remote.git")
+	if _, err := git.PlainInit(bare, true); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.PlainInit(filepath.Join(dir, "seed"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bare}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return bare
+}
+
+// commitFile commits a file to the bare repository remote through a separate
+// clone
+func commitFile(t *testing.T, remote, name, content string) {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("Add "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitConformance(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		store, err := storage.NewGitRepository(storage.GitRepositoryConfig{
+			RepoPath:     initBareRepository(t),
+			CloneDir:     t.TempDir(),
+			SyncInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestGitManifest(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+
+	// the manifest is maintained out of band, it is not a writable key
+	remote := initBareRepository(t)
+	manifest := `keys:
+  config/:
+    owner: platform
+    tags: [config]
+  config/limits.json:
+    description: request limits
+    value_type: json
+    default: '{"limit": 10}'
+    schema: schemas/limits.json
+  config/generated.txt:
+    read_only: true
+`
+	commitFile(t, remote, storage.GitManifest, manifest)
+
+	store, err := storage.NewGitRepository(storage.GitRepositoryConfig{RepoPath: remote, CloneDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = store.PushBatch(ctx, []storage.Data{
+		{Key: "config/limits.json", Value: []byte(`{"limit": 5}`)},
+		{Key: "config/generated.txt", Value: []byte("generated")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities, _, err := store.ListCapabilities(ctx, storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Capability{
+		{Key: "config/", Owner: "platform", Tags: []string{"config"}},
+		{Key: "config/generated.txt", ValueType: "text/plain", ReadOnly: true, Owner: "platform", Tags: []string{"config"}},
+		{Key: "config/limits.json", ValueType: "json", Description: "request limits", Default: []byte(`{"limit": 10}`), Schema: "schemas/limits.json", Owner: "platform", Tags: []string{"config"}},
+	}
+	if !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("ListCapabilities = %+v, want %+v", capabilities, want)
+	}
+
+	// the manifest is not a key and declares the value type of synced files
+	data, _, err := store.Sync(ctx, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data[storage.GitManifest]; ok {
+		t.Errorf("Sync returned the manifest")
+	}
+	data, _, err = store.Sync(ctx, []string{"config/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vt := data["config/limits.json"].ValueType; vt != "json" {
+		t.Errorf("value type of config/limits.json = %q, want json", vt)
+	}
+	if vt := data["config/generated.txt"].ValueType; vt != "text/plain" {
+		t.Errorf("value type of config/generated.txt = %q, want text/plain", vt)
+	}
+}
+
+func TestGitCloneDirReuse(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+
+	config := storage.GitRepositoryConfig{RepoPath: initBareRepository(t), CloneDir: t.TempDir()}
+	first, err := storage.NewGitRepository(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := first.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted store opens the existing clone instead of failing
+	second, err := storage.NewGitRepository(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := second.Sync(ctx, []string{"alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["alpha"].Value) != "1" {
+		t.Errorf("alpha = %q, want 1", data["alpha"].Value)
+	}
+}
+
+func TestGitRevert(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+
+	remote := initBareRepository(t)
+	store, err := storage.NewGitRepository(storage.GitRepositoryConfig{RepoPath: remote, CloneDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, value := range []string{"1", "2"} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.(storage.Reverter).Revert(ctx, []storage.Data{{Key: "alpha", Value: []byte("1")}}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the revert is pushed as a new commit on top of the history
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "Revert to revision 2" {
+		t.Errorf("HEAD commit message = %q, want the revert", commit.Message)
+	}
+	history, err := store.History(ctx, "alpha", 0)
+	if err != nil || len(history) != 3 || string(history[0].Value) != "1" {
+		t.Errorf("History = %+v, %v, want all three versions", history, err)
+	}
+}
+
+func TestGitReservedKeys(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+
+	store, err := storage.NewGitRepository(storage.GitRepositoryConfig{RepoPath: initBareRepository(t), CloneDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{storage.GitManifest, ".git/config", "./.git/HEAD", "a/../.git", "../outside"} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: key, Value: []byte("x")}); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("PushUpdate(%q) = %v, want ErrReservedKey", key, err)
+		}
+		if err := store.PushBatch(ctx, []storage.Data{{Key: "alpha", Value: []byte("1")}, {Key: key, Value: []byte("x")}}); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("PushBatch(%q) = %v, want ErrReservedKey", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("Delete(%q) = %v, want ErrReservedKey", key, err)
+		}
+	}
+
+	// a rejected batch writes nothing
+	data, _, err := store.Sync(ctx, []string{"alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Sync = %v after rejected batches", data)
+	}
+}
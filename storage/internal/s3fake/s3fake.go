@@ -0,0 +1,309 @@
+// Package s3fake implements a minimal in-process S3 compatible server for
+// testing the S3 storage backend. Buckets are versioned.
+package s3fake
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	metadata http.Header
+
+	versionID    string
+	deleteMarker bool
+}
+
+// Server is a path-style S3 server that keeps all objects in memory
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	// versions of every object by bucket and key, the oldest first
+	versions    map[string]map[string][]*object
+	nextVersion int
+	// requests counts the requests by method
+	requests map[string]int
+}
+
+// New starts a server with the given buckets
+func New(buckets ...string) *Server {
+	s := &Server{
+		buckets:  make(map[string]map[string]*object),
+		versions: make(map[string]map[string][]*object),
+		requests: make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+		s.versions[bucket] = make(map[string][]*object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Requests returns the number of requests with method served so far
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: code})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key, _ := strings.Cut(path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method]++
+
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if key == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+			return
+		}
+		if _, ok := r.URL.Query()["versions"]; ok {
+			s.listVersions(w, r, bucketName)
+			return
+		}
+		s.list(w, r, bucketName, bucket)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		obj, ok := bucket[key]
+		if id := r.URL.Query().Get("versionId"); id != "" {
+			obj, ok = s.version(bucketName, key, id)
+		}
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range obj.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("X-Amz-Version-Id", obj.versionID)
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodPut:
+		existing, exists := bucket[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || existing.etag != match) {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		sum := md5.Sum(data)
+		obj := &object{
+			data:     data,
+			etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+			modified: time.Now().UTC(),
+			metadata: make(http.Header),
+		}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				obj.metadata[name] = values
+			}
+		}
+		s.nextVersion++
+		obj.versionID = fmt.Sprint(s.nextVersion)
+		bucket[key] = obj
+		s.versions[bucketName][key] = append(s.versions[bucketName][key], obj)
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("X-Amz-Version-Id", obj.versionID)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if _, ok := bucket[key]; ok {
+			s.nextVersion++
+			marker := &object{modified: time.Now().UTC(), versionID: fmt.Sprint(s.nextVersion), deleteMarker: true}
+			s.versions[bucketName][key] = append(s.versions[bucketName][key], marker)
+			delete(bucket, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type listContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listContent
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, name string, bucket map[string]*object) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		fmt.Sscan(v, &maxKeys)
+	}
+	start := query.Get("continuation-token")
+	if start == "" {
+		start = query.Get("start-after")
+	}
+
+	var keys []string
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) && key > start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{
+		Name:              name,
+		Prefix:            prefix,
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := bucket[key]
+		result.Contents = append(result.Contents, listContent{
+			Key:          key,
+			LastModified: obj.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// version returns the version id of key, delete markers are not found
+func (s *Server) version(bucket, key, id string) (*object, bool) {
+	for _, obj := range s.versions[bucket][key] {
+		if obj.versionID == id && !obj.deleteMarker {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+type listVersion struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int
+	StorageClass string `xml:",omitempty"`
+}
+
+type listVersionsResult struct {
+	XMLName       xml.Name `xml:"ListVersionsResult"`
+	Name          string
+	Prefix        string
+	MaxKeys       int
+	IsTruncated   bool
+	Versions      []listVersion `xml:"Version"`
+	DeleteMarkers []listVersion `xml:"DeleteMarker"`
+}
+
+// listVersions lists all versions under the prefix in one page, the newest
+// version of every key first. Times are listed with full precision to order
+// versions written in quick succession.
+func (s *Server) listVersions(w http.ResponseWriter, r *http.Request, name string) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range s.versions[name] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listVersionsResult{Name: name, Prefix: prefix, MaxKeys: 1000}
+	for _, key := range keys {
+		versions := s.versions[name][key]
+		for i := len(versions) - 1; i >= 0; i-- {
+			obj := versions[i]
+			version := listVersion{
+				Key:          key,
+				VersionId:    obj.versionID,
+				IsLatest:     i == len(versions)-1,
+				LastModified: obj.modified.Format(time.RFC3339Nano),
+			}
+			if obj.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, version)
+				continue
+			}
+			version.ETag = obj.etag
+			version.Size = len(obj.data)
+			version.StorageClass = "STANDARD"
+			result.Versions = append(result.Versions, version)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
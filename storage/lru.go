@@ -0,0 +1,47 @@
+package storage
+
+import "container/list"
+
+// lru maps up to size keys to values, adding a key to a full map evicts the
+// least recently used one. It is not safe for concurrent use.
+type lru[K comparable, V any] struct {
+	size    int
+	entries map[K]*list.Element
+	// order holds the entries, the most recently used first
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](size int) *lru[K, V] {
+	return &lru[K, V]{size: size, entries: make(map[K]*list.Element), order: list.New()}
+}
+
+// get returns the value of key and marks it as recently used
+func (l *lru[K, V]) get(key K) (V, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+// add sets the value of key and marks it as recently used
+func (l *lru[K, V]) add(key K, value V) {
+	if e, ok := l.entries[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
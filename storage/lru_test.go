@@ -0,0 +1,32 @@
+package storage
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	l := newLRU[string, int](2)
+	l.add("a", 1)
+	l.add("b", 2)
+	if v, ok := l.get("a"); !ok || v != 1 {
+		t.Errorf("get(a) = %d, %v, want 1", v, ok)
+	}
+
+	// b is the least recently used key
+	l.add("c", 3)
+	if _, ok := l.get("b"); ok {
+		t.Error("b not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := l.get(key); !ok || v != want {
+			t.Errorf("get(%s) = %d, %v, want %d", key, v, ok, want)
+		}
+	}
+
+	// updating a key does not evict another
+	l.add("c", 4)
+	if v, ok := l.get("a"); !ok || v != 1 {
+		t.Errorf("get(a) = %d, %v, want 1", v, ok)
+	}
+	if v, _ := l.get("c"); v != 4 {
+		t.Errorf("get(c) = %d, want 4", v)
+	}
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage implements the Storage interface in process memory. Updates are
+// pushed to subscribers as they happen instead of being polled.
+type MemoryStorage struct {
+	mu           sync.RWMutex
+	data         map[string]Data
+	capabilities []Capability
+	subscribers  map[*memorySubscriber]struct{}
+
+	// revision is the current store revision and log holds every change in
+	// revision order for resuming subscriptions. changed holds the time each
+	// change of the log was made at, UpdatedAt is set by clients.
+	revision int64
+	log      []Data
+	changed  []time.Time
+}
+
+type MemoryConfig struct {
+	// optional initial data
+	Seed []Data
+
+	// optional capability declarations by key or selector, keys without a
+	// declared value type are listed with the type of their current value
+	Capabilities []Capability
+}
+
+// NewMemoryStorage creates a new in-memory storage
+func NewMemoryStorage(config MemoryConfig) *MemoryStorage {
+	store := &MemoryStorage{
+		data:        make(map[string]Data),
+		subscribers: make(map[*memorySubscriber]struct{}),
+	}
+
+	store.capabilities = append(store.capabilities, config.Capabilities...)
+
+	// seeds were made before the store existed, at their update time
+	for _, data := range config.Seed {
+		changed := data.UpdatedAt
+		if changed.IsZero() {
+			changed = time.Now()
+		}
+		store.apply([]Data{data}, changed)
+	}
+
+	return store
+}
+
+func copyData(data Data) Data {
+	data.Value = append([]byte(nil), data.Value...)
+	return data
+}
+
+func (m *MemoryStorage) ListCapabilities(ctx context.Context, query CapabilityQuery) ([]Capability, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	present := make(map[string]string, len(m.data))
+	for key, data := range m.data {
+		if strings.HasPrefix(key, query.Prefix) {
+			present[key] = data.ValueType
+		}
+	}
+	return query.page(mergeCapabilities(m.capabilities, present))
+}
+
+func (m *MemoryStorage) Sync(ctx context.Context, keys []string) (map[string]Data, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]Data)
+	for key, data := range m.selected(keys) {
+		result[key] = copyData(data)
+	}
+	return result, m.revision, nil
+}
+
+// SyncAt replays the log up to the last change made at or before asOf
+func (m *MemoryStorage) SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	end := len(m.log)
+	for end > 0 && m.changed[end-1].After(asOf) {
+		end--
+	}
+	var revision int64
+	if end > 0 {
+		revision = m.log[end-1].Revision
+	}
+	return m.replay(keys, revision), revision, nil
+}
+
+func (m *MemoryStorage) SyncRevision(ctx context.Context, keys []string, revision int64) (map[string]Data, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.replay(keys, revision), nil
+}
+
+// replay returns copies of the entries of keys at revision, the caller must
+// hold the lock
+func (m *MemoryStorage) replay(keys []string, revision int64) map[string]Data {
+	result := make(map[string]Data)
+	for _, data := range m.log {
+		if data.Revision > revision {
+			break
+		}
+		if !Match(keys, data.Key) {
+			continue
+		}
+		if data.Deleted {
+			delete(result, data.Key)
+		} else {
+			result[data.Key] = copyData(data)
+		}
+	}
+	return result
+}
+
+func (m *MemoryStorage) History(ctx context.Context, key string, limit int) ([]Data, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var versions []Data
+	for i := len(m.log) - 1; i >= 0 && (limit <= 0 || len(versions) < limit); i-- {
+		if m.log[i].Key == key {
+			versions = append(versions, copyData(m.log[i]))
+		}
+	}
+	return versions, nil
+}
+
+// selected returns the current entries of keys, the caller must hold the lock
+func (m *MemoryStorage) selected(keys []string) map[string]Data {
+	exact, selectors := splitSelectors(keys)
+	result := make(map[string]Data)
+	for _, key := range exact {
+		if data, ok := m.data[key]; ok {
+			result[key] = data
+		}
+	}
+	if len(selectors) > 0 {
+		for key, data := range m.data {
+			if Match(selectors, key) {
+				result[key] = data
+			}
+		}
+	}
+	return result
+}
+
+func (m *MemoryStorage) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []Data, error) {
+	sub := newMemorySubscriber(keys)
+
+	// register and queue the initial state or the replayed changes under the
+	// same lock so that no update can slip in between
+	m.mu.Lock()
+	if fromRevision > 0 {
+		// the log is ordered by revision, changes of a batch share a revision
+		start := sort.Search(len(m.log), func(i int) bool {
+			return m.log[i].Revision >= fromRevision
+		})
+		for i := start; i < len(m.log); {
+			j := i
+			for j < len(m.log) && m.log[j].Revision == m.log[i].Revision {
+				j++
+			}
+			sub.enqueue(m.log[i:j], false)
+			i = j
+		}
+	} else {
+		sub.enqueue(sortedByKey(m.selected(keys)), true)
+	}
+	m.subscribers[sub] = struct{}{}
+	m.mu.Unlock()
+
+	out := make(chan []Data)
+	go func() {
+		defer close(out)
+		defer func() {
+			m.mu.Lock()
+			delete(m.subscribers, sub)
+			m.mu.Unlock()
+		}()
+		sub.run(ctx, out)
+	}()
+
+	return out, nil
+}
+
+func (m *MemoryStorage) PushUpdate(ctx context.Context, data *Data) error {
+	return m.PushBatch(ctx, []Data{*data})
+}
+
+func (m *MemoryStorage) PushBatch(ctx context.Context, batch []Data) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range batch {
+		current, exists := m.data[batch[i].Key]
+		if err := checkRevision(&batch[i], current, exists); err != nil {
+			return err
+		}
+	}
+	m.apply(batch, time.Now())
+	return nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data[key]; !ok {
+		return nil
+	}
+	m.apply([]Data{{Key: key, Deleted: true}}, time.Now())
+	return nil
+}
+
+// apply assigns the next revision to a batch of changes made at changed,
+// records them and notifies the subscribers. Batches which change nothing,
+// e.g. deleting a missing key, do not take a revision. The caller must hold
+// the write lock.
+func (m *MemoryStorage) apply(batch []Data, changed time.Time) {
+	changes := make([]Data, 0, len(batch))
+	for _, data := range batch {
+		change := copyData(data)
+		change.ExpectedRevision = nil
+		if change.UpdatedAt.IsZero() {
+			change.UpdatedAt = time.Now()
+		}
+
+		change.Revision = m.revision + 1
+		if change.Deleted {
+			if _, ok := m.data[change.Key]; !ok {
+				continue
+			}
+			change.Value = nil
+			change.Version = 0
+			delete(m.data, change.Key)
+		} else {
+			change.Version = m.data[change.Key].Version + 1
+			m.data[change.Key] = change
+		}
+		m.log = append(m.log, change)
+		m.changed = append(m.changed, changed)
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	m.revision++
+
+	for sub := range m.subscribers {
+		sub.enqueue(changes, false)
+	}
+}
+
+// memorySubscriber buffers updates for a single subscription so that writers
+// never block on slow readers
+type memorySubscriber struct {
+	keys      map[string]bool
+	selectors []string
+
+	mu     sync.Mutex
+	queue  [][]Data
+	notify chan struct{}
+}
+
+func newMemorySubscriber(keys []string) *memorySubscriber {
+	exact, selectors := splitSelectors(keys)
+	sub := &memorySubscriber{
+		keys:      make(map[string]bool, len(exact)),
+		selectors: selectors,
+		notify:    make(chan struct{}, 1),
+	}
+	for _, key := range exact {
+		sub.keys[key] = true
+	}
+	return sub
+}
+
+// enqueue queues copies of the changes to the subscribed keys as one group,
+// empty groups are only queued if always is set
+func (s *memorySubscriber) enqueue(changes []Data, always bool) {
+	var group []Data
+	for _, data := range changes {
+		if s.keys[data.Key] || Match(s.selectors, data.Key) {
+			group = append(group, copyData(data))
+		}
+	}
+	if len(group) == 0 && !always {
+		return
+	}
+
+	s.mu.Lock()
+	s.queue = append(s.queue, group)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySubscriber) run(ctx context.Context, out chan<- []Data) {
+	for {
+		s.mu.Lock()
+		pending := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, group := range pending {
+			select {
+			case out <- group:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/storagetest"
+)
+
+var _ storage.Storage = &storage.MemoryStorage{}
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage(storage.MemoryConfig{})
+	})
+}
+
+func TestMemoryCapabilities(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "services/payments/limit", Value: []byte("5"), ValueType: "int"},
+			{Key: "services/search/limit", Value: []byte("7"), ValueType: "int"},
+		},
+		Capabilities: []storage.Capability{
+			{Key: "services/", Owner: "platform", Tags: []string{"services"}},
+			{Key: "services/payments/limit", Description: "payment limit", ReadOnly: true},
+			{Key: "feature_flag", ValueType: "bool", Default: []byte("false")},
+		},
+	})
+
+	capabilities, _, err := store.ListCapabilities(context.Background(), storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Capability{
+		{Key: "feature_flag", ValueType: "bool", Default: []byte("false")},
+		{Key: "services/", Owner: "platform", Tags: []string{"services"}},
+		{Key: "services/payments/limit", ValueType: "int", Description: "payment limit", ReadOnly: true, Owner: "platform", Tags: []string{"services"}},
+		{Key: "services/search/limit", ValueType: "int", Owner: "platform", Tags: []string{"services"}},
+	}
+	if !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("ListCapabilities = %+v, want %+v", capabilities, want)
+	}
+}
+
+func TestMemoryRevisionsWithoutGaps(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	ctx := context.Background()
+
+	// batches changing nothing do not take a revision
+	if err := store.PushBatch(ctx, []storage.Data{{Key: "missing", Deleted: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1", "2"} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PushBatch(ctx, []storage.Data{{Key: "missing", Deleted: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := store.History(ctx, "alpha", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := store.Sync(ctx, []string{"alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Revision != 1 || versions[0].Revision != 2 || revision != 2 {
+		t.Errorf("History = %+v at revision %d, want revisions 1 and 2", versions, revision)
+	}
+}
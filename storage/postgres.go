@@ -2,13 +2,19 @@ package storage
 
 import (
 	"fmt"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
 // PostgresStorage implements the Storage interface for a Postgres database
 func NewPostgresStorage(config SQLConfig) (Storage, error) {
+	if config.Table == "" {
+		config.Table = DefaultTable
+	}
+
 	// ensure that table exists and has the columns: key, value, value_type, updated_at
 	// if not, error out
-	stmt, err := config.DB.Prepare("SELECT table_name FROM information_schema.tables WHERE table_schema='public' AND table_name=?")
+	stmt, err := config.DB.Prepare("SELECT table_name FROM information_schema.tables WHERE table_schema='public' AND table_name=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +29,7 @@ func NewPostgresStorage(config SQLConfig) (Storage, error) {
 	}
 
 	// check that the table has the correct columns
-	stmt, err = config.DB.Prepare("SELECT column_name FROM information_schema.columns WHERE table_name=?")
+	stmt, err = config.DB.Prepare("SELECT column_name FROM information_schema.columns WHERE table_schema='public' AND table_name=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -60,14 +66,96 @@ func NewPostgresStorage(config SQLConfig) (Storage, error) {
 		return nil, fmt.Errorf("table %s does not have a column named 'updated_at'", config.Table)
 	}
 
-	return &SQLTable{
-		db:           config.DB,
-		table:        config.Table,
-		syncInterval: config.SyncInterval,
-		errorChannel: config.ErrorChan,
-	}, nil
+	return newSQLTable(config, semconv.DBSystemPostgreSQL, postgresLogSchema)
 }
 
+// postgresLogSchema creates the change log and the metadata table of a table,
+// {table} is replaced by the table name. Timestamps are logged in the RFC3339
+// format written by PushUpdate whatever the type of the updated_at column. The
+// changed_at column holds the time a change was logged as Unix nanoseconds to
+// look up revisions by time, as updated_at is set by clients.
+//
+// Revisions are drawn from a sequence when a change is logged, not when it is
+// committed. Writers thus lock the change log until they commit, before their
+// first statement touches a row, so that no revision becomes visible after a
+// higher one and pollers following the log by revision cannot skip changes.
+// Rows written before the change log existed are logged as their first
+// version when the log is empty.
+const postgresLogSchema = `
+	CREATE TABLE IF NOT EXISTS {table}_meta (
+		key TEXT PRIMARY KEY,
+		value_type TEXT,
+		description TEXT,
+		read_only BOOLEAN NOT NULL DEFAULT FALSE,
+		default_value BYTEA,
+		schema_ref TEXT,
+		owner TEXT,
+		tags TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS {table}_log (
+		revision BIGSERIAL PRIMARY KEY,
+		key TEXT NOT NULL,
+		value BYTEA,
+		value_type TEXT,
+		updated_at TEXT,
+		version BIGINT NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT FALSE,
+		changed_at BIGINT
+	);
+
+	CREATE INDEX IF NOT EXISTS {table}_log_key ON {table}_log (key, revision);
+
+	ALTER TABLE {table}_log ADD COLUMN IF NOT EXISTS changed_at BIGINT;
+	UPDATE {table}_log SET changed_at = floor(extract(epoch FROM updated_at::timestamptz) * 1000000)::bigint * 1000
+	WHERE changed_at IS NULL;
+	CREATE INDEX IF NOT EXISTS {table}_log_changed_at ON {table}_log (changed_at);
+
+	CREATE OR REPLACE FUNCTION {table}_log_append() RETURNS trigger AS $$
+	DECLARE
+		updated timestamptz;
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO {table}_log (key, updated_at, changed_at, version, deleted)
+			VALUES (OLD.key, to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				floor(extract(epoch FROM clock_timestamp()) * 1000000)::bigint * 1000, 0, TRUE);
+			RETURN OLD;
+		END IF;
+		updated := COALESCE(NEW.updated_at::timestamptz, now());
+		INSERT INTO {table}_log (key, value, value_type, updated_at, changed_at, version)
+		VALUES (NEW.key, NEW.value, NEW.value_type,
+			to_char(updated AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+			floor(extract(epoch FROM clock_timestamp()) * 1000000)::bigint * 1000, COALESCE(
+			(SELECT CASE WHEN deleted THEN 0 ELSE version END FROM {table}_log WHERE key = NEW.key ORDER BY revision DESC LIMIT 1), 0) + 1);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE FUNCTION {table}_log_lock() RETURNS trigger AS $$
+	BEGIN
+		LOCK TABLE {table}_log IN SHARE ROW EXCLUSIVE MODE;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS {table}_log_lock ON {table};
+	CREATE TRIGGER {table}_log_lock
+	BEFORE INSERT OR UPDATE OR DELETE ON {table}
+	FOR EACH STATEMENT EXECUTE FUNCTION {table}_log_lock();
+
+	DROP TRIGGER IF EXISTS {table}_log_append ON {table};
+	CREATE TRIGGER {table}_log_append
+	AFTER INSERT OR UPDATE OR DELETE ON {table}
+	FOR EACH ROW EXECUTE FUNCTION {table}_log_append();
+
+	LOCK TABLE {table}_log IN SHARE ROW EXCLUSIVE MODE;
+	INSERT INTO {table}_log (key, value, value_type, updated_at, changed_at, version)
+	SELECT key, value, value_type, to_char(changed AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+		floor(extract(epoch FROM changed) * 1000000)::bigint * 1000, 1
+	FROM (SELECT key, value, value_type, COALESCE(updated_at::timestamptz, now()) AS changed FROM {table}) d
+	WHERE NOT EXISTS (SELECT 1 FROM {table}_log) ORDER BY key;
+`
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -2,15 +2,27 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bartke/datastream/metrics"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // S3Storage implements the datastream.Storage interface for S3-compatible storage
@@ -19,6 +31,15 @@ type S3Storage struct {
 	bucket       string
 	syncInterval time.Duration
 	errorChannel chan<- error
+	metrics      *metrics.Metrics
+
+	// mu serializes the increments of the revision counter by this instance,
+	// increments by other instances are detected by a conditional PUT
+	mu sync.Mutex
+
+	// listed memoizes the metadata of listed objects by key
+	listedMu sync.Mutex
+	listed   *lru[string, s3Listed]
 }
 
 type S3StorageConfig struct {
@@ -41,6 +62,9 @@ type S3StorageConfig struct {
 
 	// optional error channel
 	ErrorChan chan<- error
+
+	// optional metrics of the object polls
+	Metrics *metrics.Metrics
 }
 
 // NewS3Storage creates a new S3Storage instance
@@ -59,11 +83,17 @@ func NewS3Storage(config S3StorageConfig) (*S3Storage, error) {
 		config.SyncInterval = DefaultSyncInterval
 	}
 
+	client := s3.New(sess)
+	client.Handlers.Validate.PushFrontNamed(request.NamedHandler{Name: "datastream.StartSpan", Fn: startS3Span})
+	client.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "datastream.EndSpan", Fn: endS3Span})
+
 	return &S3Storage{
-		client:       s3.New(sess),
+		client:       client,
 		bucket:       config.Bucket,
 		syncInterval: config.SyncInterval,
 		errorChannel: config.ErrorChan,
+		metrics:      config.Metrics,
+		listed:       newLRU[string, s3Listed](s3MemoEntries),
 	}, nil
 }
 
@@ -73,159 +103,1072 @@ func (s *S3Storage) forwardError(err error) {
 	}
 }
 
-// ListCapabilities lists available keys for subscription
-func (s *S3Storage) ListCapabilities() ([]Capability, error) {
+type s3SpanKey struct{}
+
+// startS3Span starts the span of a request, e.g. "S3.GetObject", the span
+// covers the retries of the request
+func startS3Span(r *request.Request) {
+	ctx, span := tracer.Start(r.Context(), "S3."+r.Operation.Name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCServiceKey.String("S3"),
+			semconv.RPCMethodKey.String(r.Operation.Name),
+		),
+	)
+	r.SetContext(context.WithValue(ctx, s3SpanKey{}, span))
+}
+
+// endS3Span ends the span of a request, missing objects are expected and not
+// recorded as errors
+func endS3Span(r *request.Request) {
+	span, ok := r.Context().Value(s3SpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	err := r.Error
+	if r.HTTPResponse != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(r.HTTPResponse.StatusCode))
+		if r.HTTPResponse.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+	}
+	endSpan(span, err)
+}
+
+// isNotFound reports whether err is a missing object error from GetObject or HeadObject
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// s3MetaPrefix holds bookkeeping objects which are not exposed as keys
+	s3MetaPrefix = ".datastream/"
+	// s3RevisionKey stores the current store revision
+	s3RevisionKey = s3MetaPrefix + "revision"
+	// s3BatchPrefix holds the manifests of batches in progress
+	s3BatchPrefix = s3MetaPrefix + "batches/"
+
+	// s3MemoEntries bounds the memoized object metadata
+	s3MemoEntries = 100000
+	// s3Root is the capability of the root directory, it is listed with the
+	// objects in key order
+	s3Root = "/"
+)
+
+// S3BatchTimeout is the age after which a batch manifest is removed, an
+// unfinished batch is considered abandoned and its objects become visible to
+// subscribers
+var S3BatchTimeout = time.Minute
+
+// ListCapabilities lists available keys for subscription, keys are described
+// by the object metadata x-amz-meta-description, -read-only, -default, -schema,
+// -owner and -tags (comma separated). The metadata is requested for the
+// objects written since they were last listed. Pages continue listing the
+// bucket after the last key of the previous page.
+func (s *S3Storage) ListCapabilities(ctx context.Context, query CapabilityQuery) ([]Capability, string, error) {
+	after, err := query.after()
+	if err != nil {
+		return nil, "", err
+	}
+
 	var capabilities []Capability
+	next := ""
+	add := func(capability Capability) bool {
+		if !query.matches(capability) {
+			return true
+		}
+		if query.full(len(capabilities)) {
+			next = pageToken(capabilities[len(capabilities)-1].Key)
+			return false
+		}
+		capabilities = append(capabilities, capability)
+		return true
+	}
 
-	// List all objects in the S3 bucket
-	result, err := s.client.ListObjectsV2(&s3.ListObjectsV2Input{
+	root := strings.HasPrefix(s3Root, query.Prefix) && after < s3Root
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(query.Prefix),
+	}
+	if after != "" {
+		input.StartAfter = aws.String(after)
+	}
+	if query.PageSize > 0 && len(query.Tags) == 0 && query.PageSize < 1000 {
+		// one more than needed to tell whether there is a next page
+		input.MaxKeys = aws.Int64(int64(query.PageSize + 1))
+	}
+
+	// Add each object key as a capability, described by its metadata, the
+	// listing follows the continuation tokens until the page is complete.
+	// Without tag filters the metadata of the object following a complete page
+	// is not needed.
+	var headErr error
+	err = s.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if root && key >= s3Root {
+				root = false
+				if key != s3Root && !add(Capability{Key: s3Root, ValueType: "directory"}) {
+					return false
+				}
+			}
+			if strings.HasPrefix(key, s3MetaPrefix) {
+				continue
+			}
+			if len(query.Tags) == 0 && query.full(len(capabilities)) {
+				next = pageToken(capabilities[len(capabilities)-1].Key)
+				return false
+			}
+			listed, err := s.listedMetadata(ctx, key, s3Listed{etag: aws.StringValue(object.ETag), modified: aws.TimeValue(object.LastModified)})
+			if err != nil {
+				headErr = fmt.Errorf("failed to retrieve metadata of object %s from bucket %s: %w", key, s.bucket, err)
+				return false
+			}
+			if listed.exists && !add(s3Capability(key, listed.metadata)) {
+				return false
+			}
+		}
+		return true
 	})
+	if headErr != nil {
+		return nil, "", headErr
+	}
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	if root && next == "" {
+		add(Capability{Key: s3Root, ValueType: "directory"})
+	}
+	return capabilities, next, nil
+}
 
-	// Add the root directory as a capability
-	capabilities = append(capabilities, Capability{
-		Key:       "/",
-		ValueType: "directory",
-	})
+// s3Listed is the metadata of an object as of its listed ETag and
+// modification time, exists is false if it was deleted after the listing
+type s3Listed struct {
+	etag     string
+	modified time.Time
+	exists   bool
+	metadata map[string]*string
+}
 
-	// Add each object key as a capability
-	for _, object := range result.Contents {
-		capabilities = append(capabilities, Capability{
-			Key:       *object.Key,
-			ValueType: "binary", // Assume all objects in S3 are binary data
-		})
+// listedMetadata returns the metadata of a listed object, it is only requested
+// if the object was written since it was last listed
+func (s *S3Storage) listedMetadata(ctx context.Context, key string, listed s3Listed) (s3Listed, error) {
+	s.listedMu.Lock()
+	memo, ok := s.listed.get(key)
+	s.listedMu.Unlock()
+	if ok && memo.etag == listed.etag && memo.modified.Equal(listed.modified) {
+		return memo, nil
 	}
 
-	return capabilities, nil
+	head, err := s.headObject(ctx, key)
+	if err != nil {
+		return s3Listed{}, err
+	}
+	listed.exists, listed.metadata = head.exists, head.metadata
+	if head.exists {
+		s.listedMu.Lock()
+		s.listed.add(key, listed)
+		s.listedMu.Unlock()
+	}
+	return listed, nil
 }
 
-func (s *S3Storage) Sync(keys []string) (map[string]Data, error) {
+// s3CapabilityMetadata are the object metadata fields describing a key, they
+// are kept when the object is overwritten
+var s3CapabilityMetadata = []string{"Description", "Read-Only", "Default", "Schema", "Owner", "Tags"}
+
+// s3Capability describes key by its object metadata, objects without a
+// Value-Type are binary
+func s3Capability(key string, metadata map[string]*string) Capability {
+	capability := Capability{
+		Key:         key,
+		ValueType:   "binary",
+		Description: aws.StringValue(metadata["Description"]),
+		Schema:      aws.StringValue(metadata["Schema"]),
+		Owner:       aws.StringValue(metadata["Owner"]),
+		Tags:        parseTags(aws.StringValue(metadata["Tags"])),
+	}
+	if v := aws.StringValue(metadata["Value-Type"]); v != "" {
+		capability.ValueType = v
+	}
+	if v, ok := metadata["Default"]; ok && v != nil {
+		capability.Default = []byte(*v)
+	}
+	capability.ReadOnly, _ = strconv.ParseBool(aws.StringValue(metadata["Read-Only"]))
+	return capability
+}
+
+func (s *S3Storage) Sync(ctx context.Context, keys []string) (map[string]Data, int64, error) {
+	revision, err := s.revision(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	exact, selectors := splitSelectors(keys)
+	for _, selector := range selectors {
+		err := s.listSelector(ctx, selector, func(obj *s3.Object) {
+			exact = append(exact, *obj.Key)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 
 	data := make(map[string]Data)
-	for _, key := range keys {
-		obj, err := s.client.GetObject(&s3.GetObjectInput{
+	for _, key := range exact {
+		d, err := s.getObject(ctx, key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		data[key] = d
+	}
+	return data, revision, nil
+}
+
+// listSelector calls fn for every object matching selector
+func (s *S3Storage) listSelector(ctx context.Context, selector string, fn func(obj *s3.Object)) error {
+	return s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(SelectorPrefix(selector)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if !strings.HasPrefix(*obj.Key, s3MetaPrefix) && Match([]string{selector}, *obj.Key) {
+				fn(obj)
+			}
+		}
+		return true
+	})
+}
+
+// revision returns the current store revision
+func (s *S3Storage) revision(ctx context.Context) (int64, error) {
+	revision, _, err := s.readRevision(ctx)
+	return revision, err
+}
+
+// readRevision returns the current store revision and the etag of the counter,
+// which is empty if the counter does not exist yet
+func (s *S3Storage) readRevision(ctx context.Context) (int64, string, error) {
+	obj, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3RevisionKey),
+	})
+	if isNotFound(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to retrieve revision from bucket %s: %v", s.bucket, err)
+	}
+	defer obj.Body.Close()
+
+	value, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read revision from bucket %s: %v", s.bucket, err)
+	}
+	revision, err := strconv.ParseInt(string(value), 10, 64)
+	return revision, aws.StringValue(obj.ETag), err
+}
+
+// s3RevisionAttempts bounds the attempts to increment the revision counter
+// while other instances keep changing it
+const s3RevisionAttempts = 20
+
+// nextRevision increments and returns the store revision. The counter is
+// only replaced if it is unchanged since it was read, an increment losing the
+// race against another instance is retried with the new value.
+func (s *S3Storage) nextRevision(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; attempt < s3RevisionAttempts; attempt++ {
+		revision, etag, err := s.readRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		revision++
+
+		req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
 			Bucket: aws.String(s.bucket),
-			Key:    aws.String(key),
+			Key:    aws.String(s3RevisionKey),
+			Body:   bytes.NewReader([]byte(strconv.FormatInt(revision, 10))),
 		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve object %s from bucket %s: %v", key, s.bucket, err)
+		req.SetContext(ctx)
+		if etag != "" {
+			req.HTTPRequest.Header.Set("If-Match", etag)
+		} else {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+		err = req.Send()
+		if err == nil {
+			return revision, nil
+		}
+		if !isPreconditionFailed(err) {
+			return 0, fmt.Errorf("failed to store revision in bucket %s: %v", s.bucket, err)
+		}
+
+		// back off a little to let the winner finish
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(attempt+1) * int64(5*time.Millisecond)))):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return 0, fmt.Errorf("failed to store revision in bucket %s: too many concurrent writers", s.bucket)
+}
+
+// isPreconditionFailed reports whether err is a failed conditional PUT, S3
+// reports a conflicting concurrent conditional PUT separately
+func isPreconditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+func metadataInt(metadata map[string]*string, name string) int64 {
+	if v, ok := metadata[name]; ok && v != nil {
+		n, _ := strconv.ParseInt(*v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// getObject fetches an object and its revision metadata
+func (s *S3Storage) getObject(ctx context.Context, key string) (Data, error) {
+	return s.getObjectVersion(ctx, key, "")
+}
+
+// getObjectVersion fetches a version of an object, the current one if
+// versionID is empty
+func (s *S3Storage) getObjectVersion(ctx context.Context, key, versionID string) (Data, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	obj, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if isNotFound(err) {
+			return Data{}, err
 		}
+		return Data{}, fmt.Errorf("failed to retrieve object %s from bucket %s: %w", key, s.bucket, err)
+	}
+	defer obj.Body.Close()
+
+	value, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return Data{}, fmt.Errorf("failed to read contents of object %s from bucket %s: %v", key, s.bucket, err)
+	}
+
+	data := Data{
+		Key:       key,
+		Value:     value,
+		ValueType: "binary", // Assume all objects in S3 are binary data
+		UpdatedAt: aws.TimeValue(obj.LastModified),
+		Revision:  metadataInt(obj.Metadata, "Revision"),
+		Version:   metadataInt(obj.Metadata, "Version"),
+	}
+	if v, ok := obj.Metadata["Value-Type"]; ok && v != nil && *v != "" {
+		data.ValueType = *v
+	}
+	return data, nil
+}
+
+// s3Version is a version of an object or a delete marker
+type s3Version struct {
+	id       string
+	modified time.Time
+	deleted  bool
+}
 
-		value, err := ioutil.ReadAll(obj.Body)
+// listVersions returns the versions of the objects under prefix by key, the
+// most recent first. Without versioning enabled on the bucket only the
+// current objects are listed.
+func (s *S3Storage) listVersions(ctx context.Context, prefix string) (map[string][]s3Version, error) {
+	versions := make(map[string][]s3Version)
+	err := s.client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			key := aws.StringValue(v.Key)
+			versions[key] = append(versions[key], s3Version{id: aws.StringValue(v.VersionId), modified: aws.TimeValue(v.LastModified)})
+		}
+		for _, m := range page.DeleteMarkers {
+			key := aws.StringValue(m.Key)
+			versions[key] = append(versions[key], s3Version{id: aws.StringValue(m.VersionId), modified: aws.TimeValue(m.LastModified), deleted: true})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list object versions in bucket %s: %w", s.bucket, err)
+	}
+	for _, v := range versions {
+		sort.SliceStable(v, func(i, j int) bool {
+			return v[i].modified.After(v[j].modified)
+		})
+	}
+	return versions, nil
+}
+
+// versionAt returns the most recent of versions modified at or before asOf
+func versionAt(versions []s3Version, asOf time.Time) (s3Version, bool) {
+	for _, v := range versions {
+		if !v.modified.After(asOf) {
+			return v, true
+		}
+	}
+	return s3Version{}, false
+}
+
+// revisionAt returns the store revision as of asOf from the versions of the
+// revision counter
+func (s *S3Storage) revisionAt(ctx context.Context, revisions []s3Version, asOf time.Time) (int64, error) {
+	v, ok := versionAt(revisions, asOf)
+	if !ok || v.deleted {
+		return 0, nil
+	}
+	return s.revisionVersion(ctx, v.id)
+}
+
+// revisionVersion reads a version of the revision counter
+func (s *S3Storage) revisionVersion(ctx context.Context, versionID string) (int64, error) {
+	obj, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(s3RevisionKey),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve revision from bucket %s: %v", s.bucket, err)
+	}
+	defer obj.Body.Close()
+
+	value, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read revision from bucket %s: %v", s.bucket, err)
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+// SyncAt reads the version of every key that was current at asOf. It
+// requires versioning to be enabled on the bucket.
+func (s *S3Storage) SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, int64, error) {
+	revisions, err := s.listVersions(ctx, s3RevisionKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, err := s.revisionAt(ctx, revisions[s3RevisionKey], asOf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := s.versionsAt(ctx, keys, asOf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, revision, nil
+}
+
+// SyncRevision reads the versions of the keys written before the revision
+// counter was incremented past revision, writers increment it before writing
+// the objects. It requires versioning to be enabled on the bucket.
+func (s *S3Storage) SyncRevision(ctx context.Context, keys []string, revision int64) (map[string]Data, error) {
+	revisions, err := s.listVersions(ctx, s3RevisionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the oldest increment after revision
+	var next *s3Version
+	for i, v := range revisions[s3RevisionKey] {
+		if v.deleted {
+			break
+		}
+		n, err := s.revisionVersion(ctx, v.id)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read contents of object %s from bucket %s: %v", key, s.bucket, err)
+			return nil, err
+		}
+		if n <= revision {
+			break
 		}
+		next = &revisions[s3RevisionKey][i]
+	}
+	if next == nil {
+		data, _, err := s.Sync(ctx, keys)
+		return data, err
+	}
+	return s.versionsAt(ctx, keys, next.modified.Add(-time.Nanosecond))
+}
 
-		data[key] = Data{
-			Key:       key,
-			Value:     value,
-			ValueType: "binary", // Assume all objects in S3 are binary data
-			UpdatedAt: time.Now(),
+// versionsAt reads the version of every key that was current at asOf
+func (s *S3Storage) versionsAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, error) {
+	// exact keys are listed by prefix as well, which may include other keys
+	data := make(map[string]Data)
+	listed := make(map[string]bool)
+	for _, prefix := range keys {
+		if IsSelector(prefix) {
+			prefix = SelectorPrefix(prefix)
+		}
+		if listed[prefix] {
+			continue
+		}
+		listed[prefix] = true
+		versions, err := s.listVersions(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for key, v := range versions {
+			if _, ok := data[key]; ok || strings.HasPrefix(key, s3MetaPrefix) || !Match(keys, key) {
+				continue
+			}
+			version, ok := versionAt(v, asOf)
+			if !ok || version.deleted {
+				continue
+			}
+			d, err := s.getObjectVersion(ctx, key, version.id)
+			if err != nil {
+				return nil, err
+			}
+			data[key] = d
 		}
 	}
 	return data, nil
 }
 
-func (s *S3Storage) Subscribe(keys []string) (<-chan Data, error) {
-	updates := make(chan Data)
-	lastETag := make(map[string]string)
+// History lists the versions of the object of key. It requires versioning to
+// be enabled on the bucket. Delete markers carry no metadata, the revision of
+// their tombstones is the store revision at the time of the deletion.
+func (s *S3Storage) History(ctx context.Context, key string, limit int) ([]Data, error) {
+	versions, err := s.listVersions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions map[string][]s3Version
+	var history []Data
+	for _, v := range versions[key] {
+		if limit > 0 && len(history) == limit {
+			break
+		}
+		if !v.deleted {
+			d, err := s.getObjectVersion(ctx, key, v.id)
+			if err != nil {
+				return nil, err
+			}
+			history = append(history, d)
+			continue
+		}
+
+		if revisions == nil {
+			if revisions, err = s.listVersions(ctx, s3RevisionKey); err != nil {
+				return nil, err
+			}
+		}
+		revision, err := s.revisionAt(ctx, revisions[s3RevisionKey], v.modified)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, Data{Key: key, UpdatedAt: v.modified, Deleted: true, Revision: revision})
+	}
+	return history, nil
+}
+
+// Subscribe polls the objects of keys for changes. S3 keeps no change log, a
+// subscription resumed from a revision receives the current state of every
+// object changed since, but no tombstones for objects deleted in between.
+func (s *S3Storage) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []Data, error) {
+	updates := make(chan []Data)
+	watch := &s3Watch{
+		keys:      keys,
+		etags:     make(map[string]string),
+		revisions: make(map[string]int64),
+		manifests: make(map[string]*s3Manifest),
+	}
 
 	go func() {
-	outer:
+		defer close(updates)
+
+		// objects older than fromRevision are only recorded on the first poll,
+		// without fromRevision the first poll is the initial state
+		minRevision := fromRevision
+		initial := fromRevision == 0
 		for {
-			for _, key := range keys {
-				if strings.HasSuffix(key, "/") {
-					// The key is a directory, fetch the files periodically
-
-					// List the objects in the directory
-					resp, err := s.client.ListObjectsV2(&s3.ListObjectsV2Input{
-						Bucket:  aws.String(s.bucket),
-						Prefix:  aws.String(key),
-						MaxKeys: aws.Int64(1000), // fixme
-					})
-					if err != nil {
-						s.forwardError(err)
-						break outer
-					}
-
-					// Loop through the objects and check if they have been updated
-					for _, obj := range resp.Contents {
-						// Check if the object has been updated by comparing its ETAG
-						if lastETag[*obj.Key] == *obj.ETag {
-							continue
-						}
-
-						err := s.fetchObjectAndSendUpdate(updates, *obj.Key)
-						if err != nil {
-							s.forwardError(err)
-							continue
-						}
-
-						lastETag[*obj.Key] = *obj.ETag
-					}
-				} else {
-					head, err := s.client.HeadObject(&s3.HeadObjectInput{
-						Bucket: aws.String(s.bucket),
-						Key:    aws.String(key),
-					})
-					if err != nil || head.ETag == nil {
-						s.forwardError(err)
-						break outer
-					}
-
-					if lastETag[key] != *head.ETag {
-						s.fetchObjectAndSendUpdate(updates, key)
-						lastETag[key] = *head.ETag
-					}
+			start := time.Now()
+			changes, err := s.poll(ctx, watch, minRevision)
+			if ctx.Err() != nil {
+				return
+			}
+			s.metrics.ObservePoll("s3", start, err)
+			if err != nil {
+				s.forwardError(err)
+				return
+			}
+			minRevision = 0
+
+			if len(changes) > 0 || initial {
+				if changes == nil {
+					changes = []Data{}
+				}
+				select {
+				case updates <- changes:
+				case <-ctx.Done():
+					return
 				}
+			}
+			initial = false
 
-				<-time.After(s.syncInterval)
+			select {
+			case <-time.After(s.syncInterval):
+			case <-ctx.Done():
+				return
 			}
 		}
-		close(updates)
 	}()
 
 	return updates, nil
 }
 
-func (s *S3Storage) fetchObjectAndSendUpdate(updates chan Data, key string) error {
-	// Fetch the object from S3
-	getResp, err := s.client.GetObject(&s3.GetObjectInput{
+// s3Watch is the state of a subscription between polls
+type s3Watch struct {
+	keys []string
+	// etags and revisions of the objects last delivered
+	etags     map[string]string
+	revisions map[string]int64
+	// manifests of recent batches by object key
+	manifests map[string]*s3Manifest
+}
+
+// poll compares the objects of the watched keys with the last delivered state
+// and returns the changed objects and tombstones for removed objects in
+// revision order. Selectors are resolved by listing the objects under their
+// prefix. Changes belonging to a batch which is not fully
+// visible yet are held back until a later poll.
+func (s *S3Storage) poll(ctx context.Context, watch *s3Watch, minRevision int64) ([]Data, error) {
+	keys := watch.keys
+	etags := make(map[string]string)
+	for _, key := range keys {
+		if IsSelector(key) {
+			// The key is a prefix or pattern, list the matching objects
+			err := s.listSelector(ctx, key, func(obj *s3.Object) {
+				etags[*obj.Key] = *obj.ETag
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if head.ETag == nil {
+			return nil, fmt.Errorf("object %s in bucket %s has no ETag", key, s.bucket)
+		}
+		etags[key] = *head.ETag
+	}
+
+	// the manifests are listed after the objects, a batch write observed
+	// above always has its manifest listed
+	manifests, err := s.recentBatches(ctx, watch.manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]Data)
+	for key, etag := range etags {
+		// Check if the object has been updated by comparing its ETAG
+		if watch.etags[key] == etag {
+			continue
+		}
+
+		data, err := s.getObject(ctx, key)
+		if isNotFound(err) {
+			// removed in the meantime, picked up by the next poll
+			delete(etags, key)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			s.forwardError(err)
+			continue
+		}
+		changed[key] = data
+	}
+
+	// revision returns the revision of a present key as of this poll
+	revision := func(key string) (int64, bool) {
+		if _, ok := etags[key]; !ok {
+			return 0, false
+		}
+		if data, ok := changed[key]; ok {
+			return data.Revision, true
+		}
+		return watch.revisions[key], true
+	}
+
+	// changes to keys of incomplete batches at or after the batch revision
+	held := make(map[string]int64)
+	for _, manifest := range manifests {
+		complete := true
+		for _, entry := range manifest.Entries {
+			if !Match(keys, entry.Key) {
+				continue
+			}
+			rev, exists := revision(entry.Key)
+			if entry.Deleted && exists && rev <= manifest.Revision ||
+				!entry.Deleted && (!exists || rev < manifest.Revision) {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			continue
+		}
+		for _, entry := range manifest.Entries {
+			if r, ok := held[entry.Key]; !ok || manifest.Revision < r {
+				held[entry.Key] = manifest.Revision
+			}
+		}
+	}
+
+	var changes []Data
+	for key, data := range changed {
+		if r, ok := held[key]; ok && data.Revision >= r {
+			continue
+		}
+		watch.etags[key] = etags[key]
+		watch.revisions[key] = data.Revision
+		if data.Revision >= minRevision {
+			changes = append(changes, data)
+		}
+	}
+
+	// Objects no longer present have been removed
+	var current int64
+	for key := range watch.etags {
+		if _, ok := etags[key]; ok || !Match(keys, key) {
+			continue
+		}
+		if _, ok := held[key]; ok {
+			continue
+		}
+		if current == 0 {
+			var err error
+			if current, err = s.revision(ctx); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, Data{Key: key, UpdatedAt: time.Now(), Deleted: true, Revision: current})
+		delete(watch.etags, key)
+		delete(watch.revisions, key)
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Revision < changes[j].Revision
+	})
+	return changes, nil
+}
+
+// s3Object is the state of an object before it is written
+type s3Object struct {
+	exists   bool
+	etag     string
+	revision int64
+	version  int64
+	metadata map[string]*string
+}
+
+func (s *S3Storage) headObject(ctx context.Context, key string) (s3Object, error) {
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
+	if isNotFound(err) {
+		return s3Object{}, nil
+	}
 	if err != nil {
+		return s3Object{}, err
+	}
+	return s3Object{
+		exists:   true,
+		etag:     aws.StringValue(head.ETag),
+		revision: metadataInt(head.Metadata, "Revision"),
+		version:  metadataInt(head.Metadata, "Version"),
+		metadata: head.Metadata,
+	}, nil
+}
+
+// checkS3Key rejects the keys of bookkeeping objects
+func checkS3Key(key string) error {
+	if strings.HasPrefix(key, s3MetaPrefix) {
+		return fmt.Errorf("%w: %s", ErrReservedKey, key)
+	}
+	return nil
+}
+
+func (s *S3Storage) PushUpdate(ctx context.Context, data *Data) error {
+	if err := checkS3Key(data.Key); err != nil {
+		return err
+	}
+	current, err := s.headObject(ctx, data.Key)
+	if err != nil {
+		return err
+	}
+	if err := checkRevision(data, Data{Revision: current.revision}, current.exists); err != nil {
 		return err
 	}
 
-	// The object has been updated, send an update
-	data, err := ioutil.ReadAll(getResp.Body)
+	revision, err := s.nextRevision(ctx)
 	if err != nil {
 		return err
 	}
 
-	updates <- Data{
-		Key:       key,
-		Value:     data,
-		ValueType: "binary",
-		UpdatedAt: time.Now(),
+	return s.putObject(ctx, data, current, revision)
+}
+
+// putObject uploads data at the given revision, conditional writes are
+// guarded against changes since current was read using If-Match. The
+// capability metadata of the current object is carried over.
+func (s *S3Storage) putObject(ctx context.Context, data *Data, current s3Object, revision int64) error {
+	metadata := map[string]*string{
+		"Revision":   aws.String(strconv.FormatInt(revision, 10)),
+		"Version":    aws.String(strconv.FormatInt(current.version+1, 10)),
+		"Value-Type": aws.String(data.ValueType),
+	}
+	for _, name := range s3CapabilityMetadata {
+		if v, ok := current.metadata[name]; ok {
+			metadata[name] = v
+		}
+	}
+
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(data.Key),
+		Body:     bytes.NewReader(data.Value),
+		Metadata: metadata,
+	})
+	req.SetContext(ctx)
+
+	if data.ExpectedRevision != nil {
+		if current.exists {
+			req.HTTPRequest.Header.Set("If-Match", current.etag)
+		} else {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+	}
+
+	if err := req.Send(); err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("%w: key %s was modified concurrently", ErrRevisionMismatch, data.Key)
+		}
+		return err
 	}
 
 	return nil
 }
 
-func (s *S3Storage) PushUpdate(data *Data) error {
-	_, err := s.client.PutObject(&s3.PutObjectInput{
+// s3Manifest lists the keys written by a batch, it is stored before the
+// objects and kept until S3BatchTimeout so that pollers can tell whether all
+// objects of the batch are visible
+type s3Manifest struct {
+	Revision int64             `json:"revision"`
+	Entries  []s3ManifestEntry `json:"entries"`
+}
+
+type s3ManifestEntry struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// PushBatch writes all updates at the same revision. S3 has no transactions,
+// the preconditions of all updates are checked before any object is written
+// and a manifest lets subscribers deliver the batch once it is complete. If a
+// write fails the batch remains partially applied.
+func (s *S3Storage) PushBatch(ctx context.Context, batch []Data) error {
+	current := make([]s3Object, len(batch))
+	manifest := s3Manifest{}
+	for i := range batch {
+		if err := checkS3Key(batch[i].Key); err != nil {
+			return err
+		}
+		var err error
+		if current[i], err = s.headObject(ctx, batch[i].Key); err != nil {
+			return err
+		}
+		if err := checkRevision(&batch[i], Data{Revision: current[i].revision}, current[i].exists); err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, s3ManifestEntry{Key: batch[i].Key, Deleted: batch[i].Deleted})
+	}
+
+	revision, err := s.nextRevision(ctx)
+	if err != nil {
+		return err
+	}
+	manifest.Revision = revision
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestKey := s3BatchPrefix + strconv.FormatInt(revision, 10)
+	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(data.Key),
-		Body:   bytes.NewReader(data.Value),
+		Key:    aws.String(manifestKey),
+		Body:   bytes.NewReader(body),
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to store batch manifest in bucket %s: %v", s.bucket, err)
+	}
+
+	for i := range batch {
+		if batch[i].Deleted {
+			if !current[i].exists {
+				continue
+			}
+			_, err = s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(batch[i].Key),
+			})
+		} else {
+			err = s.putObject(ctx, &batch[i], current[i], revision)
+		}
+		if err != nil {
+			// without the manifest subscribers deliver the written objects
+			s.client.DeleteObjectWithContext(context.Background(), &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(manifestKey),
+			})
+			return fmt.Errorf("batch partially applied: %w", err)
+		}
 	}
 
+	return s.expireBatches(ctx)
+}
+
+// listBatches lists the manifest objects of all batches
+func (s *S3Storage) listBatches(ctx context.Context) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s3BatchPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	return objects, err
+}
+
+// expireBatches removes manifests older than S3BatchTimeout
+func (s *S3Storage) expireBatches(ctx context.Context) error {
+	objects, err := s.listBatches(ctx)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if time.Since(aws.TimeValue(obj.LastModified)) < S3BatchTimeout {
+			continue
+		}
+		_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    obj.Key,
+		})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
 	return nil
 }
+
+// recentBatches returns the manifests younger than S3BatchTimeout, manifests
+// are immutable and cached by object key
+func (s *S3Storage) recentBatches(ctx context.Context, cache map[string]*s3Manifest) ([]*s3Manifest, error) {
+	objects, err := s.listBatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*s3Manifest
+	recent := make(map[string]bool)
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if time.Since(aws.TimeValue(obj.LastModified)) >= S3BatchTimeout {
+			continue
+		}
+		recent[key] = true
+
+		manifest, ok := cache[key]
+		if !ok {
+			resp, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    obj.Key,
+			})
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			manifest = &s3Manifest{}
+			err = json.NewDecoder(resp.Body).Decode(manifest)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("invalid batch manifest %s in bucket %s: %v", key, s.bucket, err)
+			}
+			cache[key] = manifest
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	for key := range cache {
+		if !recent[key] {
+			delete(cache, key)
+		}
+	}
+	return manifests, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if err := checkS3Key(key); err != nil {
+		return err
+	}
+	current, err := s.headObject(ctx, key)
+	if err != nil || !current.exists {
+		return err
+	}
+
+	if _, err := s.nextRevision(ctx); err != nil {
+		return err
+	}
+
+	_, err = s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
@@ -1,5 +1,237 @@
 package storage_test
 
-import "github.com/bartke/datastream/storage"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/internal/s3fake"
+	"github.com/bartke/datastream/storage/storagetest"
+)
 
 var _ storage.Storage = &storage.S3Storage{}
+
+var s3TestConfig = storage.S3StorageConfig{
+	Region:       "us-east-1",
+	AccessKey:    "access",
+	SecretKey:    "secret",
+	Bucket:       "test",
+	SyncInterval: 10 * time.Millisecond,
+}
+
+func TestS3Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		server := s3fake.New("test")
+		t.Cleanup(server.Close)
+
+		config := s3TestConfig
+		config.Endpoint = server.URL
+		store, err := storage.NewS3Storage(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestS3CapabilityMetadata(t *testing.T) {
+	server := s3fake.New("test")
+	defer server.Close()
+	config := s3TestConfig
+	config.Endpoint = server.URL
+	store, err := storage.NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata is maintained out of band, e.g. with the aws cli
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String(config.Region),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String("limits/payments"),
+		Body:   bytes.NewReader([]byte("5")),
+		Metadata: map[string]*string{
+			"description": aws.String("payment limit"),
+			"read-only":   aws.String("true"),
+			"default":     aws.String("10"),
+			"owner":       aws.String("payments"),
+			"tags":        aws.String("limits,payments"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// updates keep the metadata of the object
+	ctx := context.Background()
+	if err := store.PushUpdate(ctx, &storage.Data{Key: "limits/payments", Value: []byte("6"), ValueType: "int"}); err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities, _, err := store.ListCapabilities(ctx, storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Capability{
+		{Key: "/", ValueType: "directory"},
+		{Key: "limits/payments", ValueType: "int", Description: "payment limit", ReadOnly: true, Default: []byte("10"), Owner: "payments", Tags: []string{"limits", "payments"}},
+	}
+	if !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("ListCapabilities = %+v, want %+v", capabilities, want)
+	}
+}
+
+func TestS3ListCapabilitiesPages(t *testing.T) {
+	server := s3fake.New("test")
+	defer server.Close()
+	config := s3TestConfig
+	config.Endpoint = server.URL
+	store, err := storage.NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"-draft", "a", "b", "c"} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: key, Value: []byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the root directory is listed in key order, pages continue after it
+	want := []string{"-draft", "/", "a", "b", "c"}
+	for _, pageSize := range []int{0, 1, 2} {
+		var keys []string
+		query := storage.CapabilityQuery{PageSize: pageSize}
+		for {
+			capabilities, next, err := store.ListCapabilities(ctx, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, capability := range capabilities {
+				keys = append(keys, capability.Key)
+			}
+			if next == "" {
+				break
+			}
+			query.PageToken = next
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("pages of %d list %v, want %v", pageSize, keys, want)
+		}
+	}
+
+	// metadata is requested once per written object, and not for the object
+	// following a page
+	heads := server.Requests("HEAD")
+	if _, _, err := store.ListCapabilities(ctx, storage.CapabilityQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests("HEAD") - heads; n != 0 {
+		t.Errorf("listing unchanged objects made %d HEAD requests, want 0", n)
+	}
+	if err := store.PushUpdate(ctx, &storage.Data{Key: "a", Value: []byte("2"), ValueType: "int"}); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := storage.NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[*storage.S3Storage]int{store: 1, fresh: 2} {
+		heads = server.Requests("HEAD")
+		capabilities, _, err := s.ListCapabilities(ctx, storage.CapabilityQuery{PageSize: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(capabilities) != 3 || capabilities[2].ValueType != "int" {
+			t.Errorf("ListCapabilities = %+v, want a as int", capabilities)
+		}
+		if n := server.Requests("HEAD") - heads; n != want {
+			t.Errorf("listing a page of 3 made %d HEAD requests, want %d", n, want)
+		}
+	}
+}
+
+func TestS3ConcurrentRevisions(t *testing.T) {
+	server := s3fake.New("test")
+	defer server.Close()
+	config := s3TestConfig
+	config.Endpoint = server.URL
+
+	// writers of two instances sharing the bucket race for revisions, the
+	// instances are created up front as sessions are not created concurrently
+	const instances, writers, writes = 2, 4, 10
+	stores := make([]*storage.S3Storage, instances)
+	for i := range stores {
+		var err error
+		if stores[i], err = storage.NewS3Storage(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(store *storage.S3Storage, key string) {
+				defer wg.Done()
+				for n := 0; n < writes; n++ {
+					if err := store.PushUpdate(context.Background(), &storage.Data{Key: key, Value: []byte(strconv.Itoa(n))}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(store, fmt.Sprintf("instance%d/writer%d", i, w))
+		}
+	}
+	wg.Wait()
+
+	_, revision, err := stores[0].Sync(context.Background(), []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != instances*writers*writes {
+		t.Errorf("revision = %d after %d writes", revision, instances*writers*writes)
+	}
+}
+
+func TestS3ReservedKeys(t *testing.T) {
+	server := s3fake.New("test")
+	defer server.Close()
+	config := s3TestConfig
+	config.Endpoint = server.URL
+	store, err := storage.NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, key := range []string{".datastream/revision", ".datastream/batches/1"} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: key, Value: []byte("1")}); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("PushUpdate(%q) = %v, want ErrReservedKey", key, err)
+		}
+		if err := store.PushBatch(ctx, []storage.Data{{Key: key, Value: []byte("1")}}); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("PushBatch(%q) = %v, want ErrReservedKey", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, storage.ErrReservedKey) {
+			t.Errorf("Delete(%q) = %v, want ErrReservedKey", key, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Keys passed to Sync and Subscribe are either exact keys or selectors. A key
+// ending in a slash selects all keys with that prefix, a key containing glob
+// characters selects the keys matching the pattern as in path.Match, e.g.
+// "services/payments/*" selects the keys directly inside services/payments.
+
+// AllKeys selects every key, "*" the keys outside of directories and "*/"
+// the keys inside them
+var AllKeys = []string{"*", "*/"}
+
+// IsSelector reports whether key is a prefix or glob selector
+func IsSelector(key string) bool {
+	return strings.HasSuffix(key, "/") || strings.ContainsAny(key, `*?[\`)
+}
+
+// SelectorPrefix returns the literal prefix all keys matching selector share
+func SelectorPrefix(selector string) string {
+	if i := strings.IndexAny(selector, `*?[\`); i >= 0 {
+		return selector[:i]
+	}
+	return selector
+}
+
+// Match reports whether key is one of keys or selected by one of them
+func Match(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+		if !IsSelector(k) {
+			continue
+		}
+		if matchSelector(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSelector(selector, key string) bool {
+	if !strings.HasSuffix(selector, "/") {
+		ok, _ := path.Match(selector, key)
+		return ok
+	}
+	if SelectorPrefix(selector) == selector {
+		return strings.HasPrefix(key, selector)
+	}
+
+	// a pattern ending in a slash selects everything below matching directories
+	dir := strings.TrimSuffix(selector, "/")
+	for i := range key {
+		if key[i] != '/' {
+			continue
+		}
+		if ok, _ := path.Match(dir, key[:i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSelectors separates exact keys from selectors
+func splitSelectors(keys []string) (exact, selectors []string) {
+	for _, key := range keys {
+		if IsSelector(key) {
+			selectors = append(selectors, key)
+		} else {
+			exact = append(exact, key)
+		}
+	}
+	return exact, selectors
+}
+
+// sortedByKey returns the entries of data ordered by key
+func sortedByKey(data map[string]Data) []Data {
+	result := make([]Data, 0, len(data))
+	for _, d := range data {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
@@ -0,0 +1,32 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/bartke/datastream/storage"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		selector string
+		key      string
+		want     bool
+	}{
+		{"alpha", "alpha", true},
+		{"alpha", "alphabet", false},
+		{"services/", "services/payments/a", true},
+		{"services/", "servicesx", false},
+		{"services/payments/*", "services/payments/a", true},
+		{"services/payments/*", "services/payments/x/a", false},
+		{"services/*/a", "services/users/a", true},
+		{"services/*/", "services/users/x/a", true},
+		{"services/*/", "services/a", false},
+		{"rate_?", "rate_1", true},
+		{"[ab]*", "beta", true},
+	}
+	for _, tt := range tests {
+		if got := storage.Match([]string{tt.selector}, tt.key); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.selector, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package service_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/audit"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAuditEvents(t *testing.T) {
+	sink, err := audit.OpenJSONLFile(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "rate_limit", Value: []byte("10"), ValueType: "int"}},
+	})
+	client := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Audit: sink}))
+	ctx := context.Background()
+
+	start := time.Now()
+	if _, err := client.PushUpdate(ctx, &datastream.Data{Key: "rate_limit", Value: []byte("20")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PushBatch(ctx, &datastream.PushBatchRequest{Data: []*datastream.Data{
+		{Key: "services/payments/limit", Value: []byte("5"), ValueType: "int"},
+		{Key: "services/orders/limit", Value: []byte("1"), ValueType: "int"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, &datastream.DeleteRequest{Key: "rate_limit"}); err != nil {
+		t.Fatal(err)
+	}
+	// deleting a missing key changes nothing and is not audited
+	for _, key := range []string{"rate_limit", "missing"} {
+		if _, err := client.Delete(ctx, &datastream.DeleteRequest{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a rejected update is not audited
+	if _, err := client.PushUpdate(ctx, &datastream.Data{Key: "rate_limit", Value: []byte("x"), ValueType: "int"}); err == nil {
+		t.Fatal("invalid update accepted")
+	}
+
+	resp, err := client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "rate_limit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 2 {
+		t.Fatalf("got %d events of rate_limit, want 2: %v", len(resp.Events), resp.Events)
+	}
+	deleted, updated := resp.Events[0], resp.Events[1]
+	if deleted.Action != audit.ActionDelete || deleted.PreviousHash != audit.Hash([]byte("20")) || deleted.NewHash != "" {
+		t.Errorf("delete event = %v", deleted)
+	}
+	if updated.Action != audit.ActionUpdate || updated.PreviousHash != audit.Hash([]byte("10")) || updated.NewHash != audit.Hash([]byte("20")) {
+		t.Errorf("update event = %v", updated)
+	}
+	if updated.Principal != "anonymous" || updated.Peer == "" || updated.Time.AsTime().Before(start.Add(-time.Second)) {
+		t.Errorf("update event = %v, want anonymous caller, peer and time", updated)
+	}
+
+	resp, err = client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "missing"})
+	if err != nil || len(resp.Events) != 0 {
+		t.Errorf("events of a missing key = %v, %v, want none", resp, err)
+	}
+	resp, err = client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "services/", Limit: 1})
+	if err != nil || len(resp.Events) != 1 || resp.Events[0].PreviousHash != "" {
+		t.Errorf("services/ events = %v, %v, want one creation", resp, err)
+	}
+	resp, err = client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Until: timestamppb.New(start.Add(-time.Second))})
+	if err != nil || len(resp.Events) != 0 {
+		t.Errorf("events before the first change = %v, %v", resp, err)
+	}
+}
+
+func TestAuditEventsPolicy(t *testing.T) {
+	sink, err := audit.OpenJSONLFile(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	policy, err := service.NewPolicy(service.PolicyConfig{Rules: []service.PolicyRule{
+		{Principals: []string{"*"}, Actions: []service.Action{service.ActionPush}, Keys: []string{"services/"}},
+		{Principals: []string{"*"}, Actions: []service.Action{service.ActionAudit}, Keys: []string{"services/public/"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	client := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Audit: sink, Policy: policy}))
+	ctx := context.Background()
+
+	for _, key := range []string{"services/public/a", "services/private/b", "services/public/c"} {
+		if _, err := client.PushUpdate(ctx, &datastream.Data{Key: key, Value: []byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "services/", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 2 || resp.Events[0].Key != "services/public/c" || resp.Events[1].Key != "services/public/a" {
+		t.Errorf("events = %v, want the public keys", resp.Events)
+	}
+	if _, err := client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "services/private/b"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("events of a private key: %v, want PERMISSION_DENIED", err)
+	}
+
+	unaudited := startServer(t, service.NewDataServiceServer(store))
+	if _, err := unaudited.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("events without an audit log: %v, want FAILED_PRECONDITION", err)
+	}
+}
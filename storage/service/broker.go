@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bartke/datastream/storage"
+)
+
+// DefaultSubscriberBuffer is the default number of update groups buffered per
+// subscriber
+const DefaultSubscriberBuffer = 64
+
+var (
+	// ErrSlowConsumer ends subscriptions which fall behind by more than their
+	// buffer, the subscriber can resume from the last revision it received
+	ErrSlowConsumer = errors.New("subscriber too slow, updates dropped")
+	// ErrWatchClosed ends subscriptions whose backend subscription failed
+	ErrWatchClosed = errors.New("backend subscription closed")
+)
+
+type BrokerConfig struct {
+	// optional number of update groups buffered per subscriber, default is 64
+	Buffer int
+}
+
+// Broker shares one backend subscription between all subscribers of the same
+// set of keys and fans the updates out to them. Subscribers that do not keep
+// up are disconnected instead of stalling the others.
+type Broker struct {
+	store  storage.Storage
+	buffer int
+
+	mu      sync.Mutex
+	watches map[string]*watch
+}
+
+// watch is a backend subscription shared by subscribers of the same keys
+type watch struct {
+	id     string
+	cancel context.CancelFunc
+
+	// state is the current value of the keys once the initial state has
+	// been received, it is the snapshot sent to late subscribers
+	ready       bool
+	state       map[string]storage.Data
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription is a subscriber of a Broker
+type Subscription struct {
+	updates <-chan []storage.Data
+	err     error
+
+	// set for shared subscriptions, guarded by the broker lock
+	broker *Broker
+	out    chan []storage.Data
+	watch  *watch
+	closed bool
+	done   chan struct{}
+
+	// set for dedicated subscriptions
+	cancel context.CancelFunc
+}
+
+// NewBroker creates a broker for subscriptions to store
+func NewBroker(store storage.Storage, config BrokerConfig) *Broker {
+	if config.Buffer <= 0 {
+		config.Buffer = DefaultSubscriberBuffer
+	}
+	return &Broker{
+		store:   store,
+		buffer:  config.Buffer,
+		watches: make(map[string]*watch),
+	}
+}
+
+// Subscribe subscribes to keys, the subscription is closed once ctx is done.
+// Subscriptions resuming from a revision replay history and use a dedicated
+// backend subscription.
+func (b *Broker) Subscribe(ctx context.Context, keys []string, fromRevision int64) (*Subscription, error) {
+	if fromRevision > 0 {
+		return b.subscribeFrom(ctx, keys, fromRevision)
+	}
+
+	keys = normalizeKeys(keys)
+	id := strings.Join(keys, "\x00")
+
+	// the backend subscription is opened without holding the lock as it may
+	// take a round trip to the backend, a watch of the same keys registered
+	// in the meantime by a concurrent subscriber is shared instead
+	var opened *watch
+	var updates <-chan []storage.Data
+	for {
+		b.mu.Lock()
+		w, ok := b.watches[id]
+		if ok && opened != nil {
+			opened.cancel()
+		}
+		if !ok && opened != nil {
+			w, ok = opened, true
+			b.watches[id] = w
+			go b.run(w, updates)
+		}
+		if ok {
+			sub := b.join(ctx, w)
+			b.mu.Unlock()
+			return sub, nil
+		}
+		b.mu.Unlock()
+
+		watchCtx, cancel := context.WithCancel(context.Background())
+		var err error
+		updates, err = b.store.Subscribe(watchCtx, keys, 0)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		opened = &watch{
+			id:          id,
+			cancel:      cancel,
+			state:       make(map[string]storage.Data),
+			subscribers: make(map[*Subscription]struct{}),
+		}
+	}
+}
+
+// join adds a subscriber to a watch until ctx is done, the caller must hold
+// the broker lock
+func (b *Broker) join(ctx context.Context, w *watch) *Subscription {
+	out := make(chan []storage.Data, b.buffer)
+	sub := &Subscription{updates: out, broker: b, out: out, watch: w, done: make(chan struct{})}
+	// subscribers joining before the initial state arrived receive it with
+	// the first broadcast
+	if w.ready {
+		out <- w.snapshot()
+	}
+	w.subscribers[sub] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.close(sub, nil)
+		case <-sub.done:
+		}
+	}()
+	return sub
+}
+
+// subscribeFrom opens a dedicated backend subscription resuming from
+// fromRevision, it ends with ErrWatchClosed if the backend subscription ends
+// before ctx is done
+func (b *Broker) subscribeFrom(ctx context.Context, keys []string, fromRevision int64) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	updates, err := b.store.Subscribe(ctx, keys, fromRevision)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan []storage.Data)
+	sub := &Subscription{updates: out, cancel: cancel}
+	go func() {
+		defer close(out)
+		for group := range updates {
+			select {
+			case out <- group:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() == nil {
+			sub.err = ErrWatchClosed
+		}
+	}()
+	return sub, nil
+}
+
+// normalizeKeys returns the sorted unique keys
+func normalizeKeys(keys []string) []string {
+	unique := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// run fans the updates of a backend subscription out to the subscribers
+func (b *Broker) run(w *watch, updates <-chan []storage.Data) {
+	for group := range updates {
+		b.mu.Lock()
+		w.ready = true
+		for _, data := range group {
+			if data.Deleted {
+				delete(w.state, data.Key)
+			} else {
+				w.state[data.Key] = data
+			}
+		}
+		for sub := range w.subscribers {
+			select {
+			case sub.out <- group:
+			default:
+				b.drop(sub, ErrSlowConsumer)
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	// the backend subscription ended without all subscribers leaving
+	b.mu.Lock()
+	for sub := range w.subscribers {
+		b.drop(sub, ErrWatchClosed)
+	}
+	if b.watches[w.id] == w {
+		delete(b.watches, w.id)
+	}
+	b.mu.Unlock()
+}
+
+// snapshot returns the current state of a watch in revision order
+func (w *watch) snapshot() []storage.Data {
+	group := make([]storage.Data, 0, len(w.state))
+	for _, data := range w.state {
+		group = append(group, data)
+	}
+	sort.Slice(group, func(i, j int) bool {
+		if group[i].Revision != group[j].Revision {
+			return group[i].Revision < group[j].Revision
+		}
+		return group[i].Key < group[j].Key
+	})
+	return group
+}
+
+func (b *Broker) close(sub *Subscription, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drop(sub, err)
+}
+
+// drop removes a subscriber from its watch and stops the backend subscription
+// once the last subscriber left, the caller must hold the broker lock
+func (b *Broker) drop(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.out)
+	close(sub.done)
+
+	w := sub.watch
+	delete(w.subscribers, sub)
+	if len(w.subscribers) == 0 {
+		w.cancel()
+		if b.watches[w.id] == w {
+			delete(b.watches, w.id)
+		}
+	}
+}
+
+// Updates returns the update groups of the subscription, the first group is
+// the current state unless the subscription resumes from a revision. The
+// groups are shared between subscribers and must not be modified.
+func (s *Subscription) Updates() <-chan []storage.Data {
+	return s.updates
+}
+
+// Err returns the reason the subscription ended once Updates is closed, it is
+// nil if the subscription was closed or its context is done
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	if s.cancel != nil {
+		s.cancel()
+		return
+	}
+	s.broker.close(s, nil)
+}
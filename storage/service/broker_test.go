@@ -0,0 +1,246 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+)
+
+// countingStorage counts the backend subscriptions
+type countingStorage struct {
+	storage.Storage
+	subscriptions int32
+	active        int32
+}
+
+func (c *countingStorage) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []storage.Data, error) {
+	atomic.AddInt32(&c.subscriptions, 1)
+	atomic.AddInt32(&c.active, 1)
+	go func() {
+		<-ctx.Done()
+		atomic.AddInt32(&c.active, -1)
+	}()
+	return c.Storage.Subscribe(ctx, keys, fromRevision)
+}
+
+func newStore(t *testing.T) *countingStorage {
+	t.Helper()
+	return &countingStorage{Storage: storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "alpha", Value: []byte("0"), ValueType: "text/plain"}},
+	})}
+}
+
+func push(t *testing.T, store storage.Storage, key, value string) {
+	t.Helper()
+	err := store.PushUpdate(context.Background(), &storage.Data{Key: key, Value: []byte(value), ValueType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, sub *service.Subscription) []storage.Data {
+	t.Helper()
+	select {
+	case group, ok := <-sub.Updates():
+		if !ok {
+			t.Fatalf("subscription closed: %v", sub.Err())
+		}
+		return group
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBrokerSharesWatch(t *testing.T) {
+	store := newStore(t)
+	broker := service.NewBroker(store, service.BrokerConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, err := broker.Subscribe(ctx, []string{"alpha", "beta"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, first)
+
+	// the same keys in a different order share the watch, late subscribers
+	// receive the current state as snapshot
+	push(t, store, "alpha", "1")
+	receive(t, first)
+	second, err := broker.Subscribe(ctx, []string{"beta", "alpha", "alpha"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := receive(t, second)
+	if len(snapshot) != 1 || string(snapshot[0].Value) != "1" {
+		t.Fatalf("snapshot = %v, want alpha=1", snapshot)
+	}
+	if n := atomic.LoadInt32(&store.subscriptions); n != 1 {
+		t.Fatalf("%d backend subscriptions, want 1", n)
+	}
+
+	push(t, store, "beta", "1")
+	for _, sub := range []*service.Subscription{first, second} {
+		if group := receive(t, sub); len(group) != 1 || group[0].Key != "beta" {
+			t.Errorf("got %v, want beta update", group)
+		}
+	}
+
+	// the backend subscription ends with the last subscriber
+	first.Close()
+	second.Close()
+	waitFor(t, func() bool { return atomic.LoadInt32(&store.active) == 0 })
+}
+
+func TestBrokerSlowConsumer(t *testing.T) {
+	store := newStore(t)
+	broker := service.NewBroker(store, service.BrokerConfig{Buffer: 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow, err := broker.Subscribe(ctx, []string{"alpha"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := broker.Subscribe(ctx, []string{"alpha"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fast subscriber keeps reading while the slow one never does
+	for i := 1; i <= 5; i++ {
+		value := string(rune('0' + i))
+		push(t, store, "alpha", value)
+		for {
+			group := receive(t, fast)
+			if len(group) > 0 && string(group[len(group)-1].Value) == value {
+				break
+			}
+		}
+	}
+
+	for range slow.Updates() {
+	}
+	if !errors.Is(slow.Err(), service.ErrSlowConsumer) {
+		t.Fatalf("slow subscriber ended with %v, want ErrSlowConsumer", slow.Err())
+	}
+}
+
+func TestBrokerContextCancel(t *testing.T) {
+	store := newStore(t)
+	broker := service.NewBroker(store, service.BrokerConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := broker.Subscribe(ctx, []string{"alpha"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for range sub.Updates() {
+	}
+	if sub.Err() != nil {
+		t.Fatalf("cancelled subscription ended with %v", sub.Err())
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&store.active) == 0 })
+}
+
+// blockingStorage blocks backend subscriptions to the key "slow" until release
+// is closed
+type blockingStorage struct {
+	storage.Storage
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStorage) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []storage.Data, error) {
+	if len(keys) == 1 && keys[0] == "slow" {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Storage.Subscribe(ctx, keys, fromRevision)
+}
+
+func TestBrokerSubscribeConcurrently(t *testing.T) {
+	store := &blockingStorage{Storage: newStore(t), entered: make(chan struct{}), release: make(chan struct{})}
+	broker := service.NewBroker(store, service.BrokerConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := broker.Subscribe(ctx, []string{"slow"}, 0)
+		slow <- err
+	}()
+	<-store.entered
+
+	// a backend subscription being opened does not hold up other subscribers
+	subscribed := make(chan *service.Subscription, 1)
+	go func() {
+		sub, err := broker.Subscribe(ctx, []string{"alpha"}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		subscribed <- sub
+	}()
+	select {
+	case sub := <-subscribed:
+		if sub != nil {
+			receive(t, sub)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription blocked by the opening of another")
+	}
+
+	close(store.release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// endingStorage ends backend subscriptions right away as if they failed
+type endingStorage struct {
+	storage.Storage
+}
+
+func (endingStorage) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []storage.Data, error) {
+	updates := make(chan []storage.Data)
+	close(updates)
+	return updates, nil
+}
+
+func TestBrokerBackendFailure(t *testing.T) {
+	broker := service.NewBroker(endingStorage{Storage: newStore(t)}, service.BrokerConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// shared and resumed subscriptions both report the failure
+	for _, fromRevision := range []int64{0, 1} {
+		sub, err := broker.Subscribe(ctx, []string{"alpha"}, fromRevision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range sub.Updates() {
+		}
+		if !errors.Is(sub.Err(), service.ErrWatchClosed) {
+			t.Errorf("subscription from revision %d ended with %v, want ErrWatchClosed", fromRevision, sub.Err())
+		}
+	}
+}
@@ -2,95 +2,503 @@ package service
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/bartke/datastream/audit"
+	"github.com/bartke/datastream/codec"
 	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/metrics"
 	"github.com/bartke/datastream/storage"
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type DataServiceServer struct {
-	store storage.Storage
+	store     storage.Storage
+	broker    *Broker
+	validator *Validator
+	policy    *Policy
+	audit     audit.Sink
+	metrics   *metrics.Metrics
 	datastream.UnimplementedDataServiceServer
 }
 
+type DataServiceConfig struct {
+	// optional subscription broker, by default a broker with default
+	// settings is created for the store
+	Broker *Broker
+
+	// optional codecs updates are validated with, values of registered value
+	// types have to decode, default is codec.Default
+	Codecs *codec.Registry
+
+	// optional validator for updates, by default updates are checked against
+	// the declared value type of their key and Codecs
+	Validator *Validator
+
+	// optional authorization of the principals of calls, by default every
+	// caller may act on every key
+	Policy *Policy
+
+	// optional sink updates and deletions are recorded to, ListAuditEvents
+	// queries it if it is an audit.Reader
+	Audit audit.Sink
+
+	// optional metrics of the subscriptions and the updates sent to them
+	Metrics *metrics.Metrics
+}
+
 func NewDataServiceServer(store storage.Storage) *DataServiceServer {
+	return NewDataServiceServerWithConfig(store, DataServiceConfig{})
+}
+
+// NewDataServiceServerWithConfig creates a server with custom settings
+func NewDataServiceServerWithConfig(store storage.Storage, config DataServiceConfig) *DataServiceServer {
+	if config.Broker == nil {
+		config.Broker = NewBroker(store, BrokerConfig{})
+	}
+	if config.Validator == nil {
+		config.Validator = &Validator{codecs: config.Codecs}
+		if config.Codecs == nil {
+			config.Validator.codecs = codec.Default
+		}
+	}
 	return &DataServiceServer{
-		store: store,
+		store:     store,
+		broker:    config.Broker,
+		validator: config.Validator,
+		policy:    config.Policy,
+		audit:     config.Audit,
+		metrics:   config.Metrics,
 	}
 }
 
 func (s *DataServiceServer) ListCapabilities(ctx context.Context, in *datastream.ListCapabilitiesRequest) (*datastream.ListCapabilitiesResponse, error) {
-	capabilities, err := s.store.ListCapabilities()
+	if in.PageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative page size %d", in.PageSize)
+	}
+	capabilities, next, err := s.store.ListCapabilities(ctx, storage.CapabilityQuery{
+		Prefix:    in.Prefix,
+		Tags:      in.Tags,
+		PageSize:  int(in.PageSize),
+		PageToken: in.PageToken,
+	})
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
+	// pages may be shorter than the page size once filtered by the policy
 	resp := &datastream.ListCapabilitiesResponse{
-		Capabilities: make([]*datastream.Capability, len(capabilities)),
+		Capabilities:  make([]*datastream.Capability, 0, len(capabilities)),
+		NextPageToken: next,
 	}
-	for i, cap := range capabilities {
-		resp.Capabilities[i] = &datastream.Capability{
-			Key:       cap.Key,
-			ValueType: cap.ValueType,
+	for _, cap := range capabilities {
+		if !s.policy.Allowed(ctx, ActionList, cap.Key) {
+			continue
 		}
+		resp.Capabilities = append(resp.Capabilities, &datastream.Capability{
+			Key:          cap.Key,
+			ValueType:    cap.ValueType,
+			Description:  cap.Description,
+			ReadOnly:     cap.ReadOnly,
+			DefaultValue: cap.Default,
+			Schema:       cap.Schema,
+			Owner:        cap.Owner,
+			Tags:         cap.Tags,
+		})
 	}
 	return resp, nil
 }
 
+// Sync and Subscribe deny exact keys the caller may not read, the keys of
+// selectors are filtered instead
 func (s *DataServiceServer) Sync(ctx context.Context, in *datastream.DataRequest) (*datastream.DataResponse, error) {
-	data, err := s.store.Sync(in.Keys)
-	if err != nil {
+	if err := s.policy.authorize(ctx, ActionRead, exactKeys(in.Keys)...); err != nil {
 		return nil, err
 	}
+	var data map[string]storage.Data
+	var revision int64
+	var err error
+	if in.AsOf != nil {
+		data, revision, err = s.store.SyncAt(ctx, in.Keys, in.AsOf.AsTime())
+	} else {
+		data, revision, err = s.store.Sync(ctx, in.Keys)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
 
 	resp := &datastream.DataResponse{
-		Data: make(map[string]*datastream.Data),
+		Data:     make(map[string]*datastream.Data),
+		Revision: revision,
 	}
 	for k, v := range data {
-		resp.Data[k] = &datastream.Data{
-			Key:       v.Key,
-			Value:     v.Value,
-			ValueType: v.ValueType,
-			UpdatedAt: timestamppb.New(v.UpdatedAt),
+		if s.policy.Allowed(ctx, ActionRead, k) {
+			resp.Data[k] = toProto(v)
 		}
 	}
 	return resp, nil
 }
 
 func (s *DataServiceServer) Subscribe(in *datastream.DataRequest, stream datastream.DataService_SubscribeServer) error {
-	updates, err := s.store.Subscribe(in.Keys)
+	if in.AsOf != nil {
+		return status.Error(codes.InvalidArgument, "as_of is not supported by Subscribe")
+	}
+	if err := s.policy.authorize(stream.Context(), ActionSubscribe, exactKeys(in.Keys)...); err != nil {
+		return err
+	}
+
+	// subscribers of the same keys share a backend subscription which is
+	// released once the last client disconnects
+	sub, err := s.broker.Subscribe(stream.Context(), in.Keys, in.FromRevision)
 	if err != nil {
 		return err
 	}
+	defer sub.Close()
+	s.metrics.SubscriptionOpened()
+	defer s.metrics.SubscriptionClosed()
 
-	for update := range updates {
+	// every group of updates, e.g. a batch, is sent as one response, without
+	// a revision to resume from the first group is the initial state
+	snapshot := in.FromRevision == 0
+	for group := range sub.Updates() {
+		group = s.policy.filter(stream.Context(), ActionSubscribe, group)
+		if len(group) == 0 && !snapshot {
+			continue
+		}
 		response := &datastream.DataResponse{
-			Data: map[string]*datastream.Data{
-				update.Key: {
-					Key:       update.Key,
-					Value:     update.Value,
-					ValueType: update.ValueType,
-					UpdatedAt: timestamppb.New(update.UpdatedAt),
-				},
-			},
+			Data:     make(map[string]*datastream.Data, len(group)),
+			Snapshot: snapshot,
+		}
+		snapshot = false
+		for _, update := range group {
+			response.Data[update.Key] = toProto(update)
+			if update.Revision > response.Revision {
+				response.Revision = update.Revision
+			}
 		}
 		if err := stream.Send(response); err != nil {
 			return err
 		}
+		s.metrics.Sent(response)
 	}
-	return nil
+	return toStatus(sub.Err())
 }
 
 func (s *DataServiceServer) PushUpdate(ctx context.Context, in *datastream.Data) (*empty.Empty, error) {
-	data := &storage.Data{
-		Key:       in.Key,
-		Value:     in.Value,
-		ValueType: in.ValueType,
-		UpdatedAt: in.UpdatedAt.AsTime(),
+	if err := s.policy.authorize(ctx, ActionPush, in.Key); err != nil {
+		return nil, err
+	}
+	batch := []storage.Data{fromProto(in)}
+	if err := s.validate(ctx, batch); err != nil {
+		return nil, err
+	}
+	previous, err := s.previous(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.PushUpdate(ctx, &batch[0]); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := s.record(ctx, batch, previous); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+func (s *DataServiceServer) PushBatch(ctx context.Context, in *datastream.PushBatchRequest) (*empty.Empty, error) {
+	batch := make([]storage.Data, len(in.Data))
+	for i, data := range in.Data {
+		if err := s.policy.authorize(ctx, ActionPush, data.Key); err != nil {
+			return nil, err
+		}
+		batch[i] = fromProto(data)
+	}
+	if err := s.validate(ctx, batch); err != nil {
+		return nil, err
+	}
+	previous, err := s.previous(ctx, batch)
+	if err != nil {
+		return nil, err
 	}
-	if err := s.store.PushUpdate(data); err != nil {
+	if err := s.store.PushBatch(ctx, batch); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := s.record(ctx, batch, previous); err != nil {
 		return nil, err
 	}
 	return &empty.Empty{}, nil
 }
+
+func (s *DataServiceServer) Delete(ctx context.Context, in *datastream.DeleteRequest) (*empty.Empty, error) {
+	if err := s.policy.authorize(ctx, ActionPush, in.Key); err != nil {
+		return nil, err
+	}
+	batch := []storage.Data{{Key: in.Key, Deleted: true}}
+	if err := s.validate(ctx, batch); err != nil {
+		return nil, err
+	}
+	previous, err := s.previous(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.Delete(ctx, in.Key); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := s.record(ctx, batch, previous); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+// History requires the caller to be allowed to read the key
+func (s *DataServiceServer) History(ctx context.Context, in *datastream.HistoryRequest) (*datastream.HistoryResponse, error) {
+	if in.Key == "" || storage.IsSelector(in.Key) {
+		return nil, status.Errorf(codes.InvalidArgument, "history requires an exact key, got %q", in.Key)
+	}
+	if in.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative limit %d", in.Limit)
+	}
+	if err := s.policy.authorize(ctx, ActionRead, in.Key); err != nil {
+		return nil, err
+	}
+	versions, err := s.store.History(ctx, in.Key, int(in.Limit))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &datastream.HistoryResponse{Versions: make([]*datastream.Data, len(versions))}
+	for i, v := range versions {
+		resp.Versions[i] = toProto(v)
+	}
+	return resp, nil
+}
+
+// ListAuditEvents denies exact keys the caller may not audit, events of other
+// keys matching a selector are filtered
+func (s *DataServiceServer) ListAuditEvents(ctx context.Context, in *datastream.ListAuditEventsRequest) (*datastream.ListAuditEventsResponse, error) {
+	reader, ok := s.audit.(audit.Reader)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is not queryable")
+	}
+	if in.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative limit %d", in.Limit)
+	}
+	if in.Key != "" && !storage.IsSelector(in.Key) {
+		if err := s.policy.authorize(ctx, ActionAudit, in.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	query := audit.Query{Key: in.Key}
+	if in.Since != nil {
+		query.Since = in.Since.AsTime()
+	}
+	if in.Until != nil {
+		query.Until = in.Until.AsTime()
+	}
+	// the limit is applied after filtering by the policy
+	limit := int(in.Limit)
+	if s.policy == nil {
+		query.Limit = limit
+	}
+	events, err := reader.Events(ctx, query)
+	if errors.Is(err, audit.ErrNotReadable) {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is not queryable")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &datastream.ListAuditEventsResponse{}
+	for _, e := range events {
+		if limit > 0 && len(resp.Events) == limit {
+			break
+		}
+		if !s.policy.Allowed(ctx, ActionAudit, e.Key) {
+			continue
+		}
+		resp.Events = append(resp.Events, &datastream.AuditEvent{
+			Time:         timestamppb.New(e.Time),
+			Principal:    e.Principal,
+			Peer:         e.Peer,
+			Action:       e.Action,
+			Key:          e.Key,
+			PreviousHash: e.PreviousHash,
+			NewHash:      e.NewHash,
+		})
+	}
+	return resp, nil
+}
+
+// previous returns the current values of the keys of a batch if changes are
+// audited
+func (s *DataServiceServer) previous(ctx context.Context, batch []storage.Data) (map[string]storage.Data, error) {
+	if s.audit == nil {
+		return nil, nil
+	}
+	keys := make([]string, len(batch))
+	for i, data := range batch {
+		keys[i] = data.Key
+	}
+	previous, _, err := s.store.Sync(ctx, keys)
+	return previous, err
+}
+
+// record writes the audit events of an applied batch, deletions of keys which
+// did not exist changed nothing and are not recorded. A failure is reported to
+// the caller although the batch has been applied.
+func (s *DataServiceServer) record(ctx context.Context, batch []storage.Data, previous map[string]storage.Data) error {
+	if s.audit == nil {
+		return nil
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	now := time.Now().UTC()
+	events := make([]audit.Event, 0, len(batch))
+	for _, data := range batch {
+		old, existed := previous[data.Key]
+		existed = existed && !old.Deleted
+		if data.Deleted && !existed {
+			continue
+		}
+		event := audit.Event{
+			Time:      now,
+			Principal: principalName(ctx),
+			Peer:      addr,
+			Action:    audit.ActionUpdate,
+			Key:       data.Key,
+		}
+		if existed {
+			event.PreviousHash = audit.Hash(old.Value)
+		}
+		if data.Deleted {
+			event.Action = audit.ActionDelete
+		} else {
+			event.NewHash = audit.Hash(data.Value)
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if err := s.audit.Record(ctx, events); err != nil {
+		return status.Errorf(codes.Internal, "change applied but not audited: %v", err)
+	}
+	return nil
+}
+
+func toProto(data storage.Data) *datastream.Data {
+	return &datastream.Data{
+		Key:       data.Key,
+		Value:     data.Value,
+		ValueType: data.ValueType,
+		UpdatedAt: timestamppb.New(data.UpdatedAt),
+		Deleted:   data.Deleted,
+		Revision:  data.Revision,
+		Version:   data.Version,
+	}
+}
+
+// validate checks updates against the capabilities declared for their keys
+func (s *DataServiceServer) validate(ctx context.Context, batch []storage.Data) error {
+	// listed once per batch if it contains keys which are not listed
+	var all []storage.Capability
+	for i := range batch {
+		capability, err := s.capability(ctx, batch[i].Key, &all)
+		if err != nil {
+			return err
+		}
+		if err := s.validator.Validate(&batch[i], capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capability looks up the capability of key, which is the first one listed
+// with key as prefix. Keys which are not listed, e.g. new keys, are covered by
+// the most specific selector matching them, all lists every capability to find
+// it and is filled in on first use.
+func (s *DataServiceServer) capability(ctx context.Context, key string, all *[]storage.Capability) (*storage.Capability, error) {
+	capabilities, _, err := s.store.ListCapabilities(ctx, storage.CapabilityQuery{Prefix: key, PageSize: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(capabilities) == 1 && capabilities[0].Key == key {
+		return &capabilities[0], nil
+	}
+
+	if *all == nil {
+		capabilities, _, err := s.store.ListCapabilities(ctx, storage.CapabilityQuery{})
+		if err != nil {
+			return nil, err
+		}
+		*all = append(make([]storage.Capability, 0, len(capabilities)), capabilities...)
+	}
+	return capabilityOf(*all, key), nil
+}
+
+// capabilityOf returns the capability of key, keys which are not listed are
+// covered by the most specific selector matching them
+func capabilityOf(capabilities []storage.Capability, key string) *storage.Capability {
+	var match *storage.Capability
+	for i := range capabilities {
+		c := &capabilities[i]
+		if c.Key == key {
+			return c
+		}
+		if storage.IsSelector(c.Key) && storage.Match([]string{c.Key}, key) && (match == nil || len(c.Key) > len(match.Key)) {
+			match = c
+		}
+	}
+	return match
+}
+
+// exactKeys returns the keys which are not selectors
+func exactKeys(keys []string) []string {
+	var exact []string
+	for _, key := range keys {
+		if !storage.IsSelector(key) {
+			exact = append(exact, key)
+		}
+	}
+	return exact
+}
+
+// fromProto converts an update, without a timestamp the store sets the time
+// of the update
+func fromProto(data *datastream.Data) storage.Data {
+	d := storage.Data{
+		Key:              data.Key,
+		Value:            data.Value,
+		ValueType:        data.ValueType,
+		Deleted:          data.Deleted,
+		ExpectedRevision: data.ExpectedRevision,
+	}
+	if data.UpdatedAt != nil {
+		d.UpdatedAt = data.UpdatedAt.AsTime()
+	}
+	return d
+}
+
+// toStatus maps storage errors to gRPC status errors
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrRevisionMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, storage.ErrInvalidPageToken), errors.Is(err, storage.ErrReservedKey):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrSlowConsumer):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrWatchClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startServer serves server over an in-memory connection and returns a client
+func startServer(t *testing.T, server datastream.DataServiceServer, options ...grpc.ServerOption) datastream.DataServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(options...)
+	datastream.RegisterDataServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return datastream.NewDataServiceClient(conn)
+}
+
+func TestSubscribeSnapshot(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "alpha", Value: []byte("1"), ValueType: "text/plain"},
+			{Key: "beta", Value: []byte("2"), ValueType: "text/plain"},
+		},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &datastream.DataRequest{Keys: []string{"alpha", "beta", "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Snapshot || len(first.Data) != 2 || string(first.Data["beta"].Value) != "2" {
+		t.Fatalf("first response = %v, want snapshot of alpha and beta", first)
+	}
+
+	push(t, store, "alpha", "3")
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Snapshot || string(second.Data["alpha"].Value) != "3" {
+		t.Fatalf("second response = %v, want change of alpha", second)
+	}
+}
+
+func TestPushUpdateInvalidValue(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	client := startServer(t, service.NewDataServiceServer(store))
+
+	_, err := client.PushUpdate(context.Background(), &datastream.Data{Key: "max_connections", Value: []byte("abc"), ValueType: "int"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("PushUpdate of invalid int = %v, want INVALID_ARGUMENT", err)
+	}
+
+	_, err = client.PushUpdate(context.Background(), &datastream.Data{Key: "max_connections", Value: []byte("20"), ValueType: "int"})
+	if err != nil {
+		t.Fatalf("PushUpdate of valid int: %v", err)
+	}
+}
+
+func TestReadOnlyCapability(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "build/version", Value: []byte("1.2.0"), ValueType: "text/plain"}},
+		Capabilities: []storage.Capability{
+			{Key: "build/", Description: "set by the release pipeline", ReadOnly: true, Owner: "release", Tags: []string{"build"}},
+		},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	resp, err := client.ListCapabilities(ctx, &datastream.ListCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Capabilities) != 2 || !resp.Capabilities[1].ReadOnly || resp.Capabilities[1].Owner != "release" {
+		t.Fatalf("ListCapabilities = %v, want read-only build/ and build/version", resp.Capabilities)
+	}
+
+	for _, key := range []string{"build/version", "build/commit"} {
+		_, err = client.PushUpdate(ctx, &datastream.Data{Key: key, Value: []byte("1.3.0"), ValueType: "text/plain"})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("PushUpdate of read-only key %s = %v, want PERMISSION_DENIED", key, err)
+		}
+	}
+	_, err = client.Delete(ctx, &datastream.DeleteRequest{Key: "build/version"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Delete of read-only key = %v, want PERMISSION_DENIED", err)
+	}
+}
+
+func TestListCapabilitiesFilter(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Capabilities: []storage.Capability{
+			{Key: "limits/payments", ValueType: "int", Tags: []string{"limits", "payments"}},
+			{Key: "limits/search", ValueType: "int", Tags: []string{"limits"}},
+			{Key: "flags/payments", ValueType: "bool", Tags: []string{"payments"}},
+			{Key: "flags/search", ValueType: "bool"},
+		},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	var keys []string
+	req := &datastream.ListCapabilitiesRequest{Tags: []string{"payments"}, PageSize: 1}
+	for {
+		resp, err := client.ListCapabilities(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, capability := range resp.Capabilities {
+			keys = append(keys, capability.Key)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if len(keys) != 2 || keys[0] != "flags/payments" || keys[1] != "limits/payments" {
+		t.Errorf("capabilities tagged payments = %v, want flags/payments and limits/payments", keys)
+	}
+
+	resp, err := client.ListCapabilities(ctx, &datastream.ListCapabilitiesRequest{Prefix: "limits/", Tags: []string{"limits"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Capabilities) != 2 || resp.NextPageToken != "" {
+		t.Errorf("limits/ tagged limits = %v, want both limits", resp.Capabilities)
+	}
+
+	_, err = client.ListCapabilities(ctx, &datastream.ListCapabilitiesRequest{PageToken: "not a token"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListCapabilities with invalid token = %v, want INVALID_ARGUMENT", err)
+	}
+}
+
+// reservingStorage rejects every key as reserved
+type reservingStorage struct {
+	storage.Storage
+}
+
+func (reservingStorage) PushUpdate(ctx context.Context, data *storage.Data) error {
+	return fmt.Errorf("%w: %s", storage.ErrReservedKey, data.Key)
+}
+
+func (reservingStorage) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("%w: %s", storage.ErrReservedKey, key)
+}
+
+func (reservingStorage) Sync(ctx context.Context, keys []string) (map[string]storage.Data, int64, error) {
+	return nil, 0, fmt.Errorf("%w: %v", storage.ErrReservedKey, keys)
+}
+
+func (reservingStorage) SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]storage.Data, int64, error) {
+	return nil, 0, fmt.Errorf("%w: %v", storage.ErrReservedKey, keys)
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	store := reservingStorage{Storage: storage.NewMemoryStorage(storage.MemoryConfig{})}
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	_, err := client.PushUpdate(ctx, &datastream.Data{Key: ".git/config", Value: []byte("x")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("PushUpdate of a reserved key = %v, want INVALID_ARGUMENT", err)
+	}
+	_, err = client.Delete(ctx, &datastream.DeleteRequest{Key: ".git/config"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Delete of a reserved key = %v, want INVALID_ARGUMENT", err)
+	}
+	for _, req := range []*datastream.DataRequest{
+		{Keys: []string{".git/config"}},
+		{Keys: []string{".git/config"}, AsOf: timestamppb.Now()},
+	} {
+		if _, err := client.Sync(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Sync(%v) of a reserved key = %v, want INVALID_ARGUMENT", req, err)
+		}
+	}
+}
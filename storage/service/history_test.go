@@ -0,0 +1,93 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestHistory(t *testing.T) {
+	incident := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "rate_limit", Value: []byte("10"), ValueType: "int", UpdatedAt: incident.Add(-time.Hour)},
+			{Key: "rate_limit", Value: []byte("20"), ValueType: "int", UpdatedAt: incident.Add(-time.Minute)},
+			{Key: "timeout", Value: []byte("5"), ValueType: "int", UpdatedAt: incident.Add(-time.Minute)},
+		},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	if _, err := client.PushUpdate(ctx, &datastream.Data{Key: "rate_limit", Value: []byte("30"), ValueType: "int"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, &datastream.DeleteRequest{Key: "timeout"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.History(ctx, &datastream.HistoryRequest{Key: "rate_limit", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Versions) != 2 || string(resp.Versions[0].Value) != "30" || string(resp.Versions[1].Value) != "20" {
+		t.Errorf("History = %v, want the latest two values", resp.Versions)
+	}
+	if updated := resp.Versions[0].UpdatedAt.AsTime(); time.Since(updated) > time.Minute {
+		t.Errorf("update without a timestamp recorded at %v", updated)
+	}
+	resp, err = client.History(ctx, &datastream.HistoryRequest{Key: "timeout"})
+	if err != nil || len(resp.Versions) != 2 || !resp.Versions[0].Deleted {
+		t.Errorf("History of a deleted key = %v, %v, want a tombstone first", resp, err)
+	}
+
+	sync, err := client.Sync(ctx, &datastream.DataRequest{Keys: []string{"rate_limit", "timeout"}, AsOf: timestamppb.New(incident)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Data) != 2 || string(sync.Data["rate_limit"].Value) != "20" || sync.Revision != 3 {
+		t.Errorf("Sync as of the incident = %v, want the values before it", sync)
+	}
+
+	if _, err := client.History(ctx, &datastream.HistoryRequest{Key: "services/"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("History of a selector: %v, want INVALID_ARGUMENT", err)
+	}
+	stream, err := client.Subscribe(ctx, &datastream.DataRequest{Keys: []string{"rate_limit"}, AsOf: timestamppb.New(incident)})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Subscribe as of a time: %v, want INVALID_ARGUMENT", err)
+	}
+}
+
+func TestHistoryPolicy(t *testing.T) {
+	policy, err := service.NewPolicy(service.PolicyConfig{Rules: []service.PolicyRule{
+		{Principals: []string{"*"}, Actions: []service.Action{service.ActionRead}, Keys: []string{"public/"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "public/a", Value: []byte("1")}, {Key: "private/b", Value: []byte("2")}},
+	})
+	client := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Policy: policy}))
+	ctx := context.Background()
+
+	if _, err := client.History(ctx, &datastream.HistoryRequest{Key: "public/a"}); err != nil {
+		t.Errorf("History of a public key: %v", err)
+	}
+	if _, err := client.History(ctx, &datastream.HistoryRequest{Key: "private/b"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("History of a private key: %v, want PERMISSION_DENIED", err)
+	}
+	sync, err := client.Sync(ctx, &datastream.DataRequest{Keys: []string{"public/", "private/"}, AsOf: timestamppb.Now()})
+	if err != nil || len(sync.Data) != 1 || sync.Data["public/a"] == nil {
+		t.Errorf("Sync as of now = %v, %v, want the public key", sync, err)
+	}
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bartke/datastream/auth"
+	"github.com/bartke/datastream/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Action is what a caller does with a key
+type Action string
+
+const (
+	// ActionList lists the capability of a key
+	ActionList Action = "list"
+	// ActionRead reads a key with Sync
+	ActionRead Action = "read"
+	// ActionSubscribe follows a key with Subscribe
+	ActionSubscribe Action = "subscribe"
+	// ActionPush updates or deletes a key
+	ActionPush Action = "push"
+	// ActionAudit lists the audit events of a key
+	ActionAudit Action = "audit"
+)
+
+// PolicyRule grants or denies principals actions on keys
+type PolicyRule struct {
+	// Principals are principal names, "group:<name>" for the members of a
+	// group or "*" for every caller, including unauthenticated ones
+	Principals []string `yaml:"principals"`
+
+	// Actions are list, read, subscribe, push, audit or "*" for all of them
+	Actions []Action `yaml:"actions"`
+
+	// Keys are keys or selectors, e.g. "services/" or "services/*/limit"
+	Keys []string `yaml:"keys"`
+
+	// Deny rules take precedence over the rules allowing an action
+	Deny bool `yaml:"deny"`
+}
+
+type PolicyConfig struct {
+	Rules []PolicyRule
+
+	// optional logger denied calls are audited to, default is log.Default()
+	AuditLog *log.Logger
+}
+
+// Policy authorizes the principals of calls, see auth.FromContext, to act on
+// keys. Actions no rule allows are denied.
+type Policy struct {
+	rules    []PolicyRule
+	auditLog *log.Logger
+}
+
+// NewPolicy checks the rules of a policy
+func NewPolicy(config PolicyConfig) (*Policy, error) {
+	for i, rule := range config.Rules {
+		if len(rule.Principals) == 0 || len(rule.Actions) == 0 || len(rule.Keys) == 0 {
+			return nil, fmt.Errorf("rule %d: requires principals, actions and keys", i+1)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case ActionList, ActionRead, ActionSubscribe, ActionPush, ActionAudit, "*":
+			default:
+				return nil, fmt.Errorf("rule %d: unknown action %q", i+1, action)
+			}
+		}
+	}
+	if config.AuditLog == nil {
+		config.AuditLog = log.Default()
+	}
+	return &Policy{rules: config.Rules, auditLog: config.AuditLog}, nil
+}
+
+// LoadPolicyFile reads the rules of a YAML policy file:
+//
+//	rules:
+//	  - principals: ["*"]
+//	    actions: [list, read, subscribe]
+//	    keys: ["services/"]
+//	  - principals: [group:ops]
+//	    actions: ["*"]
+//	    keys: ["services/", max_connections]
+//	  - principals: [updater]
+//	    actions: [push]
+//	    keys: ["services/*/limit"]
+func LoadPolicyFile(path string) ([]PolicyRule, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []PolicyRule `yaml:"rules"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return file.Rules, nil
+}
+
+// Allowed reports whether the caller of ctx may act on key, a nil policy
+// allows everything
+func (p *Policy) Allowed(ctx context.Context, action Action, key string) bool {
+	if p == nil {
+		return true
+	}
+	principal, authenticated := auth.FromContext(ctx)
+	allowed := false
+	for _, rule := range p.rules {
+		if !rule.matches(principal, authenticated, action, key) {
+			continue
+		}
+		if rule.Deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// authorize returns PERMISSION_DENIED unless the caller may act on all keys,
+// denials are written to the audit log
+func (p *Policy) authorize(ctx context.Context, action Action, keys ...string) error {
+	for _, key := range keys {
+		if p.Allowed(ctx, action, key) {
+			continue
+		}
+		name := principalName(ctx)
+		p.auditLog.Printf("audit: denied principal=%q action=%s key=%q", name, action, key)
+		return status.Errorf(codes.PermissionDenied, "%s may not %s key %s", name, action, key)
+	}
+	return nil
+}
+
+// filter returns the data the caller may act on
+func (p *Policy) filter(ctx context.Context, action Action, data []storage.Data) []storage.Data {
+	if p == nil {
+		return data
+	}
+	allowed := data[:0:0]
+	for _, d := range data {
+		if p.Allowed(ctx, action, d.Key) {
+			allowed = append(allowed, d)
+		}
+	}
+	return allowed
+}
+
+func (r PolicyRule) matches(principal auth.Principal, authenticated bool, action Action, key string) bool {
+	return r.matchesPrincipal(principal, authenticated) && r.matchesAction(action) && storage.Match(r.Keys, key)
+}
+
+func (r PolicyRule) matchesPrincipal(principal auth.Principal, authenticated bool) bool {
+	for _, name := range r.Principals {
+		if name == "*" {
+			return true
+		}
+		if !authenticated {
+			continue
+		}
+		if group := strings.TrimPrefix(name, "group:"); group != name {
+			for _, g := range principal.Groups {
+				if g == group {
+					return true
+				}
+			}
+		} else if name == principal.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) matchesAction(action Action) bool {
+	for _, a := range r.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func principalName(ctx context.Context) string {
+	if principal, ok := auth.FromContext(ctx); ok {
+		return principal.Name
+	}
+	return "anonymous"
+}
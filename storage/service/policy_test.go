@@ -0,0 +1,192 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bartke/datastream/auth"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testPolicy = `
+rules:
+  - principals: ["*"]
+    actions: [list, read, subscribe]
+    keys: ["services/"]
+  - principals: [group:ops]
+    actions: ["*"]
+    keys: ["services/", max_connections]
+  - principals: [updater]
+    actions: [push]
+    keys: ["services/*/limit"]
+  - principals: ["*"]
+    actions: ["*"]
+    keys: ["services/secrets/"]
+    deny: true
+`
+
+// startPolicyServer serves store with the test policy, callers authenticate
+// with the tokens "ops" and "updater"
+func startPolicyServer(t *testing.T, store storage.Storage) (datastream.DataServiceClient, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	tokenFile, policyFile := filepath.Join(dir, "tokens"), filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(tokenFile, []byte("ops alice ops\nupdater updater\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(policyFile, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := service.LoadPolicyFile(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	policy, err := service.NewPolicy(service.PolicyConfig{Rules: rules, AuditLog: log.New(&audit, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.LoadTokenFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := auth.NewInterceptor(auth.InterceptorConfig{Authenticators: []auth.Authenticator{tokens}})
+	server := service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Policy: policy})
+	return startServer(t, server, grpc.UnaryInterceptor(a.Unary), grpc.StreamInterceptor(a.Stream)), &audit
+}
+
+func as(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "max_connections", Value: []byte("10"), ValueType: "int"},
+			{Key: "services/payments/limit", Value: []byte("5"), ValueType: "int"},
+			{Key: "services/secrets/token", Value: []byte("hunter2"), ValueType: "text/plain"},
+		},
+	})
+	client, audit := startPolicyServer(t, store)
+
+	// capabilities are filtered
+	resp, err := client.ListCapabilities(as("updater"), &datastream.ListCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, c := range resp.Capabilities {
+		keys = append(keys, c.Key)
+	}
+	if strings.Join(keys, ",") != "services/payments/limit" {
+		t.Errorf("updater lists %v, want services/payments/limit", keys)
+	}
+
+	// exact keys are denied, selectors are filtered
+	if _, err := client.Sync(as("updater"), &datastream.DataRequest{Keys: []string{"max_connections"}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("updater sync max_connections: %v, want PERMISSION_DENIED", err)
+	}
+	data, err := client.Sync(as("ops"), &datastream.DataRequest{Keys: []string{"max_connections", "services/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = keys[:0]
+	for key := range data.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "max_connections,services/payments/limit" {
+		t.Errorf("ops syncs %v, want max_connections and services/payments/limit", keys)
+	}
+	if _, err := client.Sync(as("ops"), &datastream.DataRequest{Keys: []string{"services/secrets/token"}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ops sync of a denied key: %v, want PERMISSION_DENIED", err)
+	}
+
+	// pushes require the push action on every key
+	if _, err := client.PushUpdate(as("updater"), &datastream.Data{Key: "services/payments/limit", Value: []byte("6")}); err != nil {
+		t.Errorf("updater push: %v", err)
+	}
+	if _, err := client.PushUpdate(as("updater"), &datastream.Data{Key: "max_connections", Value: []byte("20")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("updater push max_connections: %v, want PERMISSION_DENIED", err)
+	}
+	batch := &datastream.PushBatchRequest{Data: []*datastream.Data{
+		{Key: "services/payments/limit", Value: []byte("7")},
+		{Key: "services/payments/owner", Value: []byte("team")},
+	}}
+	if _, err := client.PushBatch(as("updater"), batch); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("updater batch: %v, want PERMISSION_DENIED", err)
+	}
+	if _, err := client.Delete(as("updater"), &datastream.DeleteRequest{Key: "max_connections"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("updater delete: %v, want PERMISSION_DENIED", err)
+	}
+
+	if !strings.Contains(audit.String(), `audit: denied principal="updater" action=push key="max_connections"`) {
+		t.Errorf("audit log =\n%s", audit.String())
+	}
+}
+
+func TestPolicySubscribe(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "services/payments/limit", Value: []byte("5"), ValueType: "int"},
+			{Key: "services/secrets/token", Value: []byte("hunter2"), ValueType: "text/plain"},
+		},
+	})
+	client, _ := startPolicyServer(t, store)
+
+	ctx, cancel := context.WithCancel(as("ops"))
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &datastream.DataRequest{Keys: []string{"services/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.Data["services/secrets/token"]; ok || len(first.Data) != 1 {
+		t.Errorf("snapshot = %v, want services/payments/limit only", first.Data)
+	}
+
+	push(t, store, "services/secrets/token", "hunter3")
+	push(t, store, "services/payments/limit", "6")
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Data) != 1 || string(second.Data["services/payments/limit"].Value) != "6" {
+		t.Errorf("second response = %v, want the update of services/payments/limit", second.Data)
+	}
+
+	stream, err = client.Subscribe(as("anonymous"), &datastream.DataRequest{Keys: []string{"services/payments/limit"}})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("subscribe with an unknown token: %v, want UNAUTHENTICATED", err)
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for _, rule := range []service.PolicyRule{
+		{Principals: []string{"*"}, Actions: []service.Action{"write"}, Keys: []string{"a"}},
+		{Principals: []string{"*"}, Actions: []service.Action{"read"}},
+	} {
+		if _, err := service.NewPolicy(service.PolicyConfig{Rules: []service.PolicyRule{rule}}); err == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *DataServiceServer) Rollback(ctx context.Context, in *datastream.RollbackRequest) (*datastream.RollbackResponse, error) {
+	if in.Key == "" || storage.IsSelector(in.Key) {
+		return nil, status.Errorf(codes.InvalidArgument, "rollback requires an exact key, got %q", in.Key)
+	}
+	return s.rollback(ctx, []string{in.Key}, in.Revision)
+}
+
+// RollbackTo restores all keys unless the request selects some, a point in
+// time is resolved to the last revision at or before it
+func (s *DataServiceServer) RollbackTo(ctx context.Context, in *datastream.RollbackToRequest) (*datastream.RollbackResponse, error) {
+	if (in.Revision != 0) == (in.AsOf != nil) {
+		return nil, status.Error(codes.InvalidArgument, "either revision or as_of is required")
+	}
+	keys := in.Keys
+	if len(keys) == 0 {
+		keys = storage.AllKeys
+	}
+
+	revision := in.Revision
+	if in.AsOf != nil {
+		_, at, err := s.store.SyncAt(ctx, nil, in.AsOf.AsTime())
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if at == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "no revision at or before %s", in.AsOf.AsTime().Format(time.RFC3339))
+		}
+		revision = at
+	}
+	return s.rollback(ctx, keys, revision)
+}
+
+// rollback writes the differences between the current state of keys and their
+// state at revision as one batch. Every change is conditional on the current
+// revision of its key, a concurrent update fails the rollback instead of being
+// overwritten. The caller has to be allowed to read and push every changed key.
+func (s *DataServiceServer) rollback(ctx context.Context, keys []string, revision int64) (*datastream.RollbackResponse, error) {
+	if err := s.policy.authorize(ctx, ActionRead, exactKeys(keys)...); err != nil {
+		return nil, err
+	}
+	current, currentRevision, err := s.store.Sync(ctx, keys)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if revision <= 0 || revision > currentRevision {
+		return nil, status.Errorf(codes.InvalidArgument, "revision %d is not between 1 and the current revision %d", revision, currentRevision)
+	}
+	target, err := s.store.SyncRevision(ctx, keys, revision)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	batch := restore(current, target)
+	resp := &datastream.RollbackResponse{Revision: revision, Changes: make([]*datastream.Data, len(batch))}
+	if len(batch) == 0 {
+		return resp, nil
+	}
+	changed := make([]string, len(batch))
+	for i, data := range batch {
+		changed[i] = data.Key
+		resp.Changes[i] = toProto(data)
+	}
+	if err := s.policy.authorize(ctx, ActionRead, changed...); err != nil {
+		return nil, err
+	}
+	if err := s.policy.authorize(ctx, ActionPush, changed...); err != nil {
+		return nil, err
+	}
+	if err := s.validate(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	if reverter, ok := s.store.(storage.Reverter); ok {
+		err = reverter.Revert(ctx, batch, revision)
+	} else {
+		err = s.store.PushBatch(ctx, batch)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if err := s.record(ctx, batch, current); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// restore returns the updates and deletions turning current into target
+// ordered by key, each is conditional on the current revision of its key
+func restore(current, target map[string]storage.Data) []storage.Data {
+	now := time.Now()
+	var batch []storage.Data
+	for key, old := range target {
+		data, exists := current[key]
+		if exists && bytes.Equal(data.Value, old.Value) && data.ValueType == old.ValueType {
+			continue
+		}
+		expected := data.Revision
+		batch = append(batch, storage.Data{Key: key, Value: old.Value, ValueType: old.ValueType, UpdatedAt: now, ExpectedRevision: &expected})
+	}
+	for key, data := range current {
+		if _, ok := target[key]; ok {
+			continue
+		}
+		expected := data.Revision
+		batch = append(batch, storage.Data{Key: key, UpdatedAt: now, Deleted: true, ExpectedRevision: &expected})
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Key < batch[j].Key })
+	return batch
+}
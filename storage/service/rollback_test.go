@@ -0,0 +1,216 @@
+package service_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/audit"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// values returns the current values of keys
+func values(t *testing.T, store storage.Storage, keys ...string) map[string]string {
+	t.Helper()
+	data, _, err := store.Sync(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string, len(data))
+	for key, d := range data {
+		result[key] = string(d.Value)
+	}
+	return result
+}
+
+func TestRollback(t *testing.T) {
+	sink, err := audit.OpenJSONLFile(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	store := storage.NewMemoryStorage(storage.MemoryConfig{})
+	client := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Audit: sink}))
+	ctx := context.Background()
+
+	for _, value := range []string{"10", "20", "30"} {
+		if _, err := client.PushUpdate(ctx, &datastream.Data{Key: "rate_limit", Value: []byte(value), ValueType: "int"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.PushUpdate(ctx, &datastream.Data{Key: "timeout", Value: []byte("5")}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Rollback(ctx, &datastream.RollbackRequest{Key: "rate_limit", Revision: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Changes) != 1 || string(resp.Changes[0].Value) != "20" || resp.Changes[0].ValueType != "int" {
+		t.Errorf("Rollback changes = %v, want rate_limit=20", resp.Changes)
+	}
+	if got := values(t, store, "rate_limit", "timeout"); got["rate_limit"] != "20" || got["timeout"] != "5" {
+		t.Errorf("values after rollback = %v", got)
+	}
+	history, err := client.History(ctx, &datastream.HistoryRequest{Key: "rate_limit"})
+	if err != nil || len(history.Versions) != 4 {
+		t.Errorf("history after rollback = %v, %v, want the rollback as a new version", history, err)
+	}
+	events, err := client.ListAuditEvents(ctx, &datastream.ListAuditEventsRequest{Key: "rate_limit", Limit: 1})
+	if err != nil || len(events.Events) != 1 || events.Events[0].NewHash != audit.Hash([]byte("20")) {
+		t.Errorf("audit events = %v, %v, want the rollback", events, err)
+	}
+
+	// restoring the current value changes nothing, a key which did not exist
+	// at the revision is deleted
+	resp, err = client.Rollback(ctx, &datastream.RollbackRequest{Key: "rate_limit", Revision: 5})
+	if err != nil || len(resp.Changes) != 0 {
+		t.Errorf("Rollback to the current value = %v, %v, want no changes", resp, err)
+	}
+	resp, err = client.Rollback(ctx, &datastream.RollbackRequest{Key: "timeout", Revision: 1})
+	if err != nil || len(resp.Changes) != 1 || !resp.Changes[0].Deleted {
+		t.Errorf("Rollback before creation = %v, %v, want a deletion", resp, err)
+	}
+
+	for _, req := range []*datastream.RollbackRequest{
+		{Key: "rate_limit", Revision: 100},
+		{Key: "rate_limit"},
+		{Key: "services/", Revision: 1},
+	} {
+		if _, err := client.Rollback(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Rollback(%v): %v, want INVALID_ARGUMENT", req, err)
+		}
+	}
+}
+
+func TestRollbackTo(t *testing.T) {
+	incident := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{
+			{Key: "services/payments/limit", Value: []byte("5"), UpdatedAt: incident.Add(-time.Hour)},
+			{Key: "services/orders/limit", Value: []byte("1"), UpdatedAt: incident.Add(-time.Hour)},
+			{Key: "timeout", Value: []byte("5"), UpdatedAt: incident.Add(-time.Hour)},
+		},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	// a bad push after the incident
+	if _, err := client.PushBatch(ctx, &datastream.PushBatchRequest{Data: []*datastream.Data{
+		{Key: "services/payments/limit", Value: []byte("500")},
+		{Key: "services/orders/limit", Deleted: true},
+		{Key: "services/refunds/limit", Value: []byte("1")},
+		{Key: "timeout", Value: []byte("50")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.RollbackTo(ctx, &datastream.RollbackToRequest{AsOf: timestamppb.New(incident), Keys: []string{"services/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revision != 3 || len(resp.Changes) != 3 {
+		t.Errorf("RollbackTo = %v, want three changes restoring revision 3", resp)
+	}
+	want := map[string]string{"services/payments/limit": "5", "services/orders/limit": "1", "timeout": "50"}
+	if got := values(t, store, "services/", "timeout"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("values = %v, want %v", got, want)
+	}
+
+	if _, err := client.RollbackTo(ctx, &datastream.RollbackToRequest{Revision: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := values(t, store, "timeout"); got["timeout"] != "5" {
+		t.Errorf("timeout after restoring the whole store = %v", got)
+	}
+
+	for _, req := range []*datastream.RollbackToRequest{
+		{},
+		{Revision: 1, AsOf: timestamppb.New(incident)},
+		{AsOf: timestamppb.New(incident.Add(-24 * time.Hour))},
+	} {
+		if _, err := client.RollbackTo(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RollbackTo(%v): %v, want INVALID_ARGUMENT", req, err)
+		}
+	}
+}
+
+func TestRollbackToSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// rows written before the change log existed are part of the past states
+	_, err = db.Exec(`
+		CREATE TABLE data (key TEXT PRIMARY KEY, value BLOB, value_type TEXT, updated_at DATETIME);
+		INSERT INTO data VALUES
+			('alpha', '1', 'text/plain', '2023-05-01T12:00:00Z'),
+			('beta', '2', 'text/plain', '2023-05-01T12:00:00Z');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewSQLiteStorage(storage.SQLConfig{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	if _, err := client.PushBatch(ctx, &datastream.PushBatchRequest{Data: []*datastream.Data{
+		{Key: "alpha", Value: []byte("10")},
+		{Key: "gamma", Value: []byte("3")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.RollbackTo(ctx, &datastream.RollbackToRequest{Revision: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Changes) != 2 {
+		t.Errorf("RollbackTo changes = %v, want alpha restored and gamma deleted", resp.Changes)
+	}
+	want := map[string]string{"alpha": "1", "beta": "2"}
+	if got := values(t, store, "*"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("values = %v, want %v", got, want)
+	}
+}
+
+func TestRollbackPolicy(t *testing.T) {
+	policy, err := service.NewPolicy(service.PolicyConfig{Rules: []service.PolicyRule{
+		{Principals: []string{"*"}, Actions: []service.Action{service.ActionRead, service.ActionPush}, Keys: []string{"public/"}},
+		{Principals: []string{"*"}, Actions: []service.Action{service.ActionRead}, Keys: []string{"private/"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed: []storage.Data{{Key: "public/a", Value: []byte("1")}, {Key: "private/b", Value: []byte("1")}},
+	})
+	for _, data := range []storage.Data{{Key: "public/a", Value: []byte("2")}, {Key: "private/b", Value: []byte("2")}} {
+		if err := store.PushUpdate(context.Background(), &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := startServer(t, service.NewDataServiceServerWithConfig(store, service.DataServiceConfig{Policy: policy}))
+
+	if _, err := client.RollbackTo(context.Background(), &datastream.RollbackToRequest{Revision: 2}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("RollbackTo including a private key: %v, want PERMISSION_DENIED", err)
+	}
+	if got := values(t, store, "public/a"); got["public/a"] != "2" {
+		t.Errorf("denied rollback changed public/a to %s", got["public/a"])
+	}
+	if _, err := client.RollbackTo(context.Background(), &datastream.RollbackToRequest{Revision: 2, Keys: []string{"public/"}}); err != nil {
+		t.Errorf("RollbackTo of the public keys: %v", err)
+	}
+}
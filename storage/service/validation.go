@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bartke/datastream/codec"
+	"github.com/bartke/datastream/storage"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type ValidatorConfig struct {
+	// optional codecs values have to decode with, default is codec.Default
+	Codecs *codec.Registry
+
+	// optional JSON schemas by key or selector, values of matching keys have
+	// to be JSON or YAML documents valid against every matching schema
+	Schemas map[string][]byte
+}
+
+// Validator checks updates against the value type declared for their key and
+// the JSON schemas configured for it
+type Validator struct {
+	codecs  *codec.Registry
+	schemas []keySchema
+}
+
+type keySchema struct {
+	selector string
+	schema   *jsonschema.Schema
+}
+
+// NewValidator compiles the configured schemas
+func NewValidator(config ValidatorConfig) (*Validator, error) {
+	if config.Codecs == nil {
+		config.Codecs = codec.Default
+	}
+	v := &Validator{codecs: config.Codecs}
+
+	for selector, document := range config.Schemas {
+		schema, err := compileSchema(selector, document)
+		if err != nil {
+			return nil, err
+		}
+		v.schemas = append(v.schemas, keySchema{selector: selector, schema: schema})
+	}
+	sort.Slice(v.schemas, func(i, j int) bool {
+		return v.schemas[i].selector < v.schemas[j].selector
+	})
+	return v, nil
+}
+
+func compileSchema(name string, document []byte) (*jsonschema.Schema, error) {
+	url := "datastream:///" + strings.TrimPrefix(name, "/")
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(document)); err != nil {
+		return nil, fmt.Errorf("invalid schema for %s: %w", name, err)
+	}
+	schema, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema for %s: %w", name, err)
+	}
+	return schema, nil
+}
+
+// Validate checks data against the capability declared for its key, declared
+// may be nil for undeclared keys. An empty value type is replaced with the
+// declared one. Updates of read-only keys are rejected as PERMISSION_DENIED,
+// other violations are returned as INVALID_ARGUMENT status errors.
+func (v *Validator) Validate(data *storage.Data, declared *storage.Capability) error {
+	if declared != nil && declared.ReadOnly {
+		return status.Errorf(codes.PermissionDenied, "key %s is read-only", data.Key)
+	}
+	if data.Deleted {
+		return nil
+	}
+
+	if declared != nil && declared.ValueType != "" {
+		if data.ValueType == "" {
+			data.ValueType = declared.ValueType
+		}
+		if !v.compatible(declared.ValueType, data.ValueType) {
+			return status.Errorf(codes.InvalidArgument, "key %s is declared as %s, got value type %s", data.Key, declared.ValueType, data.ValueType)
+		}
+	}
+
+	if err := v.codecs.Validate(data.ValueType, data.Value); err != nil {
+		return status.Errorf(codes.InvalidArgument, "key %s: %v", data.Key, err)
+	}
+
+	for _, ks := range v.schemas {
+		if !storage.Match([]string{ks.selector}, data.Key) {
+			continue
+		}
+		document, err := v.document(data)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "key %s: value is not a JSON or YAML document: %v", data.Key, err)
+		}
+		if err := ks.schema.Validate(document); err != nil {
+			return status.Errorf(codes.InvalidArgument, "key %s: value does not match schema %s: %v", data.Key, ks.selector, describe(err))
+		}
+	}
+	return nil
+}
+
+// compatible reports whether a value of valueType may be stored under a key
+// declared as declared. Value types sharing a codec are equivalent, e.g. text
+// and text/plain, binary keys and keys declared with a type without a codec
+// accept any value.
+func (v *Validator) compatible(declared, valueType string) bool {
+	if declared == valueType {
+		return true
+	}
+	a, ok := v.codecs.Lookup(declared)
+	if !ok {
+		return true
+	}
+	if _, ok := a.(codec.Binary); ok {
+		return true
+	}
+	b, ok := v.codecs.Lookup(valueType)
+	return ok && reflect.TypeOf(a) == reflect.TypeOf(b)
+}
+
+// document decodes a value for schema validation, YAML values are converted to
+// their JSON equivalent
+func (v *Validator) document(data *storage.Data) (interface{}, error) {
+	var document interface{}
+	if err := v.codecs.Unmarshal(data.ValueType, data.Value, &document); err == nil {
+		// round trip through JSON to normalize YAML maps and numbers
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		document = nil
+		if err := json.Unmarshal(encoded, &document); err != nil {
+			return nil, err
+		}
+		return document, nil
+	}
+
+	// scalar types are validated as their JSON literal, e.g. int or bool
+	if err := json.Unmarshal(data.Value, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// describe flattens a schema validation error into a single line
+func describe(err error) string {
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err.Error()
+	}
+	var causes []string
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			location := e.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			causes = append(causes, location+": "+e.Message)
+		}
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(verr)
+	return strings.Join(causes, "; ")
+}
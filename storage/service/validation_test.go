@@ -0,0 +1,223 @@
+package service_test
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const limitSchema = `{
+	"type": "object",
+	"required": ["limit"],
+	"properties": {"limit": {"type": "integer", "minimum": 1}}
+}`
+
+func TestValidateDeclaredType(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryConfig{
+		Capabilities: []storage.Capability{{Key: "max_connections", ValueType: "int"}},
+	})
+	client := startServer(t, service.NewDataServiceServer(store))
+
+	tests := []struct {
+		value, valueType string
+		code             codes.Code
+	}{
+		{"abc", "int", codes.InvalidArgument},
+		{"true", "bool", codes.InvalidArgument},
+		{"20", "int", codes.OK},
+		{"30", "", codes.OK},
+	}
+	for _, tt := range tests {
+		_, err := client.PushUpdate(context.Background(), &datastream.Data{Key: "max_connections", Value: []byte(tt.value), ValueType: tt.valueType})
+		if status.Code(err) != tt.code {
+			t.Errorf("PushUpdate(%q, %q) = %v, want %s", tt.value, tt.valueType, err, tt.code)
+		}
+	}
+
+	// the declared type is filled in for updates without a value type
+	data, _, err := store.Sync(context.Background(), []string{"max_connections"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := data["max_connections"]; string(got.Value) != "30" || got.ValueType != "int" {
+		t.Errorf("stored %s as %q, want 30 as int", got.Value, got.ValueType)
+	}
+}
+
+func TestValidateUnknownDeclaredType(t *testing.T) {
+	validator, err := service.NewValidator(service.ValidatorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a declared type without a codec cannot be checked against the value type
+	data := storage.Data{Key: "config.toml", Value: []byte("limit = 5"), ValueType: "text/plain"}
+	if err := validator.Validate(&data, &storage.Capability{Key: "config.toml", ValueType: "toml"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	validator, err := service.NewValidator(service.ValidatorConfig{
+		Schemas: map[string][]byte{"services/": []byte(limitSchema)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, value, valueType string
+		valid                 bool
+	}{
+		{"services/payments", `{"limit": 5}`, "json", true},
+		{"services/payments", "limit: 5", "yaml", true},
+		{"services/payments", `{"limit": 0}`, "json", false},
+		{"services/payments", `{}`, "json", false},
+		{"services/payments", "plain", "text", false},
+		{"other", `{"limit": 0}`, "json", true},
+	}
+	for _, tt := range tests {
+		data := storage.Data{Key: tt.key, Value: []byte(tt.value), ValueType: tt.valueType}
+		err := validator.Validate(&data, nil)
+		if (err == nil) != tt.valid {
+			t.Errorf("Validate(%s=%s) = %v, want valid %v", tt.key, tt.value, err, tt.valid)
+		}
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Validate(%s=%s) = %v, want INVALID_ARGUMENT", tt.key, tt.value, err)
+		}
+	}
+
+	data := storage.Data{Key: "services/payments", Value: []byte(`{"limit": 0}`), ValueType: "json"}
+	if err := validator.Validate(&data, nil); !strings.Contains(err.Error(), "/limit") {
+		t.Errorf("error %q does not name the failing field", err)
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	_, err := service.NewValidator(service.ValidatorConfig{
+		Schemas: map[string][]byte{"alpha": []byte(`{"type": 5}`)},
+	})
+	if err == nil {
+		t.Fatal("NewValidator accepted an invalid schema")
+	}
+}
+
+// queryingStorage records the capability queries
+type queryingStorage struct {
+	storage.Storage
+	queries []storage.CapabilityQuery
+}
+
+func (q *queryingStorage) ListCapabilities(ctx context.Context, query storage.CapabilityQuery) ([]storage.Capability, string, error) {
+	q.queries = append(q.queries, query)
+	return q.Storage.ListCapabilities(ctx, query)
+}
+
+func TestValidateLooksUpBatchKeys(t *testing.T) {
+	store := &queryingStorage{Storage: storage.NewMemoryStorage(storage.MemoryConfig{
+		Seed:         []storage.Data{{Key: "limits/payments", Value: []byte("5")}, {Key: "limits/search", Value: []byte("5")}},
+		Capabilities: []storage.Capability{{Key: "limits/", ValueType: "int", ReadOnly: true}},
+	})}
+	client := startServer(t, service.NewDataServiceServer(store))
+	ctx := context.Background()
+
+	// existing keys are looked up without listing every capability
+	_, err := client.PushUpdate(ctx, &datastream.Data{Key: "limits/payments", Value: []byte("6")})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("PushUpdate of a read-only key = %v, want PERMISSION_DENIED", err)
+	}
+	want := []storage.CapabilityQuery{{Prefix: "limits/payments", PageSize: 1}}
+	if !reflect.DeepEqual(store.queries, want) {
+		t.Errorf("queries = %+v, want %+v", store.queries, want)
+	}
+
+	// new keys are covered by the selectors matching them
+	store.queries = nil
+	_, err = client.PushBatch(ctx, &datastream.PushBatchRequest{Data: []*datastream.Data{
+		{Key: "limits/new", Value: []byte("1")},
+		{Key: "limits/other", Value: []byte("1")},
+	}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("PushBatch of read-only keys = %v, want PERMISSION_DENIED", err)
+	}
+	want = []storage.CapabilityQuery{{Prefix: "limits/new", PageSize: 1}, {}}
+	if !reflect.DeepEqual(store.queries, want) {
+		t.Errorf("queries = %+v, want %+v", store.queries, want)
+	}
+}
+
+// initGitRepository creates a bare repository with a single initial commit
+func initGitRepository(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "remote.git")
+	if _, err := git.PlainInit(bare, true); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.PlainInit(filepath.Join(dir, "seed"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bare}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return bare
+}
+
+func TestValidateGitRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary required for the local file transport")
+	}
+	store, err := storage.NewGitRepository(storage.GitRepositoryConfig{RepoPath: initGitRepository(t), CloneDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = store.PushBatch(ctx, []storage.Data{
+		{Key: "limits.json", Value: []byte(`{"limit": 5}`)},
+		{Key: "config.toml", Value: []byte("limit = 5")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startServer(t, service.NewDataServiceServer(store))
+
+	// values pushed back as they were read match the capabilities of the files
+	resp, err := client.Sync(ctx, &datastream.DataRequest{Keys: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 {
+		t.Fatalf("Sync = %v, want limits.json and config.toml", resp.Data)
+	}
+	for key, data := range resp.Data {
+		if _, err := client.PushUpdate(ctx, &datastream.Data{Key: key, Value: data.Value, ValueType: data.ValueType}); err != nil {
+			t.Errorf("PushUpdate(%s as %s): %v", key, data.ValueType, err)
+		}
+	}
+}
@@ -1,24 +1,48 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 	"time"
+
+	"github.com/bartke/datastream/internal/sqlutil"
+	"github.com/bartke/datastream/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultTable is the table used when SQLConfig.Table is empty
+const DefaultTable = "data"
+
+// SQLTable implements the Storage interface for a SQL table. Every change to
+// the table is recorded by triggers in a "<table>_log" change log whose
+// auto-incrementing id serves as the store revision. Capability metadata is
+// read from the "<table>_meta" sidecar table, its rows declare keys or
+// selectors with a description, read-only flag, default value, schema
+// reference, owner and comma separated tags.
 type SQLTable struct {
 	db    *sql.DB
 	table string
+	log   string
+	meta  string
+	// system is the database system attribute of spans
+	system attribute.KeyValue
+	// postgres rebinds ? placeholders to $1, $2, ...
+	postgres bool
 
 	syncInterval time.Duration
 	errorChannel chan<- error
+	metrics      *metrics.Metrics
 }
 
 type SQLConfig struct {
 	// DB is the database connection to use
 	DB *sql.DB
 
-	// Table is the name of the table to use for storing data
+	// Table is the name of the table to use for storing data, default is "data"
 	Table string
 
 	// SyncInterval is the interval at which the storage will sync to disk
@@ -26,6 +50,9 @@ type SQLConfig struct {
 
 	// Optional
 	ErrorChan chan<- error
+
+	// optional metrics of the change log polls
+	Metrics *metrics.Metrics
 }
 
 func (s *SQLTable) forwardError(err error) {
@@ -34,35 +61,241 @@ func (s *SQLTable) forwardError(err error) {
 	}
 }
 
-func (s *SQLTable) ListCapabilities() ([]Capability, error) {
-	rows, err := s.db.Query("SELECT key, value_type FROM data")
+// placeholders returns a comma separated list of n query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func keyParams(keys []string) []interface{} {
+	params := make([]interface{}, len(keys))
+	for i, key := range keys {
+		params[i] = key
+	}
+	return params
+}
+
+// keyFilter returns a condition on column selecting keys, selectors are
+// narrowed down by their literal prefix and need to be matched exactly with
+// Match on the results
+func keyFilter(column string, keys []string) (string, []interface{}) {
+	exact, selectors := splitSelectors(keys)
+	var conditions []string
+	params := keyParams(exact)
+	if len(exact) > 0 {
+		conditions = append(conditions, column+" IN ("+placeholders(len(exact))+")")
+	}
+	for _, selector := range selectors {
+		conditions = append(conditions, column+" LIKE ? ESCAPE '!'")
+		params = append(params, sqlutil.LikeEscaper.Replace(SelectorPrefix(selector))+"%")
+	}
+	if len(conditions) == 0 {
+		return "1 = 0", nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", params
+}
+
+// parseTimestamp parses both RFC3339 timestamps written by PushUpdate and the
+// SQL default CURRENT_TIMESTAMP format
+func parseTimestamp(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+func newSQLTable(config SQLConfig, system attribute.KeyValue, schema string) (*SQLTable, error) {
+	if config.SyncInterval == 0 {
+		config.SyncInterval = DefaultSyncInterval
+	}
+
+	s := &SQLTable{
+		db:           config.DB,
+		table:        config.Table,
+		log:          config.Table + "_log",
+		meta:         config.Table + "_meta",
+		system:       system,
+		postgres:     system == semconv.DBSystemPostgreSQL,
+		syncInterval: config.SyncInterval,
+		errorChannel: config.ErrorChan,
+		metrics:      config.Metrics,
+	}
+
+	// create the change log table and the triggers feeding it
+	if _, err := s.db.Exec(strings.ReplaceAll(schema, "{table}", s.table)); err != nil {
+		return nil, fmt.Errorf("failed to create change log for table %s: %w", s.table, err)
+	}
+
+	return s, nil
+}
+
+// ListCapabilities pages through the keys of the data and metadata tables in
+// key order, starting after the last key of the previous page
+func (s *SQLTable) ListCapabilities(ctx context.Context, query CapabilityQuery) ([]Capability, string, error) {
+	after, err := query.after()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	declared, err := s.declaredCapabilities(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	declared = byPrecedence(declared)
+
+	var result []Capability
+	for {
+		// fetch one more row than needed to tell whether there is a next page
+		sqlQuery := "SELECT k.key, d.value_type FROM (SELECT key FROM " + s.table + " UNION SELECT key FROM " + s.meta + ") k" +
+			" LEFT JOIN " + s.table + " d ON d.key = k.key WHERE k.key > ? AND k.key LIKE ? ESCAPE '!' ORDER BY k.key"
+		params := []interface{}{after, sqlutil.LikeEscaper.Replace(query.Prefix) + "%"}
+		limit := 0
+		if query.PageSize > 0 {
+			limit = query.PageSize - len(result) + 1
+			sqlQuery += " LIMIT ?"
+			params = append(params, limit)
+		}
+
+		rows, err := s.query(ctx, s.db, sqlQuery, params...)
+		if err != nil {
+			return nil, "", err
+		}
+		n := 0
+		for rows.Next() {
+			var valueType sql.NullString
+			if err := rows.Scan(&after, &valueType); err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			n++
+			capability := declare(declared, Capability{Key: after, ValueType: valueType.String})
+			if !query.matches(capability) {
+				continue
+			}
+			if query.full(len(result)) {
+				rows.Close()
+				return result, pageToken(result[len(result)-1].Key), nil
+			}
+			result = append(result, capability)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, "", err
+		}
+		if limit == 0 || n < limit {
+			return result, "", nil
+		}
+	}
+}
+
+// declaredCapabilities reads the metadata table
+func (s *SQLTable) declaredCapabilities(ctx context.Context) ([]Capability, error) {
+	rows, err := s.query(ctx, s.db, "SELECT key, value_type, description, read_only, default_value, schema_ref, owner, tags FROM "+s.meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata table %s: %w", s.meta, err)
 	}
 	defer rows.Close()
 	var capabilities []Capability
 	for rows.Next() {
 		var capability Capability
-		if err := rows.Scan(&capability.Key, &capability.ValueType); err != nil {
+		var valueType, description, schema, owner, tags sql.NullString
+		if err := rows.Scan(&capability.Key, &valueType, &description, &capability.ReadOnly, &capability.Default, &schema, &owner, &tags); err != nil {
 			return nil, err
 		}
+		capability.ValueType = valueType.String
+		capability.Description = description.String
+		capability.Schema = schema.String
+		capability.Owner = owner.String
+		capability.Tags = parseTags(tags.String)
 		capabilities = append(capabilities, capability)
 	}
-	return capabilities, nil
+	return capabilities, rows.Err()
 }
 
-func (s *SQLTable) Sync(keys []string) (map[string]Data, error) {
-	query := "SELECT key, value, value_type, updated_at FROM data WHERE key IN ("
-	params := make([]interface{}, len(keys))
-	for i, key := range keys {
-		if i > 0 {
-			query += ","
+func (s *SQLTable) Sync(ctx context.Context, keys []string) (map[string]Data, int64, error) {
+	// read the data and the revision from the same snapshot
+	tx, err := s.readTx(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	filter, params := keyFilter("d.key", keys)
+	query := "SELECT d.key, d.value, d.value_type, d.updated_at, l.revision, l.version FROM " + s.table + " d" +
+		" LEFT JOIN " + s.log + " l ON l.revision = (SELECT MAX(revision) FROM " + s.log + " WHERE key = d.key)" +
+		" WHERE " + filter
+	rows, err := s.query(ctx, tx, query, params...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make(map[string]Data)
+	for rows.Next() {
+		var data Data
+		var updatedAtString string
+		var revision, version sql.NullInt64
+		if err := rows.Scan(&data.Key, &data.Value, &data.ValueType, &updatedAtString, &revision, &version); err != nil {
+			return nil, 0, err
 		}
-		query += "?"
-		params[i] = key
+		data.UpdatedAt, err = parseTimestamp(updatedAtString)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !Match(keys, data.Key) {
+			continue
+		}
+		data.Revision = revision.Int64
+		data.Version = version.Int64
+		result[data.Key] = data
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	revision, err := s.revision(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, revision, nil
+}
+
+// SyncAt replays the change log up to the last change made at or before
+// asOf, which is looked up by the changed_at timestamps of the log
+func (s *SQLTable) SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, int64, error) {
+	tx, err := s.readTx(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	revision, err := s.revisionAt(ctx, tx, asOf)
+	if err != nil {
+		return nil, 0, err
 	}
-	query += ")"
-	rows, err := s.db.Query(query, params...)
+	result, err := s.syncRevision(ctx, tx, keys, revision)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, revision, nil
+}
+
+func (s *SQLTable) SyncRevision(ctx context.Context, keys []string, revision int64) (map[string]Data, error) {
+	tx, err := s.readTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return s.syncRevision(ctx, tx, keys, revision)
+}
+
+// syncRevision reads the last change of every key at or before revision from
+// the change log
+func (s *SQLTable) syncRevision(ctx context.Context, tx *sql.Tx, keys []string, revision int64) (map[string]Data, error) {
+	filter, params := keyFilter("l.key", keys)
+	query := "SELECT l.revision, l.key, l.value, l.value_type, l.updated_at, l.version FROM " + s.log + " l" +
+		" WHERE l.revision = (SELECT MAX(revision) FROM " + s.log + " WHERE key = l.key AND revision <= ?)" +
+		" AND NOT l.deleted AND " + filter
+	rows, err := s.query(ctx, tx, query, append([]interface{}{revision}, params...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -70,72 +303,336 @@ func (s *SQLTable) Sync(keys []string) (map[string]Data, error) {
 	result := make(map[string]Data)
 	for rows.Next() {
 		var data Data
-		var updatedAtString string
-		if err := rows.Scan(&data.Key, &data.Value, &data.ValueType, &updatedAtString); err != nil {
+		var valueType, updatedAtString sql.NullString
+		if err := rows.Scan(&data.Revision, &data.Key, &data.Value, &valueType, &updatedAtString, &data.Version); err != nil {
 			return nil, err
 		}
-		data.UpdatedAt, err = time.Parse(time.RFC3339, updatedAtString)
+		if !Match(keys, data.Key) {
+			continue
+		}
+		data.ValueType = valueType.String
+		data.UpdatedAt, err = parseTimestamp(updatedAtString.String)
 		if err != nil {
 			return nil, err
 		}
 		result[data.Key] = data
 	}
-	return result, nil
+	return result, rows.Err()
+}
+
+// revisionAt returns the revision of the last change made at or before asOf
+func (s *SQLTable) revisionAt(ctx context.Context, tx *sql.Tx, asOf time.Time) (int64, error) {
+	var revision int64
+	err := s.queryRow(ctx, tx, "SELECT revision FROM "+s.log+" WHERE changed_at <= ? ORDER BY revision DESC LIMIT 1", asOf.UnixNano()).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return revision, err
+}
+
+// History reads the versions of key from the change log
+func (s *SQLTable) History(ctx context.Context, key string, limit int) ([]Data, error) {
+	query := "SELECT revision, key, value, value_type, updated_at, version, deleted FROM " + s.log +
+		" WHERE key = ? ORDER BY revision DESC"
+	params := []interface{}{key}
+	if limit > 0 {
+		query += " LIMIT ?"
+		params = append(params, limit)
+	}
+	rows, err := s.query(ctx, s.db, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []Data
+	for rows.Next() {
+		var data Data
+		var valueType, updatedAtString sql.NullString
+		if err := rows.Scan(&data.Revision, &data.Key, &data.Value, &valueType, &updatedAtString, &data.Version, &data.Deleted); err != nil {
+			return nil, err
+		}
+		data.ValueType = valueType.String
+		data.UpdatedAt, err = parseTimestamp(updatedAtString.String)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, data)
+	}
+	return versions, rows.Err()
+}
+
+// readTx begins a read-only transaction whose statements all read the same
+// snapshot, which Postgres only guarantees from repeatable read isolation on
+func (s *SQLTable) readTx(ctx context.Context) (*sql.Tx, error) {
+	options := &sql.TxOptions{ReadOnly: true}
+	if s.postgres {
+		options.Isolation = sql.LevelRepeatableRead
+	}
+	return s.db.BeginTx(ctx, options)
+}
+
+// rebind replaces ? placeholders for postgres
+func (s *SQLTable) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	return sqlutil.Rebind(query)
+}
+
+// querier runs statements on the database or in a transaction
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// query, queryRow and exec run a statement written with ? placeholders in a
+// span named by its verb and the table, e.g. "SELECT data"
+func (s *SQLTable) query(ctx context.Context, q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	query = s.rebind(query)
+	ctx, span := s.startSpan(ctx, query)
+	rows, err := q.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (s *SQLTable) queryRow(ctx context.Context, q querier, query string, args ...interface{}) *sql.Row {
+	query = s.rebind(query)
+	ctx, span := s.startSpan(ctx, query)
+	row := q.QueryRowContext(ctx, query, args...)
+	endSpan(span, row.Err())
+	return row
+}
+
+func (s *SQLTable) exec(ctx context.Context, q querier, query string, args ...interface{}) (sql.Result, error) {
+	query = s.rebind(query)
+	ctx, span := s.startSpan(ctx, query)
+	result, err := q.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s *SQLTable) startSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	verb, _, _ := strings.Cut(query, " ")
+	return tracer.Start(ctx, verb+" "+s.table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			s.system,
+			semconv.DBSQLTableKey.String(s.table),
+			semconv.DBStatementKey.String(query),
+		),
+	)
+}
+
+// revision returns the current store revision
+func (s *SQLTable) revision(ctx context.Context, q querier) (int64, error) {
+	var revision sql.NullInt64
+	if err := s.queryRow(ctx, q, "SELECT MAX(revision) FROM "+s.log).Scan(&revision); err != nil {
+		return 0, err
+	}
+	return revision.Int64, nil
 }
 
-func (s *SQLTable) Subscribe(keys []string) (<-chan Data, error) {
-	dataChannel := make(chan Data)
+func (s *SQLTable) Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []Data, error) {
+	dataChannel := make(chan []Data)
 
-	var last time.Time
 	go func() {
-		// Continuously poll the database for changes in the specified keys
-		for {
-			timeFormat := "2006-01-02 15:04:05"
-			since := last.Format(timeFormat)
+		defer close(dataChannel)
 
-			rows, err := s.db.Query("SELECT key, value, value_type, updated_at FROM "+s.table+" WHERE key IN (?) and updated_at > ?", strings.Join(keys, ","), since)
-			if err != nil {
-				s.forwardError(err)
-				break
+		send := func(group []Data) bool {
+			select {
+			case dataChannel <- group:
+				return true
+			case <-ctx.Done():
+				return false
 			}
-			defer rows.Close()
+		}
 
-			for rows.Next() {
-				var data Data
-				var updatedAtString string
-				if err := rows.Scan(&data.Key, &data.Value, &data.ValueType, &updatedAtString); err != nil {
-					s.forwardError(err)
-					continue
-				}
-				data.UpdatedAt, err = time.Parse(time.RFC3339, updatedAtString)
-				if err != nil {
+		last := fromRevision - 1
+		if fromRevision == 0 {
+			// deliver the initial state and follow the change log from there
+			current, revision, err := s.Sync(ctx, keys)
+			if err != nil {
+				if ctx.Err() == nil {
 					s.forwardError(err)
-					continue
 				}
-				// if last is zero or the updated_at is after last, update last
-				if last.IsZero() || data.UpdatedAt.After(last) {
-					last = data.UpdatedAt
+				return
+			}
+			if !send(sortedByKey(current)) {
+				return
+			}
+			last = revision
+		}
+
+		// Continuously poll the change log for changes in the specified keys,
+		// a batch is committed in one transaction and thus seen by one poll
+		for {
+			start := time.Now()
+			changes, err := s.changesSince(ctx, keys, last)
+			if ctx.Err() != nil {
+				return
+			}
+			s.metrics.ObservePoll("sql", start, err)
+			if err != nil {
+				s.forwardError(err)
+				return
+			}
+
+			if len(changes) > 0 {
+				if !send(changes) {
+					return
 				}
-				dataChannel <- data
+				last = changes[len(changes)-1].Revision
 			}
 
-			<-time.After(s.syncInterval)
+			select {
+			case <-time.After(s.syncInterval):
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(dataChannel)
 	}()
 
 	return dataChannel, nil
 }
 
-func (s *SQLTable) PushUpdate(data *Data) error {
-	tx, err := s.db.Begin()
+// changesSince returns the changes to the specified keys after the given
+// revision in revision order
+func (s *SQLTable) changesSince(ctx context.Context, keys []string, revision int64) ([]Data, error) {
+	filter, params := keyFilter("key", keys)
+	query := "SELECT revision, key, value, value_type, updated_at, version, deleted FROM " + s.log +
+		" WHERE revision > ? AND " + filter + " ORDER BY revision"
+	rows, err := s.query(ctx, s.db, query, append([]interface{}{revision}, params...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Data
+	for rows.Next() {
+		var data Data
+		var valueType, updatedAtString sql.NullString
+		if err := rows.Scan(&data.Revision, &data.Key, &data.Value, &valueType, &updatedAtString, &data.Version, &data.Deleted); err != nil {
+			return nil, err
+		}
+		if !Match(keys, data.Key) {
+			continue
+		}
+		data.ValueType = valueType.String
+		data.UpdatedAt, err = parseTimestamp(updatedAtString.String)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, data)
+	}
+	return changes, rows.Err()
+}
+
+func (s *SQLTable) PushUpdate(ctx context.Context, data *Data) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	_, err = tx.Exec("INSERT OR REPLACE INTO data (key, value, value_type, updated_at) VALUES (?, ?, ?, ?)", data.Key, data.Value, data.ValueType, data.UpdatedAt.Format(time.RFC3339))
+	if err := s.write(ctx, tx, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLTable) PushBatch(ctx context.Context, batch []Data) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+	for i := range batch {
+		if err := s.write(ctx, tx, &batch[i]); err != nil {
+			return err
+		}
+	}
 	return tx.Commit()
 }
+
+// write stores data within tx, conditional writes are expressed as a single
+// statement so that concurrent writers cannot interleave
+func (s *SQLTable) write(ctx context.Context, tx *sql.Tx, data *Data) error {
+	updatedAt := data.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+	timestamp := updatedAt.UTC().Format(time.RFC3339Nano)
+
+	if data.Deleted {
+		return s.remove(ctx, tx, data)
+	}
+
+	if data.ExpectedRevision == nil {
+		_, err := s.exec(ctx, tx, "INSERT INTO "+s.table+" (key, value, value_type, updated_at) VALUES (?, ?, ?, ?)"+
+			" ON CONFLICT (key) DO UPDATE SET value = excluded.value, value_type = excluded.value_type, updated_at = excluded.updated_at",
+			data.Key, data.Value, data.ValueType, timestamp)
+		return err
+	}
+
+	var result sql.Result
+	var err error
+	if *data.ExpectedRevision == 0 {
+		result, err = s.exec(ctx, tx, "INSERT INTO "+s.table+" (key, value, value_type, updated_at) VALUES (?, ?, ?, ?) ON CONFLICT (key) DO NOTHING",
+			data.Key, data.Value, data.ValueType, timestamp)
+	} else {
+		result, err = s.exec(ctx, tx, "UPDATE "+s.table+" SET value = ?, value_type = ?, updated_at = ? WHERE key = ?"+
+			" AND (SELECT MAX(revision) FROM "+s.log+" WHERE key = ?) = ?",
+			data.Value, data.ValueType, timestamp, data.Key, data.Key, *data.ExpectedRevision)
+	}
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 1 {
+		return err
+	}
+	return s.mismatch(ctx, tx, data)
+}
+
+// remove deletes the key of data within tx, honoring its expected revision
+func (s *SQLTable) remove(ctx context.Context, tx *sql.Tx, data *Data) error {
+	if data.ExpectedRevision == nil {
+		_, err := s.exec(ctx, tx, "DELETE FROM "+s.table+" WHERE key = ?", data.Key)
+		return err
+	}
+
+	result, err := s.exec(ctx, tx, "DELETE FROM "+s.table+" WHERE key = ?"+
+		" AND (SELECT MAX(revision) FROM "+s.log+" WHERE key = ?) = ?",
+		data.Key, data.Key, *data.ExpectedRevision)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 1 {
+		return err
+	}
+	return s.mismatch(ctx, tx, data)
+}
+
+// mismatch reports why the conditional write of data did not apply, deleting
+// a missing key that was expected to be missing is not an error
+func (s *SQLTable) mismatch(ctx context.Context, tx *sql.Tx, data *Data) error {
+	var revision sql.NullInt64
+	var exists bool
+	err := s.queryRow(ctx, tx, "SELECT (SELECT MAX(revision) FROM "+s.log+" WHERE key = ?), EXISTS (SELECT 1 FROM "+s.table+" WHERE key = ?)",
+		data.Key, data.Key).Scan(&revision, &exists)
+	if err != nil {
+		return err
+	}
+	if err := checkRevision(data, Data{Revision: revision.Int64}, exists); err != nil {
+		return err
+	}
+	if data.Deleted && !exists {
+		return nil
+	}
+	return fmt.Errorf("%w: key %s was modified concurrently", ErrRevisionMismatch, data.Key)
+}
+
+func (s *SQLTable) Delete(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, s.db, "DELETE FROM "+s.table+" WHERE key = ?", key)
+	return err
+}
@@ -1,5 +1,251 @@
 package storage_test
 
-import "github.com/bartke/datastream/storage"
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/metrics"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/storagetest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
 
 var _ storage.Storage = &storage.SQLTable{}
+
+// newSQLiteStorage creates a storage on a fresh database with a data table
+func newSQLiteStorage(t *testing.T) (*sql.DB, storage.Storage) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE data (
+		key TEXT PRIMARY KEY,
+		value BLOB,
+		value_type TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.NewSQLiteStorage(storage.SQLConfig{
+		DB:           db,
+		SyncInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, store
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		_, store := newSQLiteStorage(t)
+		return store
+	})
+}
+
+func TestSQLiteCapabilityMetadata(t *testing.T) {
+	db, store := newSQLiteStorage(t)
+	ctx := context.Background()
+
+	err := store.PushUpdate(ctx, &storage.Data{Key: "limits/payments", Value: []byte("5"), ValueType: "int"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO data_meta (key, value_type, description, read_only, default_value, schema_ref, owner, tags) VALUES
+		('limits/', NULL, 'rate limits', 0, NULL, NULL, 'platform', 'limits, rates'),
+		('maintenance', 'bool', 'maintenance mode', 1, 'false', 'schemas/bool.json', NULL, NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities, _, err := store.ListCapabilities(ctx, storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Capability{
+		{Key: "limits/", Description: "rate limits", Owner: "platform", Tags: []string{"limits", "rates"}},
+		{Key: "limits/payments", ValueType: "int", Description: "rate limits", Owner: "platform", Tags: []string{"limits", "rates"}},
+		{Key: "maintenance", ValueType: "bool", Description: "maintenance mode", ReadOnly: true, Default: []byte("false"), Schema: "schemas/bool.json"},
+	}
+	if !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("ListCapabilities = %+v, want %+v", capabilities, want)
+	}
+}
+
+func TestSQLitePollMetrics(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE data (key TEXT PRIMARY KEY, value BLOB, value_type TEXT, updated_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Config{Registry: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewSQLiteStorage(storage.SQLConfig{DB: db, SyncInterval: 10 * time.Millisecond, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := store.Subscribe(ctx, []string{"alpha"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+
+	// a poll fails once the change log is gone, which ends the subscription
+	if _, err := db.Exec(`DROP TABLE data_log`); err != nil {
+		t.Fatal(err)
+	}
+	for range updates {
+	}
+	want := `
+# HELP datastream_backend_poll_errors_total Failed polls of storage backends.
+# TYPE datastream_backend_poll_errors_total counter
+datastream_backend_poll_errors_total{backend="sql"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "datastream_backend_poll_errors_total"); err != nil {
+		t.Error(err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "datastream_backend_poll_duration_seconds"); err != nil || n != 1 {
+		t.Errorf("got %d poll duration series, %v, want 1", n, err)
+	}
+}
+
+func TestSQLiteChangedAt(t *testing.T) {
+	db, store := newSQLiteStorage(t)
+	ctx := context.Background()
+
+	// changed_at holds the time a change was logged with millisecond
+	// precision, whatever its update time
+	before := time.Now().Truncate(time.Millisecond)
+	updatedAt := time.Date(2023, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	if err := store.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte("1"), UpdatedAt: updatedAt}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO data (key, value, value_type) VALUES ('beta', '1', 'text/plain')`); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	for _, key := range []string{"alpha", "beta"} {
+		var changedAt int64
+		if err := db.QueryRow(`SELECT changed_at FROM data_log WHERE key = ?`, key).Scan(&changedAt); err != nil {
+			t.Fatal(err)
+		}
+		if changed := time.Unix(0, changedAt); changed.Before(before) || changed.After(after) {
+			t.Errorf("changed_at of %s = %s, want between %s and %s", key, changed, before, after)
+		}
+	}
+}
+
+func TestSQLiteChangedAtMigration(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a change log written before changed_at was introduced
+	_, err = db.Exec(`
+		CREATE TABLE data (key TEXT PRIMARY KEY, value BLOB, value_type TEXT, updated_at DATETIME);
+		CREATE TABLE data_log (
+			revision INTEGER PRIMARY KEY AUTOINCREMENT,
+			key TEXT NOT NULL,
+			value BLOB,
+			value_type TEXT,
+			updated_at TEXT,
+			version INTEGER NOT NULL,
+			deleted INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO data VALUES ('alpha', '2', 'text/plain', '2023-05-01T13:00:00Z');
+		INSERT INTO data_log (key, value, value_type, updated_at, version) VALUES
+			('alpha', '1', 'text/plain', '2023-05-01T12:00:00.5Z', 1),
+			('alpha', '2', 'text/plain', '2023-05-01T13:00:00Z', 2);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewSQLiteStorage(storage.SQLConfig{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, revision, err := store.SyncAt(context.Background(), []string{"alpha"}, time.Date(2023, 5, 1, 12, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["alpha"].Value) != "1" || revision != 1 {
+		t.Errorf("SyncAt = %v at revision %d, want alpha=1 at revision 1", data, revision)
+	}
+}
+
+func TestSQLitePopulatedTable(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// rows written before the change log existed
+	_, err = db.Exec(`
+		CREATE TABLE data (key TEXT PRIMARY KEY, value BLOB, value_type TEXT, updated_at DATETIME);
+		INSERT INTO data VALUES
+			('alpha', '1', 'text/plain', '2023-05-01T12:00:00Z'),
+			('beta', '2', 'text/plain', '2023-05-01T13:00:00Z');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opening the table again does not log the rows twice
+	var store storage.Storage
+	for i := 0; i < 2; i++ {
+		if store, err = storage.NewSQLiteStorage(storage.SQLConfig{DB: db}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	data, revision, err := store.Sync(ctx, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["alpha"].Revision != 1 || data["alpha"].Version != 1 || data["beta"].Revision != 2 || revision != 2 {
+		t.Fatalf("Sync = %v at revision %d, want alpha and beta at revisions 1 and 2", data, revision)
+	}
+
+	expected := data["alpha"].Revision
+	if err := store.PushUpdate(ctx, &storage.Data{Key: "alpha", Value: []byte("3"), ExpectedRevision: &expected}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := store.History(ctx, "alpha", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || string(versions[1].Value) != "1" || versions[1].Revision != 1 {
+		t.Errorf("History = %v, want versions 1 and 3 of alpha", versions)
+	}
+	past, err := store.SyncRevision(ctx, []string{"*"}, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(past) != 2 || string(past["alpha"].Value) != "1" || string(past["beta"].Value) != "2" {
+		t.Errorf("SyncRevision = %v, want alpha=1 and beta=2", past)
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
 // NewSQLiteStorage creates a new instance of a SQLite-based storage implementation
 func NewSQLiteStorage(config SQLConfig) (Storage, error) {
+	if config.Table == "" {
+		config.Table = DefaultTable
+	}
+
 	if err := config.DB.Ping(); err != nil {
 		return nil, err
 	}
@@ -52,14 +57,98 @@ func NewSQLiteStorage(config SQLConfig) (Storage, error) {
 		return nil, fmt.Errorf("table %s does not have a column named 'updated_at'", config.Table)
 	}
 
-	if config.SyncInterval == 0 {
-		config.SyncInterval = DefaultSyncInterval
+	// change logs created before changed_at was introduced lack the column,
+	// sqliteLogSchema fills it in
+	var logs, columns int
+	err = config.DB.QueryRow("SELECT COUNT(*), (SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'changed_at') FROM sqlite_master WHERE type='table' AND name=?",
+		config.Table+"_log", config.Table+"_log").Scan(&logs, &columns)
+	if err != nil {
+		return nil, err
+	}
+	if logs == 1 && columns == 0 {
+		if _, err := config.DB.Exec("ALTER TABLE " + config.Table + "_log ADD COLUMN changed_at INTEGER"); err != nil {
+			return nil, fmt.Errorf("failed to add changed_at to the change log of table %s: %w", config.Table, err)
+		}
 	}
 
-	return &SQLTable{
-		db:           config.DB,
-		table:        config.Table,
-		syncInterval: config.SyncInterval,
-		errorChannel: config.ErrorChan,
-	}, nil
+	return newSQLTable(config, semconv.DBSystemSqlite, sqliteLogSchema)
 }
+
+// sqliteLogSchema creates the change log and the metadata table of a table,
+// {table} is replaced by the table name. The changed_at column holds the time
+// a change was logged as Unix nanoseconds to look up revisions by time, it is
+// set with millisecond precision by the {table}_log_changed_at trigger as
+// updated_at is set by clients. Rows written before the change log existed are
+// logged as their first version at their updated_at time when the log is
+// empty, as are changes logged before changed_at was introduced.
+const sqliteLogSchema = `
+	CREATE TABLE IF NOT EXISTS {table}_meta (
+		key TEXT PRIMARY KEY,
+		value_type TEXT,
+		description TEXT,
+		read_only INTEGER NOT NULL DEFAULT 0,
+		default_value BLOB,
+		schema_ref TEXT,
+		owner TEXT,
+		tags TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS {table}_log (
+		revision INTEGER PRIMARY KEY AUTOINCREMENT,
+		key TEXT NOT NULL,
+		value BLOB,
+		value_type TEXT,
+		updated_at TEXT,
+		version INTEGER NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0,
+		changed_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS {table}_log_key ON {table}_log (key, revision);
+	CREATE INDEX IF NOT EXISTS {table}_log_changed_at ON {table}_log (changed_at);
+
+	UPDATE {table}_log SET changed_at = ` + sqliteChangedAt + ` WHERE changed_at IS NULL;
+
+	DROP TRIGGER IF EXISTS {table}_log_changed_at;
+	CREATE TRIGGER {table}_log_changed_at
+	AFTER INSERT ON {table}_log WHEN new.changed_at IS NULL
+	BEGIN
+		UPDATE {table}_log SET changed_at = CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER) * 1000000
+		WHERE revision = new.revision;
+	END;
+
+	INSERT INTO {table}_log (key, value, value_type, updated_at, version, changed_at)
+	SELECT key, value, value_type, COALESCE(updated_at, strftime('%Y-%m-%dT%H:%M:%fZ', 'now')), 1, ` + sqliteChangedAt + `
+	FROM {table} WHERE NOT EXISTS (SELECT 1 FROM {table}_log) ORDER BY key;
+
+	CREATE TRIGGER IF NOT EXISTS {table}_log_insert
+	AFTER INSERT ON {table}
+	BEGIN
+		INSERT INTO {table}_log (key, value, value_type, updated_at, version)
+		VALUES (new.key, new.value, new.value_type, new.updated_at, COALESCE(
+			(SELECT CASE WHEN deleted THEN 0 ELSE version END FROM {table}_log WHERE key = new.key ORDER BY revision DESC LIMIT 1), 0) + 1);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS {table}_log_update
+	AFTER UPDATE ON {table}
+	BEGIN
+		INSERT INTO {table}_log (key, value, value_type, updated_at, version)
+		VALUES (new.key, new.value, new.value_type, new.updated_at, COALESCE(
+			(SELECT CASE WHEN deleted THEN 0 ELSE version END FROM {table}_log WHERE key = new.key ORDER BY revision DESC LIMIT 1), 0) + 1);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS {table}_log_delete
+	AFTER DELETE ON {table}
+	BEGIN
+		INSERT INTO {table}_log (key, updated_at, version, deleted)
+		VALUES (old.key, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'), 0, 1);
+	END;
+`
+
+// sqliteChangedAt converts an updated_at column in the RFC3339 or the
+// CURRENT_TIMESTAMP format to Unix nanoseconds, fractions of a second are
+// optional
+const sqliteChangedAt = `CAST(strftime('%s', substr(updated_at, 1, 19)) AS INTEGER) * 1000000000 +
+		CASE WHEN substr(updated_at, 20, 1) = '.'
+		THEN CAST(substr(rtrim(substr(updated_at, 21), 'Z') || '000000000', 1, 9) AS INTEGER)
+		ELSE 0 END`
@@ -1,12 +1,55 @@
 package storage
 
-import "time"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 const DefaultSyncInterval = 5 * time.Second
 
+var (
+	// ErrRevisionMismatch is returned by conditional writes when the current
+	// revision of a key differs from the expected revision
+	ErrRevisionMismatch = errors.New("revision mismatch")
+
+	// ErrInvalidPageToken is returned by ListCapabilities for page tokens it
+	// did not issue
+	ErrInvalidPageToken = errors.New("invalid page token")
+
+	// ErrReservedKey is returned by writes to keys a backend uses for its own
+	// bookkeeping, e.g. the git manifest
+	ErrReservedKey = errors.New("reserved key")
+)
+
 type Capability struct {
 	Key       string
 	ValueType string
+
+	// optional metadata describing the key
+	Description string
+	// ReadOnly keys are maintained by the backend and reject updates
+	ReadOnly bool
+	// Default is the value clients should assume while the key is not set
+	Default []byte
+	// Schema references the schema values of the key are validated against
+	Schema string
+	Owner  string
+	Tags   []string
+}
+
+// CapabilityQuery filters and pages the result of ListCapabilities
+type CapabilityQuery struct {
+	// optional key prefix
+	Prefix string
+	// optional tags, listed capabilities carry all of them
+	Tags []string
+
+	// optional maximum number of capabilities per page, zero lists all
+	PageSize int
+	// optional token returned with the previous page
+	PageToken string
 }
 
 type Data struct {
@@ -14,18 +57,86 @@ type Data struct {
 	Value     []byte
 	ValueType string
 	UpdatedAt time.Time
+
+	// Deleted marks a tombstone sent to subscribers when a key is removed
+	Deleted bool
+
+	// Revision is the global store revision at which the key was last
+	// modified, revisions increase monotonically across all keys
+	Revision int64
+	// Version is the per-key revision, it starts at 1 when a key is created,
+	// increases with every update and resets when the key is deleted
+	Version int64
+
+	// ExpectedRevision makes PushUpdate conditional on the current revision
+	// of the key, zero requires the key to not exist
+	ExpectedRevision *int64
+}
+
+// checkRevision verifies the precondition of data against the current state
+// of the key
+func checkRevision(data *Data, current Data, exists bool) error {
+	if data.ExpectedRevision == nil {
+		return nil
+	}
+	if !exists {
+		current.Revision = 0
+	}
+	if *data.ExpectedRevision != current.Revision || (*data.ExpectedRevision == 0 && exists) {
+		return fmt.Errorf("%w: key %s is at revision %d, expected %d", ErrRevisionMismatch, data.Key, current.Revision, *data.ExpectedRevision)
+	}
+	return nil
 }
 
 type Storage interface {
-	// ListCapabilities returns a list of capabilities (keys and their data types) that can be subscribed to
-	ListCapabilities() ([]Capability, error)
+	// ListCapabilities returns a page of the capabilities (keys, their data
+	// types and metadata) matching query that can be subscribed to, sorted by
+	// key. The returned token continues with the next page, it is empty once
+	// all capabilities have been listed.
+	ListCapabilities(ctx context.Context, query CapabilityQuery) ([]Capability, string, error)
+
+	// Sync retrieves the current state of the specified keys along with the
+	// store revision the state corresponds to, keys may contain selectors
+	Sync(ctx context.Context, keys []string) (map[string]Data, int64, error)
+
+	// SyncAt retrieves the state of the specified keys as of a point in time,
+	// i.e. after the last change made at or before asOf, along with the store
+	// revision the state corresponds to
+	SyncAt(ctx context.Context, keys []string, asOf time.Time) (map[string]Data, int64, error)
+
+	// SyncRevision retrieves the state of the specified keys at a past store
+	// revision, future revisions return the current state
+	SyncRevision(ctx context.Context, keys []string, revision int64) (map[string]Data, error)
 
-	// Sync retrieves the current state of the specified keys
-	Sync(keys []string) (map[string]Data, error)
+	// History returns the recorded versions of a key, the most recent first,
+	// deletions are included as tombstones. A positive limit returns at most
+	// limit versions.
+	History(ctx context.Context, key string, limit int) ([]Data, error)
 
-	// Subscribe returns a channel that will receive updates for the specified keys
-	Subscribe(keys []string) (<-chan Data, error)
+	// Subscribe returns a channel that will receive updates for the specified keys.
+	// Selectors include keys created while the subscription is open.
+	// Updates are delivered in groups, the changes of an atomic batch are
+	// always part of the same group. With a zero fromRevision the current
+	// state is sent as the first group, otherwise all changes with a revision
+	// greater or equal to fromRevision are replayed.
+	// The channel is closed and all backend resources are released once ctx is done.
+	Subscribe(ctx context.Context, keys []string, fromRevision int64) (<-chan []Data, error)
+
+	// PushUpdate stores an updated value for a key, if data.ExpectedRevision
+	// is set and does not match ErrRevisionMismatch is returned
+	PushUpdate(ctx context.Context, data *Data) error
+
+	// PushBatch atomically applies all updates or none of them, entries
+	// marked as deleted remove their key
+	PushBatch(ctx context.Context, batch []Data) error
+
+	// Delete removes a key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
 
-	// PushUpdate stores an updated value for a key
-	PushUpdate(data *Data) error
+// Reverter is implemented by stores which record a batch restoring the state
+// of a past revision differently from other updates, e.g. as a revert commit
+type Reverter interface {
+	// Revert applies the batch like PushBatch
+	Revert(ctx context.Context, batch []Data, revision int64) error
 }
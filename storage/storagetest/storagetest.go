@@ -0,0 +1,851 @@
+// Package storagetest provides a conformance test suite for implementations
+// of the storage.Storage interface.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/storage"
+)
+
+// Factory returns a new, empty and writable storage. Polling backends should
+// use a short sync interval to keep the suite fast.
+type Factory func(t *testing.T) storage.Storage
+
+// Timeout is the maximum time the suite waits for a subscription update
+var Timeout = 10 * time.Second
+
+// Run runs the conformance test suite against the storage returned by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store storage.Storage)
+	}{
+		{"ListCapabilities", testListCapabilities},
+		{"ListCapabilitiesPaging", testListCapabilitiesPaging},
+		{"SyncPresent", testSyncPresent},
+		{"SyncMissing", testSyncMissing},
+		{"PushUpdateRoundTrip", testPushUpdateRoundTrip},
+		{"SubscribeInitialState", testSubscribeInitialState},
+		{"SubscribeEmptyInitialState", testSubscribeEmptyInitialState},
+		{"SubscribeOrdering", testSubscribeOrdering},
+		{"SubscribeCancel", testSubscribeCancel},
+		{"ConcurrentSubscribers", testConcurrentSubscribers},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"DeleteTombstone", testDeleteTombstone},
+		{"Revisions", testRevisions},
+		{"ResumeFromRevision", testResumeFromRevision},
+		{"ResumeWithoutInitialState", testResumeWithoutInitialState},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"CompareAndSwapCreate", testCompareAndSwapCreate},
+		{"PushBatch", testPushBatch},
+		{"PushBatchAtomic", testPushBatchAtomic},
+		{"PushBatchSingleUpdate", testPushBatchSingleUpdate},
+		{"SyncSelector", testSyncSelector},
+		{"SubscribeSelector", testSubscribeSelector},
+		{"History", testHistory},
+		{"SyncAt", testSyncAt},
+		{"SyncRevision", testSyncRevision},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+func push(t *testing.T, store storage.Storage, key, value string) {
+	t.Helper()
+	err := store.PushUpdate(context.Background(), &storage.Data{
+		Key:       key,
+		Value:     []byte(value),
+		ValueType: "text/plain",
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("PushUpdate(%s): %v", key, err)
+	}
+}
+
+// subscription reads the groups of a subscription one update at a time
+type subscription struct {
+	groups  <-chan []storage.Data
+	pending []storage.Data
+}
+
+func subscribe(t *testing.T, store storage.Storage, keys ...string) *subscription {
+	t.Helper()
+	return subscribeFrom(t, store, 0, keys...)
+}
+
+func subscribeFrom(t *testing.T, store storage.Storage, fromRevision int64, keys ...string) *subscription {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	updates, err := store.Subscribe(ctx, keys, fromRevision)
+	if err != nil {
+		t.Fatalf("Subscribe(%v, %d): %v", keys, fromRevision, err)
+	}
+	return &subscription{groups: updates}
+}
+
+func syncKeys(t *testing.T, store storage.Storage, keys ...string) (map[string]storage.Data, int64) {
+	t.Helper()
+	data, revision, err := store.Sync(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("Sync(%v): %v", keys, err)
+	}
+	return data, revision
+}
+
+// nextGroup waits for the rest of the current group or the next group
+func nextGroup(sub *subscription) ([]storage.Data, error) {
+	if len(sub.pending) > 0 {
+		group := sub.pending
+		sub.pending = nil
+		return group, nil
+	}
+	select {
+	case group, ok := <-sub.groups:
+		if !ok {
+			return nil, fmt.Errorf("subscription closed unexpectedly")
+		}
+		return group, nil
+	case <-time.After(Timeout):
+		return nil, fmt.Errorf("no update received within %s", Timeout)
+	}
+}
+
+// next waits for the next update on the subscription
+func next(sub *subscription) (storage.Data, error) {
+	for len(sub.pending) == 0 {
+		group, err := nextGroup(sub)
+		if err != nil {
+			return storage.Data{}, err
+		}
+		sub.pending = group
+	}
+	data := sub.pending[0]
+	sub.pending = sub.pending[1:]
+	return data, nil
+}
+
+// waitFor consumes updates until key holds value and returns all values
+// observed for key along the way
+func waitFor(sub *subscription, key, value string) ([]string, error) {
+	var seen []string
+	for {
+		data, err := next(sub)
+		if err != nil {
+			return seen, fmt.Errorf("waiting for %s=%s, seen %v: %w", key, value, seen, err)
+		}
+		if data.Key != key {
+			continue
+		}
+		seen = append(seen, string(data.Value))
+		if string(data.Value) == value {
+			return seen, nil
+		}
+	}
+}
+
+func receive(t *testing.T, sub *subscription) storage.Data {
+	t.Helper()
+	data, err := next(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func receiveUntil(t *testing.T, sub *subscription, key, value string) []string {
+	t.Helper()
+	seen, err := waitFor(sub, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seen
+}
+
+func testListCapabilities(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "beta", "2")
+
+	capabilities, _, err := store.ListCapabilities(context.Background(), storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatalf("ListCapabilities: %v", err)
+	}
+
+	found := make(map[string]bool)
+	for _, capability := range capabilities {
+		found[capability.Key] = true
+	}
+	for _, key := range []string{"alpha", "beta"} {
+		if !found[key] {
+			t.Errorf("capability %q not listed in %v", key, capabilities)
+		}
+	}
+}
+
+func testListCapabilitiesPaging(t *testing.T, store storage.Storage) {
+	keys := []string{"a/1", "a/2", "a/3", "a/4", "b/1"}
+	for _, key := range keys {
+		push(t, store, key, "1")
+	}
+
+	// paging through all capabilities lists every key once and in order
+	var listed []string
+	query := storage.CapabilityQuery{PageSize: 2}
+	for page := 0; ; page++ {
+		capabilities, next, err := store.ListCapabilities(context.Background(), query)
+		if err != nil {
+			t.Fatalf("ListCapabilities: %v", err)
+		}
+		if len(capabilities) > 2 {
+			t.Fatalf("page %d has %d capabilities, want at most 2", page, len(capabilities))
+		}
+		for _, capability := range capabilities {
+			listed = append(listed, capability.Key)
+		}
+		if next == "" {
+			break
+		}
+		if page > len(keys) {
+			t.Fatalf("paging did not end after %d pages", page)
+		}
+		query.PageToken = next
+	}
+	var found []string
+	for i, key := range listed {
+		if i > 0 && key <= listed[i-1] {
+			t.Errorf("capabilities not sorted: %v", listed)
+		}
+		if strings.Contains(key, "/") && key != "/" {
+			found = append(found, key)
+		}
+	}
+	if fmt.Sprint(found) != fmt.Sprint(keys) {
+		t.Errorf("paged capabilities = %v, want %v", found, keys)
+	}
+
+	// a prefix filter combined with paging
+	query = storage.CapabilityQuery{Prefix: "a/", PageSize: 3}
+	capabilities, next, err := store.ListCapabilities(context.Background(), query)
+	if err != nil {
+		t.Fatalf("ListCapabilities: %v", err)
+	}
+	if len(capabilities) != 3 || capabilities[0].Key != "a/1" || next == "" {
+		t.Fatalf("first page of a/ = %v, %q, want a/1 to a/3 and a token", capabilities, next)
+	}
+	query.PageToken = next
+	capabilities, next, err = store.ListCapabilities(context.Background(), query)
+	if err != nil {
+		t.Fatalf("ListCapabilities: %v", err)
+	}
+	if len(capabilities) != 1 || capabilities[0].Key != "a/4" || next != "" {
+		t.Fatalf("last page of a/ = %v, %q, want a/4 without a token", capabilities, next)
+	}
+
+	_, _, err = store.ListCapabilities(context.Background(), storage.CapabilityQuery{PageToken: "!"})
+	if !errors.Is(err, storage.ErrInvalidPageToken) {
+		t.Errorf("ListCapabilities with invalid token = %v, want ErrInvalidPageToken", err)
+	}
+}
+
+func testSyncPresent(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "beta", "2")
+
+	data, _ := syncKeys(t, store, "alpha", "beta")
+	if len(data) != 2 {
+		t.Fatalf("Sync returned %d entries, want 2", len(data))
+	}
+	if got := string(data["alpha"].Value); got != "1" {
+		t.Errorf("alpha = %q, want %q", got, "1")
+	}
+	if got := data["beta"].Key; got != "beta" {
+		t.Errorf("beta key = %q, want %q", got, "beta")
+	}
+}
+
+func testSyncMissing(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+
+	data, _ := syncKeys(t, store, "alpha", "missing")
+	if _, ok := data["missing"]; ok {
+		t.Errorf("Sync returned an entry for a missing key")
+	}
+	if _, ok := data["alpha"]; !ok {
+		t.Errorf("Sync did not return the present key")
+	}
+}
+
+func testPushUpdateRoundTrip(t *testing.T, store storage.Storage) {
+	value := []byte{0, 1, 2, 'x', 0xff}
+	err := store.PushUpdate(context.Background(), &storage.Data{
+		Key:       "alpha",
+		Value:     value,
+		ValueType: "binary",
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("PushUpdate: %v", err)
+	}
+	push(t, store, "beta", "first")
+	push(t, store, "beta", "second")
+
+	data, _ := syncKeys(t, store, "alpha", "beta")
+	if !bytes.Equal(data["alpha"].Value, value) {
+		t.Errorf("alpha = %v, want %v", data["alpha"].Value, value)
+	}
+	if got := string(data["beta"].Value); got != "second" {
+		t.Errorf("beta = %q, want %q", got, "second")
+	}
+}
+
+func testSubscribeInitialState(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "beta", "2")
+
+	updates := subscribe(t, store, "alpha", "beta", "missing")
+
+	// the complete state is the first group
+	group, err := nextGroup(updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := make(map[string]string)
+	for _, data := range group {
+		initial[data.Key] = string(data.Value)
+	}
+	if len(initial) != 2 || initial["alpha"] != "1" || initial["beta"] != "2" {
+		t.Errorf("initial state = %v, want alpha=1 beta=2", initial)
+	}
+}
+
+func testSubscribeEmptyInitialState(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+
+	updates := subscribe(t, store, "missing")
+	group, err := nextGroup(updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group) != 0 {
+		t.Errorf("initial state = %v, want empty", group)
+	}
+}
+
+func testSubscribeOrdering(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "0")
+	updates := subscribe(t, store, "alpha")
+	receiveUntil(t, updates, "alpha", "0")
+
+	for i := 1; i <= 5; i++ {
+		push(t, store, "alpha", fmt.Sprint(i))
+	}
+
+	// updates may be coalesced, but never go back in time
+	seen := receiveUntil(t, updates, "alpha", "5")
+	last := -1
+	for _, value := range seen {
+		var n int
+		fmt.Sscan(value, &n)
+		if n < last {
+			t.Fatalf("updates out of order: %v", seen)
+		}
+		last = n
+	}
+}
+
+func testSubscribeCancel(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := store.Subscribe(ctx, []string{"alpha"}, 0)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	cancel()
+
+	deadline := time.After(Timeout)
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("subscription not closed within %s after cancel", Timeout)
+		}
+	}
+}
+
+func testConcurrentSubscribers(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "0")
+
+	const subscribers = 5
+	subs := make([]*subscription, subscribers)
+	for i := range subs {
+		subs[i] = subscribe(t, store, "alpha")
+	}
+
+	push(t, store, "alpha", "1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, subscribers)
+	for _, sub := range subs {
+		wg.Add(1)
+		go func(sub *subscription) {
+			defer wg.Done()
+			if _, err := waitFor(sub, "alpha", "1"); err != nil {
+				errs <- err
+			}
+		}(sub)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testDelete(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "beta", "2")
+
+	if err := store.Delete(context.Background(), "alpha"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	data, _ := syncKeys(t, store, "alpha", "beta")
+	if _, ok := data["alpha"]; ok {
+		t.Errorf("Sync returned deleted key")
+	}
+	if _, ok := data["beta"]; !ok {
+		t.Errorf("Sync did not return remaining key")
+	}
+
+	capabilities, _, err := store.ListCapabilities(context.Background(), storage.CapabilityQuery{})
+	if err != nil {
+		t.Fatalf("ListCapabilities: %v", err)
+	}
+	for _, capability := range capabilities {
+		if capability.Key == "alpha" {
+			t.Errorf("deleted key still listed as capability")
+		}
+	}
+}
+
+func testDeleteMissing(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+
+	if err := store.Delete(context.Background(), "missing"); err != nil {
+		t.Fatalf("Delete of missing key: %v", err)
+	}
+}
+
+func testDeleteTombstone(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	updates := subscribe(t, store, "alpha")
+	receiveUntil(t, updates, "alpha", "1")
+
+	if err := store.Delete(context.Background(), "alpha"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	data := receive(t, updates)
+	if data.Key != "alpha" || !data.Deleted {
+		t.Fatalf("got %+v, want tombstone for alpha", data)
+	}
+
+	// a key recreated after deletion is delivered again
+	push(t, store, "alpha", "2")
+	receiveUntil(t, updates, "alpha", "2")
+}
+
+func testRevisions(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "alpha", "2")
+	push(t, store, "beta", "1")
+
+	data, revision := syncKeys(t, store, "alpha", "beta")
+	alpha, beta := data["alpha"], data["beta"]
+	if alpha.Revision <= 0 || beta.Revision <= alpha.Revision {
+		t.Errorf("revisions alpha=%d beta=%d, want 0 < alpha < beta", alpha.Revision, beta.Revision)
+	}
+	if revision < beta.Revision {
+		t.Errorf("store revision %d older than beta revision %d", revision, beta.Revision)
+	}
+	if alpha.Version != 2 || beta.Version != 1 {
+		t.Errorf("versions alpha=%d beta=%d, want 2 and 1", alpha.Version, beta.Version)
+	}
+
+	// the version restarts when a key is recreated
+	if err := store.Delete(context.Background(), "alpha"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	push(t, store, "alpha", "3")
+
+	data, next := syncKeys(t, store, "alpha")
+	if data["alpha"].Version != 1 {
+		t.Errorf("version after recreate = %d, want 1", data["alpha"].Version)
+	}
+	if data["alpha"].Revision <= beta.Revision || next <= revision {
+		t.Errorf("revision did not advance: alpha=%d store=%d, previous store=%d", data["alpha"].Revision, next, revision)
+	}
+}
+
+func testResumeFromRevision(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "alpha", "2")
+	data, _ := syncKeys(t, store, "alpha")
+	from := data["alpha"].Revision
+	push(t, store, "beta", "1")
+
+	updates := subscribeFrom(t, store, from, "alpha", "beta")
+
+	first := receive(t, updates)
+	if first.Key != "alpha" || string(first.Value) != "2" || first.Revision != from {
+		t.Fatalf("first update = %s=%s@%d, want alpha=2@%d", first.Key, first.Value, first.Revision, from)
+	}
+	second := receive(t, updates)
+	if second.Key != "beta" || second.Revision <= first.Revision {
+		t.Fatalf("second update = %s=%s@%d, want beta after %d", second.Key, second.Value, second.Revision, first.Revision)
+	}
+
+	push(t, store, "alpha", "3")
+	third := receive(t, updates)
+	if third.Key != "alpha" || string(third.Value) != "3" || third.Revision <= second.Revision {
+		t.Fatalf("third update = %s=%s@%d, want alpha=3 after %d", third.Key, third.Value, third.Revision, second.Revision)
+	}
+}
+
+func testResumeWithoutInitialState(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	_, revision := syncKeys(t, store, "alpha")
+
+	updates := subscribeFrom(t, store, revision+1, "alpha")
+	push(t, store, "alpha", "2")
+
+	data := receive(t, updates)
+	if string(data.Value) != "2" {
+		t.Fatalf("got alpha=%s, want only changes after revision %d", data.Value, revision)
+	}
+}
+
+func pushIf(store storage.Storage, key, value string, expectedRevision int64) error {
+	return store.PushUpdate(context.Background(), &storage.Data{
+		Key:              key,
+		Value:            []byte(value),
+		ValueType:        "text/plain",
+		UpdatedAt:        time.Now(),
+		ExpectedRevision: &expectedRevision,
+	})
+}
+
+func testCompareAndSwap(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	data, _ := syncKeys(t, store, "alpha")
+	revision := data["alpha"].Revision
+
+	if err := pushIf(store, "alpha", "2", revision); err != nil {
+		t.Fatalf("PushUpdate with current revision: %v", err)
+	}
+
+	// the revision read before is stale now
+	err := pushIf(store, "alpha", "3", revision)
+	if !errors.Is(err, storage.ErrRevisionMismatch) {
+		t.Fatalf("PushUpdate with stale revision = %v, want ErrRevisionMismatch", err)
+	}
+
+	data, _ = syncKeys(t, store, "alpha")
+	if got := string(data["alpha"].Value); got != "2" {
+		t.Errorf("alpha = %q after rejected update, want %q", got, "2")
+	}
+}
+
+func testCompareAndSwapCreate(t *testing.T, store storage.Storage) {
+	if err := pushIf(store, "alpha", "1", 0); err != nil {
+		t.Fatalf("PushUpdate of missing key with revision 0: %v", err)
+	}
+
+	err := pushIf(store, "alpha", "2", 0)
+	if !errors.Is(err, storage.ErrRevisionMismatch) {
+		t.Fatalf("PushUpdate of existing key with revision 0 = %v, want ErrRevisionMismatch", err)
+	}
+
+	data, _ := syncKeys(t, store, "alpha")
+	if got := string(data["alpha"].Value); got != "1" {
+		t.Errorf("alpha = %q after rejected create, want %q", got, "1")
+	}
+}
+
+func text(key, value string) storage.Data {
+	return storage.Data{
+		Key:       key,
+		Value:     []byte(value),
+		ValueType: "text/plain",
+		UpdatedAt: time.Now(),
+	}
+}
+
+func testPushBatch(t *testing.T, store storage.Storage) {
+	push(t, store, "gamma", "1")
+	_, before := syncKeys(t, store, "gamma")
+
+	batch := []storage.Data{text("alpha", "1"), text("beta", "2"), {Key: "gamma", Deleted: true}}
+	if err := store.PushBatch(context.Background(), batch); err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+
+	data, _ := syncKeys(t, store, "alpha", "beta", "gamma")
+	if string(data["alpha"].Value) != "1" || string(data["beta"].Value) != "2" {
+		t.Errorf("alpha = %q, beta = %q, want 1 and 2", data["alpha"].Value, data["beta"].Value)
+	}
+	if _, ok := data["gamma"]; ok {
+		t.Errorf("Sync returned key deleted by batch")
+	}
+	if data["alpha"].Revision <= before || data["beta"].Revision <= before {
+		t.Errorf("batch revisions alpha=%d beta=%d, want after %d", data["alpha"].Revision, data["beta"].Revision, before)
+	}
+}
+
+func testPushBatchAtomic(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+
+	// the create of alpha fails, beta must not be written either
+	created := int64(0)
+	first, second := text("beta", "1"), text("alpha", "2")
+	second.ExpectedRevision = &created
+	err := store.PushBatch(context.Background(), []storage.Data{first, second})
+	if !errors.Is(err, storage.ErrRevisionMismatch) {
+		t.Fatalf("PushBatch with stale revision = %v, want ErrRevisionMismatch", err)
+	}
+
+	data, _ := syncKeys(t, store, "alpha", "beta")
+	if _, ok := data["beta"]; ok {
+		t.Errorf("rejected batch partially applied")
+	}
+	if got := string(data["alpha"].Value); got != "1" {
+		t.Errorf("alpha = %q after rejected batch, want %q", got, "1")
+	}
+}
+
+func testPushBatchSingleUpdate(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "0")
+	sub := subscribe(t, store, "alpha", "beta")
+	receiveUntil(t, sub, "alpha", "0")
+
+	batch := []storage.Data{text("alpha", "1"), text("beta", "1")}
+	if err := store.PushBatch(context.Background(), batch); err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+
+	group, err := nextGroup(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for _, data := range group {
+		values[data.Key] = string(data.Value)
+	}
+	if len(group) != 2 || values["alpha"] != "1" || values["beta"] != "1" {
+		t.Fatalf("got %v, want alpha=1 and beta=1 in one update", values)
+	}
+}
+
+func testSyncSelector(t *testing.T, store storage.Storage) {
+	push(t, store, "services/payments/a", "1")
+	push(t, store, "services/payments/b", "2")
+	push(t, store, "services/payments/x/c", "3")
+	push(t, store, "services/users/a", "4")
+	push(t, store, "alpha", "5")
+
+	tests := []struct {
+		keys []string
+		want []string
+	}{
+		{[]string{"services/payments/*"}, []string{"services/payments/a", "services/payments/b"}},
+		{[]string{"services/"}, []string{"services/payments/a", "services/payments/b", "services/payments/x/c", "services/users/a"}},
+		{[]string{"services/*/a", "alpha"}, []string{"alpha", "services/payments/a", "services/users/a"}},
+		{[]string{"missing/*"}, nil},
+	}
+	for _, tt := range tests {
+		data, _ := syncKeys(t, store, tt.keys...)
+		if len(data) != len(tt.want) {
+			t.Errorf("Sync(%v) returned %d entries, want %v", tt.keys, len(data), tt.want)
+			continue
+		}
+		for _, key := range tt.want {
+			if _, ok := data[key]; !ok {
+				t.Errorf("Sync(%v) did not return %s", tt.keys, key)
+			}
+		}
+	}
+}
+
+func testSubscribeSelector(t *testing.T, store storage.Storage) {
+	push(t, store, "services/payments/a", "1")
+	sub := subscribe(t, store, "services/payments/*")
+	receiveUntil(t, sub, "services/payments/a", "1")
+
+	// keys outside the selector are not delivered, new keys inside it are
+	push(t, store, "services/users/a", "1")
+	push(t, store, "services/payments/b", "2")
+	data := receive(t, sub)
+	if data.Key != "services/payments/b" || string(data.Value) != "2" {
+		t.Fatalf("got %s=%s, want services/payments/b=2", data.Key, data.Value)
+	}
+
+	if err := store.Delete(context.Background(), "services/payments/a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	data = receive(t, sub)
+	if data.Key != "services/payments/a" || !data.Deleted {
+		t.Fatalf("got %+v, want tombstone for services/payments/a", data)
+	}
+}
+
+func testHistory(t *testing.T, store storage.Storage) {
+	push(t, store, "alpha", "1")
+	push(t, store, "alpha", "2")
+	if err := store.Delete(context.Background(), "alpha"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	push(t, store, "alpha", "3")
+	push(t, store, "beta", "1")
+
+	history, err := store.History(context.Background(), "alpha", 0)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	want := []struct {
+		value   string
+		deleted bool
+		version int64
+	}{{"3", false, 1}, {"", true, 0}, {"2", false, 2}, {"1", false, 1}}
+	if len(history) != len(want) {
+		t.Fatalf("History returned %d versions, want %d: %+v", len(history), len(want), history)
+	}
+	for i, w := range want {
+		got := history[i]
+		if got.Key != "alpha" || got.Deleted != w.deleted || !w.deleted && (string(got.Value) != w.value || got.Version != w.version) {
+			t.Errorf("version %d = %+v, want value %q deleted %v version %d", i, got, w.value, w.deleted, w.version)
+		}
+		if got.UpdatedAt.IsZero() || i > 0 && got.Revision >= history[i-1].Revision {
+			t.Errorf("version %d = %+v, want a time and a revision before %d", i, got, history[i-1].Revision)
+		}
+	}
+
+	history, err = store.History(context.Background(), "alpha", 2)
+	if err != nil || len(history) != 2 || string(history[0].Value) != "3" || !history[1].Deleted {
+		t.Errorf("History with limit 2 = %+v, %v, want the latest two versions", history, err)
+	}
+	history, err = store.History(context.Background(), "missing", 0)
+	if err != nil || len(history) != 0 {
+		t.Errorf("History of a missing key = %+v, %v", history, err)
+	}
+}
+
+func testSyncAt(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	push(t, store, "alpha", "1")
+	push(t, store, "beta", "1")
+	_, revision := syncKeys(t, store, "alpha", "beta")
+	asOf := time.Now()
+
+	// commit times of some backends have a resolution of one second
+	time.Sleep(1100 * time.Millisecond)
+	push(t, store, "alpha", "2")
+	if err := store.Delete(ctx, "beta"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	push(t, store, "gamma", "1")
+
+	for _, keys := range [][]string{{"alpha", "beta", "gamma"}, {"*"}} {
+		data, at, err := store.SyncAt(ctx, keys, asOf)
+		if err != nil {
+			t.Fatalf("SyncAt: %v", err)
+		}
+		if len(data) != 2 || string(data["alpha"].Value) != "1" || string(data["beta"].Value) != "1" {
+			t.Errorf("SyncAt(%v) = %v, want alpha=1 and beta=1", keys, data)
+		}
+		if at != revision {
+			t.Errorf("SyncAt(%v) revision = %d, want %d", keys, at, revision)
+		}
+	}
+
+	current, revision := syncKeys(t, store, "alpha", "beta", "gamma")
+	data, at, err := store.SyncAt(ctx, []string{"alpha", "beta", "gamma"}, time.Now())
+	if err != nil || len(data) != 2 || string(data["alpha"].Value) != "2" || at != revision {
+		t.Errorf("SyncAt now = %v@%d, %v, want %v@%d", data, at, err, current, revision)
+	}
+
+	data, at, err = store.SyncAt(ctx, []string{"alpha"}, asOf.Add(-time.Hour))
+	if err != nil || len(data) != 0 || at != 0 {
+		t.Errorf("SyncAt before the first change = %v@%d, %v, want nothing", data, at, err)
+	}
+
+	// changes are looked up by the time they were made, not by their update
+	// time which is set by clients
+	for _, updatedAt := range []time.Time{asOf.Add(-24 * time.Hour), time.Now().Add(24 * time.Hour)} {
+		if err := store.PushUpdate(ctx, &storage.Data{Key: "delta", Value: []byte("1"), UpdatedAt: updatedAt}); err != nil {
+			t.Fatalf("PushUpdate: %v", err)
+		}
+	}
+	if data, _, err := store.SyncAt(ctx, []string{"delta"}, asOf); err != nil || len(data) != 0 {
+		t.Errorf("SyncAt before a backdated change = %v, %v, want nothing", data, err)
+	}
+	if data, _, err := store.SyncAt(ctx, []string{"delta"}, time.Now()); err != nil || len(data) != 1 {
+		t.Errorf("SyncAt after a future dated change = %v, %v, want delta", data, err)
+	}
+}
+
+func testSyncRevision(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	push(t, store, "alpha", "1")
+	push(t, store, "dir/beta", "1")
+	_, first := syncKeys(t, store, "alpha")
+	push(t, store, "alpha", "2")
+	_, second := syncKeys(t, store, "alpha")
+	if err := store.Delete(ctx, "dir/beta"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	push(t, store, "gamma", "1")
+	_, current := syncKeys(t, store, "alpha")
+
+	tests := []struct {
+		keys     []string
+		revision int64
+		want     map[string]string
+	}{
+		{storage.AllKeys, first, map[string]string{"alpha": "1", "dir/beta": "1"}},
+		{[]string{"alpha", "dir/"}, second, map[string]string{"alpha": "2", "dir/beta": "1"}},
+		{storage.AllKeys, current + 10, map[string]string{"alpha": "2", "gamma": "1"}},
+		{[]string{"alpha"}, 0, map[string]string{}},
+	}
+	for _, tt := range tests {
+		data, err := store.SyncRevision(ctx, tt.keys, tt.revision)
+		if err != nil {
+			t.Fatalf("SyncRevision: %v", err)
+		}
+		got := make(map[string]string, len(data))
+		for key, d := range data {
+			got[key] = string(d.Value)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("SyncRevision(%v, %d) = %v, want %v", tt.keys, tt.revision, got, tt.want)
+		}
+	}
+}
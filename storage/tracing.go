@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of backend operations, they are recorded once a
+// tracer provider is installed, see the tracing package
+var tracer = otel.Tracer("github.com/bartke/datastream/storage")
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
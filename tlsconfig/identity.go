@@ -0,0 +1,61 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Identity is the subject of a verified client certificate
+type Identity struct {
+	CommonName     string
+	Organizations  []string
+	DNSNames       []string
+	EmailAddresses []string
+	// URIs holds URI SANs such as SPIFFE IDs
+	URIs []string
+	// Fingerprint is the hex encoded SHA-256 of the certificate
+	Fingerprint string
+}
+
+// Name returns the first URI SAN if there is one, the common name otherwise
+func (i Identity) Name() string {
+	if len(i.URIs) > 0 {
+		return i.URIs[0]
+	}
+	return i.CommonName
+}
+
+// NewIdentity returns the identity of a certificate
+func NewIdentity(cert *x509.Certificate) Identity {
+	fingerprint := sha256.Sum256(cert.Raw)
+	identity := Identity{
+		CommonName:     cert.Subject.CommonName,
+		Organizations:  cert.Subject.Organization,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+// PeerIdentity returns the identity of the verified client certificate of a
+// call, it is only available on servers configured with a CA file
+func PeerIdentity(ctx context.Context) (Identity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Identity{}, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	return NewIdentity(info.State.VerifiedChains[0][0]), true
+}
@@ -0,0 +1,191 @@
+// Package tlsconfig builds TLS and mutual TLS configurations for DataService
+// servers and clients from PEM files. Certificates and the CA bundles of
+// servers are reloaded when the files change, so they can be rotated without a
+// restart.
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultReloadInterval is the minimum interval between checks of the files
+const DefaultReloadInterval = 30 * time.Second
+
+type Config struct {
+	// CertFile and KeyFile hold the certificate and key, they are required for
+	// servers and optional for clients, which present them for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// optional CA bundle, servers require client certificates signed by it,
+	// clients verify the server against it instead of the system roots
+	CAFile string
+
+	// optional server name clients verify, default is the host of the address
+	ServerName string
+
+	// optional, clients do not verify the server certificate
+	InsecureSkipVerify bool
+
+	// optional minimum interval between checks of the files for changes,
+	// default is DefaultReloadInterval, negative disables reloading
+	ReloadInterval time.Duration
+
+	// optional channel for reload errors, the previous files stay in use
+	ErrorChannel chan<- error
+}
+
+// files holds the loaded certificate and CA pool, they are checked for
+// changes on handshakes at most once per reload interval
+type files struct {
+	config Config
+
+	mu       sync.Mutex
+	checked  time.Time
+	contents [3][]byte
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newFiles(config Config) (*files, error) {
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = DefaultReloadInterval
+	}
+	f := &files{config: config}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+// reload reads the files and replaces the certificate and pool if any changed
+func (f *files) reload() error {
+	var contents [3][]byte
+	for i, path := range []string{f.config.CertFile, f.config.KeyFile, f.config.CAFile} {
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents[i] = b
+	}
+	if bytes.Equal(contents[0], f.contents[0]) && bytes.Equal(contents[1], f.contents[1]) && bytes.Equal(contents[2], f.contents[2]) {
+		return nil
+	}
+
+	var cert *tls.Certificate
+	if f.config.CertFile != "" || f.config.KeyFile != "" {
+		c, err := tls.X509KeyPair(contents[0], contents[1])
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", f.config.CertFile, err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if f.config.CAFile != "" {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(contents[2]) {
+			return fmt.Errorf("no certificates found in %s", f.config.CAFile)
+		}
+	}
+
+	f.contents, f.cert, f.pool = contents, cert, pool
+	return nil
+}
+
+// current returns the certificate and pool, reloading them if they are due
+func (f *files) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.config.ReloadInterval > 0 && time.Since(f.checked) >= f.config.ReloadInterval {
+		f.checked = time.Now()
+		if err := f.reload(); err != nil && f.config.ErrorChannel != nil {
+			f.config.ErrorChannel <- fmt.Errorf("tls reload: %w", err)
+		}
+	}
+	return f.cert, f.pool
+}
+
+// NewServerConfig returns a server configuration, client certificates are
+// required and verified if a CA file is set
+func NewServerConfig(config Config) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls: servers require a certificate and key")
+	}
+	f, err := newFiles(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := f.current()
+			c := &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				MinVersion:   tls.VersionTLS12,
+				// the config replaces the one gRPC added its protocol to
+				NextProtos: []string{"h2"},
+			}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// NewClientConfig returns a client configuration presenting the certificate
+// if one is set. The server is verified against the CA file as of the call.
+func NewClientConfig(config Config) (*tls.Config, error) {
+	f, err := newFiles(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// crypto/tls verifies the server, only the client certificate is reloaded
+	_, pool := f.current()
+	return &tls.Config{
+		ServerName:         config.ServerName,
+		RootCAs:            pool,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := f.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}, nil
+}
+
+// NewServerCredentials returns gRPC server credentials, see NewServerConfig
+func NewServerCredentials(config Config) (credentials.TransportCredentials, error) {
+	c, err := NewServerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(c), nil
+}
+
+// NewClientCredentials returns gRPC client credentials, see NewClientConfig
+func NewClientCredentials(config Config) (credentials.TransportCredentials, error) {
+	c, err := NewClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(c), nil
+}
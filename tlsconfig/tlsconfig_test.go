@@ -0,0 +1,301 @@
+package tlsconfig_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"github.com/bartke/datastream/tlsconfig"
+	"google.golang.org/grpc"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), name+".crt")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &authority{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate for localhost signed by the authority to
+// certFile and keyFile
+func (a *authority) issue(t *testing.T, certFile, keyFile, name string, uris ...string) {
+	t.Helper()
+	a.issueFor(t, certFile, keyFile, name, "localhost", net.ParseIP("127.0.0.1"), uris...)
+}
+
+// issueFor writes a certificate for host and ip signed by the authority to
+// certFile and keyFile
+func (a *authority) issueFor(t *testing.T, certFile, keyFile, name, host string, ip net.IP, uris ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"platform"}},
+		DNSNames:     []string{host},
+		IPAddresses:  []net.IP{ip},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA := newAuthority(t, "server-ca"), newAuthority(t, "client-ca")
+	serverCA.issue(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "datastreamd")
+	clientCA.issue(t, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), "ctl", "spiffe://example.org/ctl")
+
+	serverCreds, err := tlsconfig.NewServerCredentials(tlsconfig.Config{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   clientCA.file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := make(chan tlsconfig.Identity, 1)
+	identify := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if identity, ok := tlsconfig.PeerIdentity(ctx); ok {
+			identities <- identity
+		}
+		return handler(ctx, req)
+	}
+	server := grpc.NewServer(grpc.Creds(serverCreds), grpc.UnaryInterceptor(identify))
+	datastream.RegisterDataServiceServer(server, service.NewDataServiceServer(storage.NewMemoryStorage(storage.MemoryConfig{})))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	sync := func(config tlsconfig.Config) error {
+		creds, err := tlsconfig.NewClientCredentials(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = datastream.NewDataServiceClient(conn).Sync(ctx, &datastream.DataRequest{Keys: []string{"key"}})
+		return err
+	}
+
+	err = sync(tlsconfig.Config{
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		CAFile:     serverCA.file,
+		ServerName: "localhost",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := <-identities
+	if identity.Name() != "spiffe://example.org/ctl" || identity.CommonName != "ctl" || identity.Organizations[0] != "platform" || len(identity.Fingerprint) != 64 {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	if err := sync(tlsconfig.Config{CAFile: serverCA.file, ServerName: "localhost"}); err == nil {
+		t.Error("call without client certificate succeeded")
+	}
+	if err := sync(tlsconfig.Config{
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		CAFile:     clientCA.file,
+		ServerName: "localhost",
+	}); err == nil {
+		t.Error("call to a server of an untrusted CA succeeded")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, "ca")
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca.issue(t, certFile, keyFile, "first")
+
+	errs := make(chan error, 1)
+	serverConfig, err := tlsconfig.NewServerConfig(tlsconfig.Config{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: time.Nanosecond,
+		ErrorChannel:   errs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	clientConfig, err := tlsconfig.NewClientConfig(tlsconfig.Config{CAFile: ca.file, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := served(); name != "first" {
+		t.Fatalf("served %s, want first", name)
+	}
+	ca.issue(t, certFile, keyFile, "second")
+	if name := served(); name != "second" {
+		t.Errorf("served %s after rotation, want second", name)
+	}
+
+	// a broken certificate is reported and the previous one stays in use
+	if err := os.WriteFile(certFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if name := served(); name != "second" {
+		t.Errorf("served %s after a failed reload, want second", name)
+	}
+	if err := <-errs; !strings.Contains(err.Error(), "tls reload") {
+		t.Errorf("reload error = %v", err)
+	}
+}
+
+func TestVerifyIPAddress(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, "ca")
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+	ca.issueFor(t, certFile, keyFile, "other", "other.example", net.ParseIP("10.0.0.1"))
+	serverConfig, err := tlsconfig.NewServerConfig(tlsconfig.Config{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// the address is verified against the IP SANs of the certificate when no
+	// server name is configured
+	clientConfig, err := tlsconfig.NewClientConfig(tlsconfig.Config{CAFile: ca.file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func() error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial(); err == nil {
+		t.Error("handshake with a certificate for another address succeeded")
+	}
+	ca.issue(t, certFile, keyFile, "local")
+	if err := dial(); err != nil {
+		t.Errorf("handshake with a certificate for 127.0.0.1: %v", err)
+	}
+}
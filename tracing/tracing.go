@@ -0,0 +1,127 @@
+// Package tracing exports OpenTelemetry traces of DataService calls and of the
+// backend operations they cause, e.g. SQL queries, git pulls and S3 requests,
+// to an OTLP collector or stdout.
+//
+//	provider, err := tracing.New(ctx, tracing.Config{Exporter: tracing.ExporterOTLP, Insecure: true})
+//	defer provider.Shutdown(ctx)
+//	grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor(), shared.LogMiddleware),
+//		grpc.StreamInterceptor(tracing.StreamServerInterceptor()),
+//	)
+//
+// Clients dial with DialOptions to propagate the trace context of their calls,
+// including the subscriptions of the client package, to the server.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"google.golang.org/grpc"
+)
+
+const (
+	// ExporterOTLP exports spans to an OTLP collector over gRPC
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes spans as JSON, e.g. for local debugging
+	ExporterStdout = "stdout"
+
+	// DefaultServiceName is the service name used when Config.ServiceName is
+	// empty
+	DefaultServiceName = "datastream"
+)
+
+type Config struct {
+	// Exporter is ExporterOTLP or ExporterStdout
+	Exporter string
+
+	// optional OTLP collector address, default is localhost:4317
+	Endpoint string
+	// optional, connect to the OTLP collector without TLS
+	Insecure bool
+
+	// optional writer of the stdout exporter, default is os.Stdout
+	Writer io.Writer
+
+	// optional service name of the spans, default is DefaultServiceName
+	ServiceName string
+
+	// optional fraction of the traces started here which are sampled, calls
+	// follow the sampling decision of their client, default is 1
+	SampleRatio float64
+}
+
+// New creates a tracer provider exporting to the configured exporter and
+// installs it and the W3C trace context propagator globally. Shutdown flushes
+// the spans not exported yet. It is meant to be called once per process, the
+// instrumentation keeps using the first provider installed.
+func New(ctx context.Context, config Config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case ExporterOTLP:
+		var options []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case ExporterStdout:
+		writer := config.Writer
+		if writer == nil {
+			writer = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(writer))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", config.Exporter, err)
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultServiceName
+	}
+	if config.SampleRatio == 0 {
+		config.SampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider, nil
+}
+
+// UnaryServerInterceptor and StreamServerInterceptor start a span for every
+// call, continuing the trace propagated by the client
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return otelgrpc.UnaryServerInterceptor()
+}
+
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return otelgrpc.StreamServerInterceptor()
+}
+
+// DialOptions start a span for every call of a client connection and
+// propagate its trace context to the server
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	}
+}
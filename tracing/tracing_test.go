@@ -0,0 +1,162 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bartke/datastream/client"
+	"github.com/bartke/datastream/generated/datastream"
+	"github.com/bartke/datastream/storage"
+	"github.com/bartke/datastream/storage/service"
+	"github.com/bartke/datastream/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// span is the part of a span written by the stdout exporter the tests check
+type span struct {
+	Name        string
+	SpanKind    trace.SpanKind
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+}
+
+// decodeSpans returns the spans written to buf by name and kind, e.g.
+// "INSERT data (client)"
+func decodeSpans(t *testing.T, buf *bytes.Buffer) map[string]span {
+	t.Helper()
+	spans := make(map[string]span)
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var s span
+		if err := decoder.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans[fmt.Sprintf("%s (%s)", s.Name, s.SpanKind)] = s
+	}
+	return spans
+}
+
+// checkChild fails unless the span named child is a child of the span named
+// parent
+func checkChild(t *testing.T, spans map[string]span, parent, child string) {
+	t.Helper()
+	p, ok := spans[parent]
+	if !ok {
+		t.Fatalf("no %q span in %v", parent, spans)
+	}
+	c, ok := spans[child]
+	if !ok {
+		t.Fatalf("no %q span in %v", child, spans)
+	}
+	if c.Parent.TraceID != p.SpanContext.TraceID || c.Parent.SpanID != p.SpanContext.SpanID {
+		t.Errorf("span %q has parent %v, want %q %v", child, c.Parent, parent, p.SpanContext)
+	}
+}
+
+// startServer serves a traced SQLite store and returns the server and a traced
+// connection
+func startServer(t *testing.T) (*grpc.Server, *grpc.ClientConn) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE data (key TEXT PRIMARY KEY, value BLOB, value_type TEXT, updated_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewSQLiteStorage(storage.SQLConfig{DB: db, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(tracing.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(tracing.StreamServerInterceptor()),
+	)
+	datastream.RegisterDataServiceServer(server, service.NewDataServiceServer(store))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	options := append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, tracing.DialOptions()...)
+	conn, err := grpc.Dial("bufnet", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return server, conn
+}
+
+// provider writes to buf, it is installed once as the instrumentation keeps
+// using the first installed provider
+var (
+	buf      bytes.Buffer
+	provider *sdktrace.TracerProvider
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	provider, err = tracing.New(context.Background(), tracing.Config{Exporter: tracing.ExporterStdout, Writer: &buf})
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestTracing(t *testing.T) {
+	buf.Reset()
+	server, conn := startServer(t)
+	service := datastream.NewDataServiceClient(conn)
+
+	ctx := context.Background()
+	if _, err := service.PushUpdate(ctx, &datastream.Data{Key: "alpha", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscription of the client library is traced across the call
+	c := client.New(service, client.Config{Keys: []string{"alpha"}})
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	if err := c.WaitSynced(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-done
+	// the spans of calls end once their handlers return
+	server.GracefulStop()
+
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := decodeSpans(t, &buf)
+	checkChild(t, spans, "datastream.DataService/PushUpdate (client)", "datastream.DataService/PushUpdate (server)")
+	checkChild(t, spans, "datastream.DataService/PushUpdate (server)", "INSERT data (client)")
+	checkChild(t, spans, "client subscribe (internal)", "datastream.DataService/Subscribe (client)")
+	checkChild(t, spans, "datastream.DataService/Subscribe (client)", "datastream.DataService/Subscribe (server)")
+}
+
+func TestNewUnknownExporter(t *testing.T) {
+	if _, err := tracing.New(context.Background(), tracing.Config{Exporter: "jaeger"}); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}